@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"forum/internal/data"
+	"forum/internal/jsonlog"
+	"forum/internal/jwt"
+	"forum/internal/mailer"
+	"forum/internal/settings"
+	"forum/internal/validator"
+)
+
+// The flags holding secrets, which -print-config redacts.
+var secretFlags = []string{"smtp-password", "cursor-secret", "jwt-keys"}
+
+// loadConfig defines a flag for every setting and fills in the config struct from the
+// flag defaults, the configuration file, GREENLIGHT_* environment variables and the
+// command-line flags, in increasing order of precedence. See the internal/settings
+// package for how the file and the environment variables map onto the flags.
+func loadConfig(fs *flag.FlagSet, args []string) (config, error) {
+	var cfg config
+	fs.StringVar(&cfg.configFile, "config", "", "Path of a YAML, TOML or JSON configuration file")
+	fs.BoolVar(&cfg.printConfig, "print-config", false, "Print the effective configuration, with secrets redacted, and exit")
+	// Read the value of the port and env command-line flags into the config struct. We
+	// default to using the port number 4000 and the environment "development" if no
+	// corresponding flags are provided.
+	fs.IntVar(&cfg.port, "port", 4000, "Api server port")
+	fs.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "./migrateDB/test.db", "Database DSN: a SQLite file path or a postgres:// URL")
+	// Read the connection pool settings from command-line flags into the config struct.
+	// Notice the default values that we're using
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "Database max open connections")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "Database max idle connections")
+	fs.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "Database max connection idle time")
+	fs.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", data.DefaultQueryTimeout, "Maximum time a single database query may take")
+	fs.DurationVar(&cfg.db.slowQueryThreshold, "db-slow-query-threshold", 500*time.Millisecond, "Log queries slower than this (0 disables the slow query log)")
+
+	// Read the SMTP server configuration settings into the config struct. There are
+	// deliberately no default credentials: set them in the configuration file or the
+	// environment, or read the password from a file with -smtp-password-file.
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	smtpPasswordFile := fs.String("smtp-password-file", "", "Read the SMTP password from this file")
+	fs.StringVar(&cfg.smtp.tls, "smtp-tls", mailer.TLSOpportunistic, "SMTP connection security (opportunistic|starttls|tls|none)")
+	fs.StringVar(&cfg.mail.transport, "mail-transport", "smtp", "How emails are delivered (smtp|file|memory)")
+	fs.StringVar(&cfg.mail.dir, "mail-dir", "./tmp/mail", "Directory the file mail transport writes .eml files to")
+	fs.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.alexedwards.net>", "SMTP sender")
+	fs.IntVar(&cfg.outbox.workers, "outbox-workers", 2, "Number of workers delivering queued emails")
+	fs.DurationVar(&cfg.outbox.pollInterval, "outbox-poll-interval", 5*time.Second, "How often idle outbox workers look for due emails")
+	fs.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 8, "Attempts at delivering an email before it is marked as failed")
+	fs.DurationVar(&cfg.outbox.backoff, "outbox-backoff", 30*time.Second, "Delay before retrying an email, doubled with every attempt")
+	fs.DurationVar(&cfg.outbox.drainTimeout, "outbox-drain-timeout", 10*time.Second, "How long shutdown waits for the due emails to be delivered")
+	/// Use the flag.Func() function to process the -cors-trusted-origins command line
+	// flag. In this we use the strings.Fields() function to split the flag value into a
+	// slice based on whitespace characters and assign it to our config struct.
+	// Importantly, if the -cors-trusted-origins flag is not present, contains the empty
+	// string, or contains only whitespace, then strings.Fields() will return an empty
+	// []string slice.
+	fs.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
+		cfg.cors.trusredOrigins = strings.Fields(val)
+		return nil
+	})
+	fs.StringVar(&cfg.cursor.secret, "cursor-secret", "", "Secret for signing pagination cursors")
+	cursorSecretFile := fs.String("cursor-secret-file", "", "Read the cursor secret from this file")
+	fs.DurationVar(&cfg.accessCache.ttl, "access-cache-ttl", time.Minute, "How long to cache user roles and permissions (0 disables the cache)")
+	fs.DurationVar(&cfg.tokens.passwordResetTTL, "password-reset-token-ttl", 45*time.Minute, "How long a password reset token stays valid")
+	fs.DurationVar(&cfg.tokens.authenticationTTL, "auth-token-ttl", 12*time.Hour, "How long an authentication token stays valid after it was last used")
+	fs.DurationVar(&cfg.tokens.janitorInterval, "token-janitor-interval", time.Hour, "How often expired tokens are deleted")
+	fs.StringVar(&cfg.tokens.mode, "auth-token-mode", authModeOpaque, "Authentication tokens issued on sign-in (opaque|jwt)")
+	fs.DurationVar(&cfg.tokens.accessTTL, "access-token-ttl", 15*time.Minute, "How long a signed access token stays valid, in jwt mode")
+	fs.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "How long a refresh token stays valid after it was last used, in jwt mode")
+	fs.StringVar(&cfg.tokens.jwtKeys, "jwt-keys", "", "Keys signing the access tokens, as space separated id:algorithm:base64-key entries with the signing key first (algorithm HS256 or EdDSA)")
+	jwtKeysFile := fs.String("jwt-keys-file", "", "Read the access token keys from this file")
+	// Create command line flags to read the setting values into the config struct.
+	// Notice that we use true as the default for the 'enabled' setting?
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	fs.Float64Var(&cfg.limiter.strictRps, "limiter-strict-rps", 0.2, "Rate limiter maximum requests per second for login and registration")
+	fs.IntVar(&cfg.limiter.strictBurst, "limiter-strict-burst", 5, "Rate limiter maximum burst for login and registration")
+	fs.Func("limiter-trusted-proxies", "Proxies trusted to set X-Forwarded-For (space separated IPs or CIDRs)", func(val string) error {
+		var err error
+		cfg.limiter.trustedProxies, err = parseTrustedProxies(val)
+		return err
+	})
+	// The Level type implements encoding.TextUnmarshaler, so flag.TextVar() can parse
+	// level names like "debug" straight into it.
+	fs.TextVar(&cfg.log.level, "log-level", jsonlog.LevelInfo, "Minimum log level (debug|info|warn|error|fatal|off)")
+	fs.BoolVar(&cfg.log.stackTraces, "log-stack-traces", false, "Include stack traces in error log entries")
+	fs.DurationVar(&cfg.log.sampleTick, "log-sample-tick", time.Second, "Log sampling interval")
+	fs.IntVar(&cfg.log.sampleFirst, "log-sample-first", 0, "Log the first N identical entries per interval (0 disables sampling)")
+	fs.IntVar(&cfg.log.sampleThereafter, "log-sample-thereafter", 100, "After that, log every Nth identical entry per interval")
+	fs.DurationVar(&cfg.shutdown.drainDelay, "shutdown-drain-delay", 0, "Time to report not ready before shutting down the server")
+	fs.BoolVar(&cfg.healthcheck.smtp, "healthcheck-smtp", false, "Check that the SMTP server is reachable in the readiness check")
+	fs.StringVar(&cfg.metrics.addr, "metrics-addr", "", "Separate listen address for the Prometheus metrics, e.g. localhost:9090")
+	fs.StringVar(&cfg.adminEmail, "admin-email", "", "Grant the admin role to the user with this email at startup")
+
+	err := settings.Load(fs, args, settings.Options{FileFlag: "config", EnvPrefix: "GREENLIGHT_"})
+	if err != nil {
+		return cfg, err
+	}
+	// Read the secrets kept in files, so that they don't have to be passed on the
+	// command line, where other users of the machine can see them.
+	err = readSecretFile(fs, "smtp-password", *smtpPasswordFile)
+	if err != nil {
+		return cfg, err
+	}
+	err = readSecretFile(fs, "cursor-secret", *cursorSecretFile)
+	if err != nil {
+		return cfg, err
+	}
+	err = readSecretFile(fs, "jwt-keys", *jwtKeysFile)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// readSecretFile sets a flag to the contents of a file, without the trailing newline.
+// Setting the flag directly as well as through the file is an error, as one of the
+// two values would be silently ignored.
+func readSecretFile(fs *flag.FlagSet, name, path string) error {
+	if path == "" {
+		return nil
+	}
+	if fs.Lookup(name).Value.String() != "" {
+		return fmt.Errorf("-%s and -%s-file can't both be set", name, name)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return fs.Set(name, strings.TrimRight(string(content), "\r\n"))
+}
+
+// validate checks the whole configuration, returning an error which lists every
+// problem found.
+func (cfg config) validate() error {
+	v := validator.New()
+	v.Check(cfg.port > 0 && cfg.port <= 65535, "port", "must be between 1 and 65535")
+	v.Check(validator.PermittedValue(cfg.env, "development", "staging", "production"), "env", "must be development, staging or production")
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+	_, _, err := data.ParseDSN(cfg.db.dsn)
+	v.Check(err == nil, "db-dsn", "must be a SQLite file path or a postgres:// URL")
+	_, err = time.ParseDuration(cfg.db.maxIdleTime)
+	v.Check(err == nil, "db-max-idle-time", "must be a duration like 15m")
+	v.Check(cfg.db.queryTimeout > 0, "db-query-timeout", "must be greater than zero")
+	v.Check(cfg.db.slowQueryThreshold >= 0, "db-slow-query-threshold", "must not be negative")
+	v.Check(validator.PermittedValue(cfg.mail.transport, "smtp", "file", "memory"), "mail-transport", "must be smtp, file or memory")
+	v.Check(cfg.smtp.sender != "", "smtp-sender", "must be provided")
+	// The SMTP server only has to be configured when it is used.
+	if cfg.mail.transport == "smtp" {
+		v.Check(cfg.smtp.host != "", "smtp-host", "must be provided")
+		v.Check(cfg.smtp.port > 0 && cfg.smtp.port <= 65535, "smtp-port", "must be between 1 and 65535")
+		v.Check(cfg.smtp.username == "" || cfg.smtp.password != "", "smtp-password", "must be provided with smtp-username")
+		v.Check(validator.PermittedValue(cfg.smtp.tls, mailer.TLSModes...), "smtp-tls", "must be opportunistic, starttls, tls or none")
+	} else {
+		v.Check(!cfg.healthcheck.smtp, "healthcheck-smtp", "can only be used with the smtp mail transport")
+	}
+	if cfg.mail.transport == "file" {
+		v.Check(cfg.mail.dir != "", "mail-dir", "must be provided")
+	}
+	v.Check(cfg.outbox.workers > 0, "outbox-workers", "must be greater than zero")
+	v.Check(cfg.outbox.pollInterval > 0, "outbox-poll-interval", "must be greater than zero")
+	v.Check(cfg.outbox.maxAttempts > 0, "outbox-max-attempts", "must be greater than zero")
+	v.Check(cfg.outbox.backoff > 0, "outbox-backoff", "must be greater than zero")
+	v.Check(cfg.outbox.drainTimeout >= 0, "outbox-drain-timeout", "must not be negative")
+	v.Check(cfg.accessCache.ttl >= 0, "access-cache-ttl", "must not be negative")
+	v.Check(cfg.tokens.passwordResetTTL > 0, "password-reset-token-ttl", "must be greater than zero")
+	v.Check(cfg.tokens.authenticationTTL > 0, "auth-token-ttl", "must be greater than zero")
+	v.Check(cfg.tokens.janitorInterval > 0, "token-janitor-interval", "must be greater than zero")
+	v.Check(validator.PermittedValue(cfg.tokens.mode, authModeOpaque, authModeJWT), "auth-token-mode", "must be opaque or jwt")
+	// The signed access tokens need keys, and a refresh token should outlive the
+	// access tokens it is exchanged for.
+	if cfg.tokens.mode == authModeJWT {
+		if _, err := jwt.ParseKeySet(cfg.tokens.jwtKeys); err != nil {
+			v.AddError("jwt-keys", err.Error())
+		}
+		v.Check(cfg.tokens.accessTTL > 0, "access-token-ttl", "must be greater than zero")
+		v.Check(cfg.tokens.refreshTTL > cfg.tokens.accessTTL, "refresh-token-ttl", "must be longer than access-token-ttl")
+	}
+	if cfg.limiter.enabled {
+		v.Check(cfg.limiter.rps > 0, "limiter-rps", "must be greater than zero")
+		v.Check(cfg.limiter.burst > 0, "limiter-burst", "must be greater than zero")
+		v.Check(cfg.limiter.strictRps > 0, "limiter-strict-rps", "must be greater than zero")
+		v.Check(cfg.limiter.strictBurst > 0, "limiter-strict-burst", "must be greater than zero")
+	}
+	v.Check(cfg.log.sampleTick > 0, "log-sample-tick", "must be greater than zero")
+	v.Check(cfg.log.sampleFirst >= 0, "log-sample-first", "must not be negative")
+	v.Check(cfg.log.sampleThereafter >= 0, "log-sample-thereafter", "must not be negative")
+	v.Check(cfg.shutdown.drainDelay >= 0, "shutdown-drain-delay", "must not be negative")
+	if cfg.metrics.addr != "" {
+		_, _, err := net.SplitHostPort(cfg.metrics.addr)
+		v.Check(err == nil, "metrics-addr", "must be a host:port address")
+	}
+	// Outside of development, cursors have to stay valid across restarts and between
+	// instances, so the secret must be configured.
+	if cfg.env != "development" {
+		v.Check(len(cfg.cursor.secret) >= 32, "cursor-secret", "must be at least 32 bytes long outside of development")
+	}
+	if v.Valid() {
+		return nil
+	}
+	keys := make([]string, 0, len(v.Errors))
+	for key := range v.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	problems := make([]string, len(keys))
+	for i, key := range keys {
+		problems[i] = fmt.Sprintf("  -%s: %s", key, v.Errors[key])
+	}
+	return errors.New("invalid configuration:\n" + strings.Join(problems, "\n"))
+}
+
+// printConfig writes the value of every setting to stdout as JSON, with the secrets
+// redacted.
+func printConfig(fs *flag.FlagSet) {
+	values := settings.Values(fs, secretFlags...)
+	// Leave out the flags which only control the loading itself.
+	for _, name := range []string{"print-config", "smtp-password-file", "cursor-secret-file", "jwt-keys-file"} {
+		delete(values, name)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(values)
+}
@@ -15,10 +15,40 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// The tokenContextKey is the key for the authToken the user of the request
+// authenticated with.
+const tokenContextKey = contextKey("token")
+
+// authToken describes the token the user of a request authenticated with: the
+// plaintext of an opaque authentication token, or a signed access token and the id of
+// the session it was issued for.
+type authToken struct {
+	plaintext string
+	signed    bool
+	sessionID int
+}
+
+// The requestContextKey is the key for the requestInfo of the current request.
+const requestContextKey = contextKey("request")
+
+// requestInfo holds what we know about a request for logging. The requestID() middleware
+// adds a pointer to it to the context before any other middleware runs. The middleware
+// further down the chain work on copies of the request, so contextSetUser() records the
+// user in it too, which lets the access log written on the way back up include them.
+// For the same reason the router records the pattern of the matched route in it.
+type requestInfo struct {
+	id    string
+	user  *data.User
+	route string
+}
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if info := contextGetRequestInfo(r); info != nil {
+		info.user = user
+	}
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -34,3 +64,40 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The contextSetToken() method returns a new copy of the request with the token the
+// user authenticated with added to the context.
+func (app *application) contextSetToken(r *http.Request, token authToken) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() method returns the token the user of the request authenticated
+// with, which is the zero authToken if the user is anonymous.
+func (app *application) contextGetToken(r *http.Request) authToken {
+	token, _ := r.Context().Value(tokenContextKey).(authToken)
+	return token
+}
+
+// The contextSetRequestInfo() method returns a new copy of the request with the provided
+// requestInfo added to the context.
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestInfo returns the requestInfo from the request context, or nil if
+// the request didn't pass through the requestID() middleware.
+func contextGetRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestContextKey).(*requestInfo)
+	return info
+}
+
+// The contextGetRequestID() method returns the id of the current request, or the empty
+// string if it hasn't been assigned one.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	if info := contextGetRequestInfo(r); info != nil {
+		return info.id
+	}
+	return ""
+}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+
+	"forum/internal/data"
+	"forum/internal/jsonlog"
 )
 
-// The logError() method is a generic helper for logging an error message. Later in the
-// book we'll upgrade this to use structured logging, and record additional information
-// about the request including the HTTP method and URL.
+// statusClientClosedRequest is the non-standard status code nginx uses for requests
+// which the client abandoned before the response was ready.
+const statusClientClosedRequest = 499
+
+// The logError() method is a generic helper for logging an error message. It records
+// the HTTP method and URL of the request, and its id so that the entry can be matched
+// with the access log line and with what the client reports.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
+	fields := jsonlog.Fields{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
-	})
+	}
+	if id := app.contextGetRequestID(r); id != "" {
+		fields["request_id"] = id
+	}
+	app.logger.PrintError(err, fields)
 }
 
 // The errorResponse() method is a generic helper for sending JSON-formatted error
@@ -36,11 +48,53 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 // errorResponse() helper to send a 500 Internal Server Error status code and JSON
 // response (containing a generic error message) to the client.
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// A query which was cut short isn't a bug in the application, so it gets a
+	// response of its own and a warning rather than an error in the log.
+	switch {
+	case errors.Is(err, data.ErrQueryCanceled):
+		app.requestCanceledResponse(w, r, err)
+		return
+	case errors.Is(err, data.ErrQueryTimeout):
+		app.queryTimeoutResponse(w, r, err)
+		return
+	}
 	app.logError(r, err)
 	message := "the server encountered a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
 
+// The logWarning() method logs a problem which is worth knowing about but isn't an
+// error in the application, with the same request fields as logError().
+func (app *application) logWarning(r *http.Request, message string, err error) {
+	fields := jsonlog.Fields{
+		"request_method": r.Method,
+		"request_url":    r.URL.String(),
+		"error":          err.Error(),
+	}
+	if id := app.contextGetRequestID(r); id != "" {
+		fields["request_id"] = id
+	}
+	app.logger.PrintWarn(message, fields)
+}
+
+// The requestCanceledResponse() method is used when a query was canceled because the
+// client went away. Nobody will read the response, but it still gets a 499 status
+// code so that the access log and metrics show what happened.
+func (app *application) requestCanceledResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logWarning(r, "request canceled", err)
+	message := "the request was canceled before it could be completed"
+	app.errorResponse(w, r, statusClientClosedRequest, message)
+}
+
+// The queryTimeoutResponse() method is used when a query took longer than the query
+// timeout. This usually means the database is overloaded, so we send a 503 Service
+// Unavailable status code and let the client try again later.
+func (app *application) queryTimeoutResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logWarning(r, "query timed out", err)
+	message := "the database took too long to respond, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 // The notFoundResponse() method will be used to send a 404 Not Found status code and
 // JSON response to the client.
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
@@ -71,11 +125,13 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	app.instruments.authFailures.Inc("invalid_credentials")
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	app.instruments.authFailures.Inc("invalid_token")
 	w.Header().Set("WWW-Authenticate", "Bearer")
 	message := "invalid or missing authentication token"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -95,3 +151,11 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// The rateLimitExceededResponse() method will be used to send a 429 Too Many Requests
+// status code and JSON response to the client. The Retry-After header must have been
+// set already.
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "rate limit exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
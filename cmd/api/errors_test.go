@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"forum/internal/data"
+)
+
+// failingGenres is a GenreRepository whose queries all fail with err.
+type failingGenres struct {
+	data.GenreRepository
+	err error
+}
+
+func (g failingGenres) GetAll(ctx context.Context) ([]*data.Genre, error) {
+	return nil, g.err
+}
+
+func TestInterruptedQueries(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("%w: %w", data.ErrQueryCanceled, context.Canceled), statusClientClosedRequest},
+		{fmt.Errorf("%w: %w", data.ErrQueryTimeout, context.DeadlineExceeded), http.StatusServiceUnavailable},
+		{fmt.Errorf("disk I/O error"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		app := newTestApplication(t)
+		app.models.Genres = failingGenres{app.models.Genres, tt.err}
+		_, token := newTestUser(t, app, "alice@example.com", true, "viewer")
+		res := request(t, app, http.MethodGet, "/v1/genres", token, nil)
+		res.wantStatus(t, tt.want)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+)
+
+// The listGenresHandler returns the genre vocabulary, with the number of movies in each
+// genre.
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+	genres, err := app.models.Genres.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJson(w, http.StatusOK, envelope{"genres": genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"time"
+
+	"forum/internal/data"
+	migratedb "forum/migrateDB"
 )
 
 // Show application information
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	env := envelope{
-		"status": "available",
-		"system_info": map[string]string{
-			"environment": app.config.env,
-			"version":     version,
-		},
+		"status":      "available",
+		"system_info": app.systemInfo(),
 	}
 	err := app.writeJson(w, http.StatusOK, env, nil)
 	if err != nil {
@@ -19,3 +24,119 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The livenessHandler reports that the process is up and able to serve requests. It
+// doesn't look at any dependency, so that a broken database doesn't get the process
+// restarted when that wouldn't help.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	app.healthcheckHandler(w, r)
+}
+
+// A dependencyCheck is the outcome of checking a single dependency in the readiness
+// check.
+type dependencyCheck struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// The readinessHandler reports whether the application can serve traffic by running
+// each of the readiness checks: that the database answers, that its schema is at the
+// latest migration, and optionally that the SMTP server accepts connections. It
+// responds with a 503 Service Unavailable if any of those fail, or while the server is
+// draining before a shutdown.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]dependencyCheck, len(app.readinessChecks))
+	for name, check := range app.readinessChecks {
+		checks[name] = app.checkDependency(r.Context(), check)
+	}
+	status, code := "ready", http.StatusOK
+	for _, check := range checks {
+		if check.Status != "up" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	if app.draining.Load() {
+		status, code = "draining", http.StatusServiceUnavailable
+	}
+	env := envelope{
+		"status":      status,
+		"checks":      checks,
+		"system_info": app.systemInfo(),
+	}
+	err := app.writeJson(w, code, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkDependency runs a check with a 2-second timeout and times it.
+func (app *application) checkDependency(ctx context.Context, check func(ctx context.Context) error) dependencyCheck {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := check(ctx)
+	result := dependencyCheck{Status: "up", Latency: time.Since(start).String()}
+	if err != nil {
+		result.Status = "down"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// readinessChecks returns the checks run by the readiness endpoint, by name.
+func readinessChecks(cfg config, db *data.DB, migrator *migratedb.Migrator) map[string]func(ctx context.Context) error {
+	checks := map[string]func(ctx context.Context) error{
+		"database":   db.PingContext,
+		"migrations": func(ctx context.Context) error { return checkMigrations(ctx, migrator) },
+	}
+	if cfg.healthcheck.smtp {
+		checks["smtp"] = func(ctx context.Context) error { return checkSMTP(ctx, cfg.smtp.host, cfg.smtp.port) }
+	}
+	return checks
+}
+
+// checkMigrations fails when the database isn't at the latest migration embedded in
+// the binary, or when an applied migration has been changed since.
+func checkMigrations(ctx context.Context, migrator *migratedb.Migrator) error {
+	current, err := migrator.VersionContext(ctx)
+	if err != nil {
+		return err
+	}
+	if latest := migrator.Latest(); current != latest {
+		return fmt.Errorf("database is at version %d, expected %d", current, latest)
+	}
+	return migrator.VerifyContext(ctx)
+}
+
+// checkSMTP only opens a TCP connection to the SMTP server, without logging in.
+func checkSMTP(ctx context.Context, host string, port int) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// systemInfo returns the environment and the version and build details of the binary.
+// When the binary wasn't built with the Makefile, the commit is taken from the VCS
+// information the go command embeds, if there is any.
+func (app *application) systemInfo() map[string]string {
+	info := map[string]string{
+		"environment": app.config.env,
+		"version":     version,
+		"commit":      commit,
+		"build_time":  buildTime,
+	}
+	if info["commit"] == "" {
+		if build, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range build.Settings {
+				if setting.Key == "vcs.revision" {
+					info["commit"] = setting.Value
+				}
+			}
+		}
+	}
+	return info
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"forum/internal/data"
+	migratedb "forum/migrateDB"
+)
+
+func TestHealthcheck(t *testing.T) {
+	app := newTestApplication(t)
+	for _, path := range []string{"/v1/healthcheck", "/v1/healthcheck/live"} {
+		r := request(t, app, http.MethodGet, path, "", nil)
+		r.wantStatus(t, http.StatusOK)
+		if r.body["status"] != "available" {
+			t.Errorf("%s: got status %v", path, r.body["status"])
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	app := newTestApplication(t)
+	status := func(r testResponse) string {
+		return r.body["status"].(string)
+	}
+
+	r := request(t, app, http.MethodGet, "/v1/healthcheck/ready", "", nil)
+	r.wantStatus(t, http.StatusOK)
+	if status(r) != "ready" {
+		t.Errorf("got status %s", status(r))
+	}
+
+	app.readinessChecks["smtp"] = func(ctx context.Context) error { return errors.New("connection refused") }
+	r = request(t, app, http.MethodGet, "/v1/healthcheck/ready", "", nil)
+	r.wantStatus(t, http.StatusServiceUnavailable)
+	smtp := r.body["checks"].(map[string]any)["smtp"].(map[string]any)
+	if status(r) != "unavailable" || smtp["status"] != "down" || smtp["error"] != "connection refused" {
+		t.Errorf("got %v", r.body)
+	}
+
+	delete(app.readinessChecks, "smtp")
+	app.draining.Store(true)
+	r = request(t, app, http.MethodGet, "/v1/healthcheck/ready", "", nil)
+	r.wantStatus(t, http.StatusServiceUnavailable)
+	if status(r) != "draining" {
+		t.Errorf("got status %s", status(r))
+	}
+}
+
+func TestCheckMigrations(t *testing.T) {
+	db, err := data.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrator, err := migratedb.New(db.Pool(), db.Dialect.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMigrations(context.Background(), migrator); err == nil || !strings.Contains(err.Error(), "database is at version 0") {
+		t.Errorf("got %v for a database without migrations", err)
+	}
+	// The check gives up when the readiness timeout does.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := checkMigrations(ctx, migrator); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v with a cancelled context, want context.Canceled", err)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,17 +11,19 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
+	"forum/internal/data"
 	"forum/internal/validator"
 )
 
 // Define an envelope type
 type envelope map[string]any
 
-// Retrieve the "id" URL parameter from the current request context, then convert it to
-// an integer and return it. If the operation isn't successful, return 0 and an error.
+// Retrieve the "id" wildcard from the matched route pattern, then convert it to an
+// integer and return it. If the operation isn't successful, return 0 and an error.
 func (app *application) readIdParam(r *http.Request) (int, error) {
-	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil || id < 1 {
 		return 0, errors.New("invalid id parametr")
 	}
@@ -92,7 +96,6 @@ func (app *application) readJson(w http.ResponseWriter, r *http.Request, dst any
 		// If the JSON contains a field which cannot be mapped to the target destination
 		case strings.HasPrefix(err.Error(), "json: unknown field "):
 			fieldname := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			fmt.Println("fieldnaem", fieldname)
 			return fmt.Errorf("body contains unknown key %s", fieldname)
 		case errors.As(err, &maxBytesError):
 			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
@@ -128,15 +131,20 @@ func (app *application) readString(qs url.Values, key string, defaultValue strin
 // The readCSV() helper reads a string value from the query string and then splits it
 // into a slice on the comma character. If no matching key could be found, it returns
 // the provided default value.
-func (app *application) readCSV(qs url.Values, key string, defaultValue string) string {
+func (app *application) readCSV(qs url.Values, key string, defaultValue []string) []string {
 	// Extract the value from the query string.
 	csv := qs.Get(key)
 	// If no key exists (or the value is empty) then return the default value.
 	if csv == "" {
 		return defaultValue
 	}
-	// Otherwise parse the value into a []string slice and return it.
-	return csv
+	// Otherwise parse the value into a []string slice, trimming the space around each
+	// value so that "a, b" reads the same as "a,b", and return it.
+	values := strings.Split(csv, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values
 }
 
 // The readInt() helper reads a string value from the query string and converts it to an
@@ -161,12 +169,43 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The readCursor() helper reads a signed pagination cursor from the query string. It
+// returns nil if the key is missing or empty, and records an error in the provided
+// Validator instance if the cursor can't be verified.
+func (app *application) readCursor(qs url.Values, key string, v *validator.Validator) *data.Cursor {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+	cursor, err := data.DecodeCursor([]byte(app.config.cursor.secret), s)
+	if err != nil {
+		v.AddError(key, "invalid cursor")
+		return nil
+	}
+	return cursor
+}
+
+// The cursorMetadata() helper converts the metadata of a keyset-paginated listing into
+// its response form, signing the next and previous cursors.
+func (app *application) cursorMetadata(metadata data.Metadata) envelope {
+	env := envelope{"page_size": metadata.PageSize}
+	if metadata.Next != nil {
+		env["next_cursor"] = metadata.Next.Encode([]byte(app.config.cursor.secret))
+	}
+	if metadata.Prev != nil {
+		env["prev_cursor"] = metadata.Prev.Encode([]byte(app.config.cursor.secret))
+	}
+	return env
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
+	app.instruments.backgroundTasks.Add(1)
 	// Launch a background goroutine.
 	go func() {
 		defer app.wg.Done()
+		defer app.instruments.backgroundTasks.Add(-1)
 		// Recover any panic.
 		defer func() {
 			if err := recover(); err != nil {
@@ -177,3 +216,41 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// newRequestID returns a random 16-byte request id, hex encoded.
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validRequestID reports whether an X-Request-ID sent by a client is safe to reuse:
+// not empty, not too long and made of characters which can't break a log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// truncate shortens s to at most n bytes, without cutting a UTF-8 encoded character
+// in half.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
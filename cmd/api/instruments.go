@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+
+	"forum/internal/metrics"
+)
+
+// instruments holds the Prometheus metrics of the application, which are served in the
+// text exposition format at /metrics.
+type instruments struct {
+	registry        *metrics.Registry
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	mailSends       *metrics.CounterVec
+	mailDeadLetters *metrics.CounterVec
+	authFailures    *metrics.CounterVec
+	// The number of goroutines started by app.background() which haven't finished
+	// yet. The sync.WaitGroup we use to wait for them can't report its count.
+	backgroundTasks atomic.Int64
+}
+
+func newInstruments(db *sql.DB) *instruments {
+	registry := metrics.NewRegistry()
+	ins := &instruments{
+		registry: registry,
+		requests: registry.NewCounterVec("greenlight_http_requests_total",
+			"Total number of HTTP requests by route pattern, method and status.",
+			"route", "method", "status"),
+		requestDuration: registry.NewHistogramVec("greenlight_http_request_duration_seconds",
+			"Time taken to serve HTTP requests by route pattern, method and status.",
+			metrics.DefaultBuckets, "route", "method", "status"),
+		mailSends: registry.NewCounterVec("greenlight_mailer_sends_total",
+			"Total number of emails sent by template and result.",
+			"template", "result"),
+		mailDeadLetters: registry.NewCounterVec("greenlight_mailer_dead_letters_total",
+			"Total number of emails given up on after failing to send, by template.",
+			"template"),
+		authFailures: registry.NewCounterVec("greenlight_auth_failures_total",
+			"Total number of failed authentication attempts by reason.",
+			"reason"),
+	}
+	registry.NewGaugeFunc("greenlight_background_tasks",
+		"Number of background tasks currently running.",
+		func() float64 { return float64(ins.backgroundTasks.Load()) })
+	registry.NewGaugeFunc("greenlight_goroutines",
+		"Number of goroutines that currently exist.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+	// Publish the database connection pool statistics, when there is a database. The
+	// handler tests run without one.
+	if db != nil {
+		registry.NewGaugeFunc("greenlight_db_max_open_connections",
+			"Maximum number of open connections to the database.",
+			func() float64 { return float64(db.Stats().MaxOpenConnections) })
+		registry.NewGaugeFunc("greenlight_db_open_connections",
+			"Number of established connections to the database, both in use and idle.",
+			func() float64 { return float64(db.Stats().OpenConnections) })
+		registry.NewGaugeFunc("greenlight_db_in_use_connections",
+			"Number of database connections currently in use.",
+			func() float64 { return float64(db.Stats().InUse) })
+		registry.NewGaugeFunc("greenlight_db_idle_connections",
+			"Number of idle database connections.",
+			func() float64 { return float64(db.Stats().Idle) })
+		registry.NewCounterFunc("greenlight_db_wait_count_total",
+			"Total number of times a query waited for a database connection.",
+			func() float64 { return float64(db.Stats().WaitCount) })
+		registry.NewCounterFunc("greenlight_db_wait_duration_seconds_total",
+			"Total time spent waiting for a database connection.",
+			func() float64 { return db.Stats().WaitDuration.Seconds() })
+	}
+	return ins
+}
+
+// methodLabel returns the label value for a request method. Methods we don't know are
+// grouped together, so that clients can't create any number of label values.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return "OTHER"
+	}
+}
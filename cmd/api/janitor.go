@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"forum/internal/jsonlog"
+)
+
+// startTokenJanitor starts the token janitor, which deletes the expired tokens of every
+// scope straight away and then every janitor interval, so that the tokens table doesn't
+// grow forever. It also deletes the failed emails whose tokens have expired. It is
+// counted in app.wg, and returns once ctx is cancelled.
+func (app *application) startTokenJanitor(ctx context.Context) {
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		ticker := time.NewTicker(app.config.tokens.janitorInterval)
+		defer ticker.Stop()
+		for {
+			app.purgeExpiredTokens(ctx)
+			app.purgeFailedEmails(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// purgeExpiredTokens deletes the expired tokens, logging how many there were.
+func (app *application) purgeExpiredTokens(ctx context.Context) {
+	deleted, err := app.models.Tokens.DeleteExpired(ctx)
+	if err != nil {
+		// Being interrupted by the shutdown is no cause for alarm, as the tokens
+		// will be deleted the next time round.
+		if !errors.Is(err, context.Canceled) {
+			app.logger.PrintError(err, nil)
+		}
+		return
+	}
+	if deleted > 0 {
+		app.logger.PrintInfo("deleted expired tokens", jsonlog.Fields{"count": deleted})
+	}
+}
+
+// purgeFailedEmails deletes the failed emails which were queued longer ago than the
+// longest lived of the tokens we email, so that the tokens in them aren't kept after
+// they have expired, logging how many there were.
+func (app *application) purgeFailedEmails(ctx context.Context) {
+	ttl := max(activationTokenTTL, emailChangeTokenTTL, app.config.tokens.passwordResetTTL)
+	deleted, err := app.models.Emails.DeleteFailed(ctx, time.Now().Add(-ttl))
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			app.logger.PrintError(err, nil)
+		}
+		return
+	}
+	if deleted > 0 {
+		app.logger.PrintInfo("deleted failed emails", jsonlog.Fields{"count": deleted})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+
+	"forum/internal/jsonlog"
+)
+
+// The showLogLevelHandler returns the current minimum log level.
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJson(w, http.StatusOK, envelope{"level": app.logger.Level()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateLogLevelHandler changes the minimum log level of the running application,
+// for example to switch on debug logging while investigating a problem without
+// restarting the server. The level goes back to the -log-level flag on restart.
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level *jsonlog.Level `json:"level"`
+	}
+	// The Level type implements encoding.TextUnmarshaler, so an unknown level name is
+	// reported by readJson() like any other malformed value.
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Level == nil {
+		app.failedValidationResponse(w, r, map[string]string{"level": "must be provided"})
+		return
+	}
+	previous := app.logger.Level()
+	app.logger.SetLevel(*input.Level)
+	app.logger.PrintInfo("log level changed", jsonlog.Fields{
+		"from":    previous,
+		"to":      *input.Level,
+		"user_id": app.contextGetUser(r).ID,
+	})
+	err = app.writeJson(w, http.StatusOK, envelope{"level": *input.Level}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
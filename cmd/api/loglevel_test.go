@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"forum/internal/jsonlog"
+)
+
+func TestLogLevel(t *testing.T) {
+	app := newTestApplication(t)
+	_, admin := newTestUser(t, app, "admin@example.com", true, "admin")
+	_, editor := newTestUser(t, app, "editor@example.com", true, "editor")
+
+	r := request(t, app, http.MethodGet, "/v1/log-level", admin, nil)
+	r.wantStatus(t, http.StatusOK)
+	if r.body["level"] != "info" {
+		t.Errorf("got level %v", r.body["level"])
+	}
+
+	r = request(t, app, http.MethodPut, "/v1/log-level", admin, map[string]any{"level": "DEBUG"})
+	r.wantStatus(t, http.StatusOK)
+	if r.body["level"] != "debug" || app.logger.Level() != jsonlog.LevelDebug {
+		t.Errorf("got level %v, logger at %v", r.body["level"], app.logger.Level())
+	}
+
+	request(t, app, http.MethodPut, "/v1/log-level", admin, map[string]any{"level": "verbose"}).wantStatus(t, http.StatusBadRequest)
+	request(t, app, http.MethodPut, "/v1/log-level", admin, map[string]any{}).wantError(t, "level")
+	request(t, app, http.MethodGet, "/v1/log-level", editor, nil).wantStatus(t, http.StatusForbidden)
+	request(t, app, http.MethodPut, "/v1/log-level", editor, map[string]any{"level": "error"}).wantStatus(t, http.StatusForbidden)
+	if app.logger.Level() != jsonlog.LevelDebug {
+		t.Errorf("a non-admin changed the level to %v", app.logger.Level())
+	}
+}
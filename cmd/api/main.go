@@ -2,25 +2,34 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"crypto/rand"
+	"errors"
 	"expvar"
 	"flag"
+	"fmt"
+	"net/netip"
 	"os"
 	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"forum/internal/data"
 	"forum/internal/jsonlog"
+	"forum/internal/jwt"
 	"forum/internal/mailer"
 	migratedb "forum/migrateDB"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 const version = "1.0.0"
 
+// The commit and build time of the binary. These are set at build time with the
+// linker's -X flag, see the build/api target in the Makefile.
+var (
+	commit    string
+	buildTime string
+)
+
 type config struct {
 	port int
 	env  string
@@ -29,6 +38,17 @@ type config struct {
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		// queryTimeout bounds every query on top of the request's own context, and
+		// queries slower than slowQueryThreshold are logged as warnings.
+		queryTimeout       time.Duration
+		slowQueryThreshold time.Duration
+	}
+	// How emails are delivered: "smtp" sends them through the SMTP server below,
+	// "file" writes them to .eml files in dir for local development, and "memory"
+	// keeps them in the process, where nobody will ever read them.
+	mail struct {
+		transport string
+		dir       string
 	}
 	smtp struct {
 		host     string
@@ -36,69 +56,162 @@ type config struct {
 		username string
 		password string
 		sender   string
+		tls      string
+	}
+	// The outbox workers which deliver the queued emails: how many of them there are,
+	// how often an idle worker looks for due emails, how many attempts an email gets
+	// before it is given up on, the delay before the first retry (which doubles with
+	// every attempt after that) and how long shutdown waits for the due emails to go
+	// out.
+	outbox struct {
+		workers      int
+		pollInterval time.Duration
+		maxAttempts  int
+		backoff      time.Duration
+		drainTimeout time.Duration
 	}
 	cors struct {
 		trusredOrigins []string
 	}
+	// The secret used to sign the cursors handed out for keyset pagination.
+	cursor struct {
+		secret string
+	}
+	// How long the roles and permissions of a user are cached for. Zero disables the
+	// cache.
+	accessCache struct {
+		ttl time.Duration
+	}
+	// How long the password reset tokens we email to users stay valid, how long an
+	// authentication token stays valid after it was last used, and how often the
+	// janitor deletes the expired tokens. The mode chooses between opaque
+	// authentication tokens and signed access tokens with refresh tokens, which have
+	// lifetimes and signing keys of their own.
+	tokens struct {
+		passwordResetTTL  time.Duration
+		authenticationTTL time.Duration
+		janitorInterval   time.Duration
+		mode              string
+		accessTTL         time.Duration
+		refreshTTL        time.Duration
+		jwtKeys           string
+	}
+	// Add a new limiter struct containing fields for the requests-per-second and burst
+	// values of the general and the strict (login and registration) token buckets, a
+	// boolean field which we can use to enable/disable rate limiting altogether, and
+	// the proxies whose X-Forwarded-For header we trust to carry the client address.
+	limiter struct {
+		enabled        bool
+		rps            float64
+		burst          int
+		strictRps      float64
+		strictBurst    int
+		trustedProxies []netip.Prefix
+	}
+	// The logging settings: the minimum level (which admins can also change at
+	// runtime), whether error entries include a stack trace, and how identical
+	// entries are sampled.
+	log struct {
+		level            jsonlog.Level
+		stackTraces      bool
+		sampleTick       time.Duration
+		sampleFirst      int
+		sampleThereafter int
+	}
+	// How long to keep serving after a shutdown signal, with the readiness check
+	// failing, so that load balancers stop sending requests before the server stops
+	// accepting them. And whether readiness also checks that the SMTP server is
+	// reachable.
+	shutdown struct {
+		drainDelay time.Duration
+	}
+	healthcheck struct {
+		smtp bool
+	}
+	// The listen address for the Prometheus metrics. When it is empty, the metrics
+	// are served by the API itself at /metrics, to users with the metrics:view
+	// permission.
+	metrics struct {
+		addr string
+	}
+	// The email address of a user to grant the admin role to at startup. This is how
+	// the first admin is created, after which admins can manage roles through the API.
+	adminEmail string
+	// The -config and -print-config flags, see config.go.
+	configFile  string
+	printConfig bool
 }
 
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config      config
+	logger      *jsonlog.Logger
+	models      data.Models
+	mailer      mailer.Mailer
+	outbox      *outbox
+	wg          sync.WaitGroup
+	instruments *instruments
+	// The rate limiters of the router, whose idle clients are evicted in the background.
+	limiters rateLimiters
+	// The keys which sign and verify the access tokens, when -auth-token-mode is jwt.
+	accessTokens *jwt.KeySet
+	// The checks run by the readiness endpoint, by name. See readinessChecks().
+	readinessChecks map[string]func(ctx context.Context) error
+	// Set when the server has been told to shut down, to fail the readiness check.
+	draining atomic.Bool
 }
 
 func main() {
-	var cfg config
-	// Read the value of the port and env command-line flags into the config struct. We
-	// default to using the port number 4000 and the environment "development" if no
-	// corresponding flags are provided.
-	flag.IntVar(&cfg.port, "port", 4000, "Api server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environ")
-	flag.StringVar(&cfg.db.dsn, "db-dsn", "./migrateDB/test.db", "Sqlite3 database")
-	// Read the connection pool settings from command-line flags into the config struct.
-	// Notice the default values that we're using
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "Sqlite3 max oppen connections")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
-	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
-
-	// Read the SMTP server configuration settings into the config struct, using the
-	// Mailtrap settings as the default values. IMPORTANT: If you're following along,
-	// make sure to replace the default values for smtp-username and smtp-password
-	// with your own Mailtrap credentials.
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "f8c85a11d5055d", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "9bc57c59deab1a", "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.alexedwards.net>", "SMTP sender")
-	/// Use the flag.Func() function to process the -cors-trusted-origins command line
-	// flag. In this we use the strings.Fields() function to split the flag value into a
-	// slice based on whitespace characters and assign it to our config struct.
-	// Importantly, if the -cors-trusted-origins flag is not present, contains the empty
-	// string, or contains only whitespace, then strings.Fields() will return an empty
-	// []string slice.
-	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
-		cfg.cors.trusredOrigins = strings.Fields(val)
-		return nil
-	})
-	flag.Parse()
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// With -print-config, print the effective configuration, with the secrets
+	// redacted, and exit.
+	if cfg.printConfig {
+		printConfig(flag.CommandLine)
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	// Initialize a new logger which writes messages to the standard out stream,
 	// prefixed with the current date and time.
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	logger := jsonlog.New(os.Stdout, cfg.log.level)
+	logger.SetStackTraces(cfg.log.stackTraces)
+	logger.SetSampling(cfg.log.sampleTick, cfg.log.sampleFirst, cfg.log.sampleThereafter)
+	// Without a configured secret, sign cursors with a random one. They will then stop
+	// being valid when the application restarts, which is fine for development.
+	if cfg.cursor.secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		cfg.cursor.secret = string(secret)
+		logger.PrintInfo("no cursor secret configured, using a random one", nil)
+	}
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 	defer db.Close()
-	if err = migratedb.CreateTable(db); err != nil {
+	db.SetSlowQueryLog(cfg.db.slowQueryThreshold, logger)
+	// Apply any pending migrations before serving requests. Up() verifies the
+	// checksums of the already applied migrations first, so a database whose history
+	// has drifted from the embedded migration files stops the startup here.
+	migrator, err := migratedb.New(db.Pool(), db.Dialect.String())
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	err = migrator.Up()
+	if err != nil && !errors.Is(err, migratedb.ErrNoChange) {
 		logger.PrintFatal(err, nil)
 	}
 
 	// Also log a message to say that the connection pool has been successfully
 	// established.
-	logger.PrintInfo("database connection pool established", nil)
+	logger.PrintInfo("database connection pool established", jsonlog.Fields{"dialect": db.Dialect.String()})
 	// Publush a new "version" var in the expvar handler containing our application
 	// version number (currently the constant "1.0.0")
 	expvar.NewString("version").Set(version)
@@ -108,18 +221,49 @@ func main() {
 	}))
 	// Publiush the databse connection pool statics
 	expvar.Publish("database", expvar.Func(func() any {
-		return db.Stats()
+		return db.Pool().Stats()
+	}))
+	models := data.NewModels(db, cfg.accessCache.ttl)
+	// Publish the hit and miss counters of the roles and permissions cache
+	expvar.Publish("access_cache", expvar.Func(func() any {
+		return models.AccessCache.Stats()
 	}))
 	// Publish the current Unix timestamp
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
 
+	transport, err := newMailTransport(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	// Parse and check every email template now, so that a broken template stops the
+	// startup instead of failing when the first email with it is sent.
+	templates, err := mailer.LoadTemplates()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	app := application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:          cfg,
+		logger:          logger,
+		models:          models,
+		instruments:     newInstruments(db.Pool()),
+		readinessChecks: readinessChecks(cfg, db, migrator),
+		mailer:          mailer.New(transport, cfg.smtp.sender, templates),
+		outbox:          newOutbox(),
+	}
+	if cfg.tokens.mode == authModeJWT {
+		app.accessTokens, err = jwt.ParseKeySet(cfg.tokens.jwtKeys)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+	if cfg.adminEmail != "" {
+		err = app.grantAdmin(cfg.adminEmail)
+		if err != nil {
+			logger.PrintFatal(err, jsonlog.Fields{"email": cfg.adminEmail})
+		}
 	}
 	// handler.
 	err = app.serve()
@@ -128,25 +272,45 @@ func main() {
 	}
 }
 
-// The openDB() function returns a sql.DB connection pool
-func openDB(cfg config) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", cfg.db.dsn)
+// memoryTransportLimit is how many emails the memory transport keeps.
+const memoryTransportLimit = 100
+
+// newMailTransport returns the transport selected with -mail-transport.
+func newMailTransport(cfg config, logger *jsonlog.Logger) (mailer.Transport, error) {
+	switch cfg.mail.transport {
+	case "file":
+		return mailer.NewFileSink(cfg.mail.dir, logger)
+	case "memory":
+		// Nothing reads the emails back in a server, so only the most recent ones are
+		// kept.
+		logger.PrintInfo("emails are kept in memory and won't be delivered", jsonlog.Fields{"kept": memoryTransportLimit})
+		return mailer.NewLimitedRecorder(memoryTransportLimit), nil
+	default:
+		return mailer.NewSMTP(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.tls)
+	}
+}
+
+// The openDB() function returns a connection pool for the database the DSN points to,
+// which is either SQLite or PostgreSQL depending on its scheme.
+func openDB(cfg config) (*data.DB, error) {
+	db, err := data.Open(cfg.db.dsn)
 	if err != nil {
 		return nil, err
 	}
 	// Set the maximum number of open (in-use + idle) connections in the pool. Note that
 	// passing a value less than or equal to 0 will mean there is no limit.
-	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	db.Pool().SetMaxOpenConns(cfg.db.maxOpenConns)
 	// Set the maximum number of idle connections in the pool. Again, passing a value
 	// less than or equal to 0 will mean there is no limit.
-	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	db.Pool().SetMaxIdleConns(cfg.db.maxIdleConns)
 	// Use the time.ParseDuration() function to convert the idle timeout duration string
 	// to a time.Duration type.
 	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
 	if err != nil {
 		return nil, err
 	}
-	db.SetConnMaxIdleTime(duration)
+	db.Pool().SetConnMaxIdleTime(duration)
+	db.SetQueryTimeout(cfg.db.queryTimeout)
 	// Create a context with a 5-second timeout deadline.
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -158,5 +322,26 @@ func openDB(cfg config) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Stop here if SQLite can't run the movie search, rather than in the middle of
+	// the migrations with a "no such module" error.
+	err = db.CheckFTS5(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return db, nil
 }
+
+// grantAdmin gives the admin role to the user with the given email address. Granting a
+// role the user already has is a no-op, so this is safe to run on every startup.
+func (app *application) grantAdmin(email string) error {
+	user, err := app.models.Users.GetByEmail(context.Background(), email)
+	if err != nil {
+		return err
+	}
+	err = app.models.Roles.AddForUser(context.Background(), user.ID, "admin")
+	if err != nil {
+		return err
+	}
+	app.logger.PrintInfo("granted admin role", jsonlog.Fields{"email": email})
+	return nil
+}
@@ -5,10 +5,12 @@ import (
 	"expvar"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 
 	"forum/internal/data"
+	"forum/internal/jsonlog"
 	"forum/internal/validator"
 
 	"github.com/felixge/httpsnoop"
@@ -60,6 +62,19 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 		token := headerParts[1]
+		// In jwt mode the token is a signed access token, which carries what we need
+		// to know about the user, so there is no need to look them up.
+		if app.config.tokens.mode == authModeJWT {
+			user, sessionID, err := app.userForAccessToken(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			r = app.contextSetUser(r, user)
+			r = app.contextSetToken(r, authToken{signed: true, sessionID: sessionID})
+			next.ServeHTTP(w, r)
+			return
+		}
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 		if data.ValidateTokenPlainText(v, token); !v.Valid() {
@@ -70,7 +85,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// again calling the invalidAuthenticationTokenResponse() helper if no
 		// matching record was found. IMPORTANT: Notice that we are using
 		// ScopeAuthentication as the first parameter here
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -80,9 +95,17 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			}
 			return
 		}
+		// Record the use of the token, which also pushes its expiry back, so that a
+		// session stays alive for as long as it is in use. A failure to record it is
+		// no reason to turn the request down.
+		err = app.models.Tokens.Touch(r.Context(), token, app.config.tokens.authenticationTTL, clientIP(r, app.config.limiter.trustedProxies))
+		if err != nil {
+			app.logError(r, err)
+		}
 		// Call the contextSetUser() helper to add the user information to the request
-		// context
+		// context, along with the token for the endpoints which manage it.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, authToken{plaintext: token})
 		// Call the next Handler in the cahin
 		next.ServeHTTP(w, r)
 	})
@@ -117,24 +140,46 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
-// Note that the first parametr for the middleware function is the permission code that
-// we require the user to have
+// An accessRule describes what a user needs to access an endpoint: at least one of the
+// roles, every permission in allOf and at least one of the permissions in anyOf. Parts
+// which are left empty aren't checked.
+type accessRule struct {
+	roles []string
+	allOf []string
+	anyOf []string
+}
 
-func (app *application) requirePermisson(code string, next http.Handler) http.HandlerFunc {
+// hasRole returns a rule which is satisfied by a user with any of the given roles.
+func hasRole(roles ...string) accessRule {
+	return accessRule{roles: roles}
+}
+
+// allOf returns a rule which is satisfied by a user holding every one of the codes.
+func allOf(codes ...string) accessRule {
+	return accessRule{allOf: codes}
+}
+
+// anyOf returns a rule which is satisfied by a user holding at least one of the codes.
+func anyOf(codes ...string) accessRule {
+	return accessRule{anyOf: codes}
+}
+
+// Note that the first parametr for the middleware function is the rule which the user
+// has to satisfy, built with one of hasRole(), allOf() or anyOf().
+func (app *application) requirePermisson(rule accessRule, next http.Handler) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		// Retrive the user from the request context
 		user := app.contextGetUser(r)
-		fmt.Println(user.ID)
-		// Get the slice of permissions of the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// Get the roles and permissions of the user. These are usually served from the
+		// access cache rather than the database.
+		access, err := app.models.Permissions.GetAccessForUser(r.Context(), user)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
-		// Check if the slice includes the required permission. If it does'nt then
-		// return a 403 frobidden response
-		if !permissions.Include(code) {
-			app.notFoundResponse(w, r)
+		// If the user doesn't satisfy the rule then return a 403 Forbidden response.
+		if !rule.satisfiedBy(access) {
+			app.notPermittedResponse(w, r)
 			return
 		}
 		// Otherwise they have the required permisssion so we call the next handler
@@ -145,6 +190,89 @@ func (app *application) requirePermisson(code string, next http.Handler) http.Ha
 	return app.requireActivatedUser(fn)
 }
 
+// satisfiedBy reports whether a user with the given roles and permissions meets the rule.
+func (rule accessRule) satisfiedBy(access data.Access) bool {
+	if len(rule.roles) > 0 && !slices.ContainsFunc(rule.roles, func(role string) bool { return slices.Contains(access.Roles, role) }) {
+		return false
+	}
+	if !access.Permissions.IncludeAll(rule.allOf...) {
+		return false
+	}
+	if len(rule.anyOf) > 0 && !access.Permissions.IncludeAny(rule.anyOf...) {
+		return false
+	}
+	return true
+}
+
+// The rateLimitIP() middleware limits the rate of requests from each client IP
+// address. It comes before authenticate(), so that a client guessing tokens is slowed
+// down as much as any other, rather than being turned away before the limiter can see
+// it, and so are the lookups of the tokens it sends.
+func (app *application) rateLimitIP(next http.Handler) http.Handler {
+	if !app.config.limiter.enabled {
+		return next
+	}
+	limiter := app.limiters.new(app.config.limiter.rps, app.config.limiter.burst)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decision := limiter.take(clientIP(r, app.config.limiter.trustedProxies))
+		setRateLimitHeaders(w, decision)
+		if !decision.allowed {
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The rateLimitUser() middleware limits the rate of requests from each authenticated
+// user on top of the limit on their IP address, so that a user can't get around it by
+// spreading their requests over several addresses. Anonymous requests pass straight
+// through.
+func (app *application) rateLimitUser(next http.Handler) http.Handler {
+	if !app.config.limiter.enabled {
+		return next
+	}
+	limiter := app.limiters.new(app.config.limiter.rps, app.config.limiter.burst)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		decision := limiter.take(strconv.Itoa(user.ID))
+		// The user's bucket replaces the headers of the IP one, as it is the one
+		// which is theirs alone.
+		setRateLimitHeaders(w, decision)
+		if !decision.allowed {
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The rateLimitStrict() middleware wraps the login and registration endpoints with a
+// bucket per client IP address which is much smaller than the general one, to slow
+// down password guessing and mass sign-ups. Each endpoint wrapped with it gets its own
+// set of buckets.
+func (app *application) rateLimitStrict(next http.Handler) http.Handler {
+	if !app.config.limiter.enabled {
+		return next
+	}
+	limiter := app.limiters.new(app.config.limiter.strictRps, app.config.limiter.strictBurst)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decision := limiter.take(clientIP(r, app.config.limiter.trustedProxies))
+		// The general limiter has already set its headers, but the strict limit is the
+		// one the client has to keep an eye on here.
+		setRateLimitHeaders(w, decision)
+		if !decision.allowed {
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Origin")
@@ -176,14 +304,19 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) metrics(next http.Handler) http.Handler {
-	// Initalize the new expvar variables when the middleware chain is first built
-	totalrequestRecived := expvar.NewInt("total_requests_recived")
-	totalResponseSent := expvar.NewInt("total_response_sent")
-	totalProcessingTimeMicroSeconds := expvar.NewInt("total_processing_time_Ms")
+// The expvar variables for the metrics() middleware. expvar panics when a name is
+// published twice, so they are created once for the process rather than each time the
+// middleware chain is built, which the handler tests do for every test.
+var (
+	totalrequestRecived             = expvar.NewInt("total_requests_recived")
+	totalResponseSent               = expvar.NewInt("total_response_sent")
+	totalProcessingTimeMicroSeconds = expvar.NewInt("total_processing_time_Ms")
 	// Declare a new expvar map to hold the count of responses for each HTTP status
 	// code.
-	totalResponsesSentByStatus := expvar.NewMap("total_response_sent_by_status")
+	totalResponsesSentByStatus = expvar.NewMap("total_response_sent_by_status")
+)
+
+func (app *application) metrics(next http.Handler) http.Handler {
 	// The folowing code will be run for every request
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		totalrequestRecived.Add(1)
@@ -201,5 +334,56 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		// Note that the expvar map is string-keyed, so we need to use the strconv.Itoa()
 		// function to convert the status code (which is an integer) to a string.
 		totalResponsesSentByStatus.Add(strconv.Itoa(metics.Code), 1)
+		// Record the request in the Prometheus metrics too, labelled by the pattern of
+		// the route it matched.
+		route := "unmatched"
+		if info := contextGetRequestInfo(r); info != nil && info.route != "" {
+			route = info.route
+		}
+		labels := []string{route, methodLabel(r.Method), strconv.Itoa(metics.Code)}
+		app.instruments.requests.Inc(labels...)
+		app.instruments.requestDuration.Observe(metics.Duration.Seconds(), labels...)
+		// Write the access log line for the request, reusing the metrics we captured.
+		app.logRequest(r, metics)
+	})
+}
+
+// The requestID() middleware gives each request an id, which is sent back to the
+// client in the X-Request-ID header and included in the log entries written for the
+// request. If the client, or a proxy in front of us, already sent a reasonable looking
+// X-Request-ID then we keep it, so that the id can be followed across services.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			var err error
+			id, err = newRequestID()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = app.contextSetRequestInfo(r, &requestInfo{id: id, user: data.AnonymousUser})
+		next.ServeHTTP(w, r)
 	})
 }
+
+// logRequest writes one INFO entry for a completed request.
+func (app *application) logRequest(r *http.Request, m httpsnoop.Metrics) {
+	fields := jsonlog.Fields{
+		"request_method": r.Method,
+		"request_path":   r.URL.Path,
+		"status":         m.Code,
+		"bytes":          m.Written,
+		"duration":       m.Duration,
+		"remote_addr":    clientIP(r, app.config.limiter.trustedProxies),
+	}
+	if info := contextGetRequestInfo(r); info != nil {
+		fields["request_id"] = info.id
+		if !info.user.IsAnonymous() {
+			fields["user_id"] = info.user.ID
+		}
+	}
+	app.logger.PrintInfo("request completed", fields)
+}
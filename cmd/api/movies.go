@@ -12,30 +12,54 @@ import (
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Title  string
-		Genres string
+		Genres []string
+		Query  string
 		data.Filters
 	}
 	v := validator.New()
 	qs := r.URL.Query()
 	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", "")
+	// A movie must have all of the comma-separated genres to be listed.
+	input.Genres = data.NormalizeGenres(app.readCSV(qs, "genres", []string{}))
+	// The q parameter is a full-text search over the movie titles. It supports
+	// "quoted phrases" and prefix* terms.
+	input.Query = app.readString(qs, "q", "")
 	input.Page = app.readInt(qs, "page", 1, v)
 	input.PageSize = app.readInt(qs, "page_size", 20, v)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	// Results can only be ranked by relevance when there is a search query.
+	if input.Query != "" {
+		input.Filters.SortSafelist = append(input.Filters.SortSafelist, "relevance")
+	}
+	// The presence of an "after" or "before" parameter switches the listing to keyset
+	// pagination. An empty value starts from the beginning of the listing.
+	input.Keyset = qs.Has("after") || qs.Has("before")
+	input.After = app.readCursor(qs, "after", v)
+	input.Before = app.readCursor(qs, "before", v)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 	// Call the GetAll() method to retrieve the movies, passing in the various filter
 	// parameters.
-	movies, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(r.Context(), input.Title, input.Genres, input.Query, input.Filters)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor):
+			v.AddError("cursor", "invalid cursor")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
-	// Send a JSON response containing the movie data.
-	err = app.writeJson(w, http.StatusOK, envelope{"movies": movies}, nil)
+	env := envelope{"movies": movies, "metadata": metadata}
+	if input.Keyset {
+		env["metadata"] = app.cursorMetadata(metadata)
+	}
+	// Include the metadata in the response envelope.
+	err = app.writeJson(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -43,9 +67,6 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 // Create a new movie
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-	}
 	// Declare an anonymous struct to hold the information that we expect to be in the
 	// HTTP request body (note that the field names and types in the struct are a subset
 	// of the Movie struct that we created earlier). This struct will be our *target
@@ -54,7 +75,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		Title   string       `json:"title"`
 		Year    int32        `json:"year"`
 		Runtime data.Runtime `json:"runtime"`
-		Genres  string       `json:"genres"`
+		Genres  []string     `json:"genres"`
 	}
 	// Initialize a new json.Decoder instance which reads from the request body, and
 	// then use the Decode() method to decode the body contents into the input struct.
@@ -71,7 +92,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		Title:   input.Title,
 		Year:    input.Year,
 		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Genres:  data.NormalizeGenres(input.Genres),
 	}
 	// Initalize a new validator instance
 	v := validator.New()
@@ -84,9 +105,15 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and update the
 	// movie struct with the system-generated information.
-	err = app.models.Movies.Insert(&movie)
+	err = app.models.Movies.Insert(r.Context(), &movie)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrUnknownGenre):
+			v.AddError("genres", "must only contain known genres")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 	// When sending a HTTP response, we want to include a Location header to let the
@@ -109,14 +136,14 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIdParam(r)
 	if err != nil {
-		http.NotFound(w, r)
+		app.notFoundResponse(w, r)
 		return
 	}
 	// Call the Get() method to fetch the data for a specific movie. We also need to
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client
 	// Encode the struct to JSON and send it as the HTTP response.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -137,12 +164,12 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIdParam(r)
 	if err != nil {
-		http.NotFound(w, r)
+		app.notFoundResponse(w, r)
 		return
 	}
 	// Fetch the existing movie record from the database, sending a 404 Not Found
 	// response to the client if we couldn't find a matching record.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -161,7 +188,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		Title   *string       `json:"title"`
 		Year    *int32        `json:"year"`
 		Runtime *data.Runtime `json:"runtime"`
-		Genres  *string       `json:"genres"`
+		Genres  []string      `json:"genres"`
 	}
 	// Initialize a new json.Decoder instance which reads from the request body, and
 	// then use the Decode() method to decode the body contents into the input struct.
@@ -189,8 +216,9 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	if input.Runtime != nil {
 		movie.Runtime = *input.Runtime
 	}
+	// We don't need to dereference a slice
 	if input.Genres != nil {
-		movie.Genres = *input.Genres
+		movie.Genres = data.NormalizeGenres(input.Genres)
 	}
 	// Initalize a new validator instance
 	v := validator.New()
@@ -200,9 +228,12 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(r.Context(), movie)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrUnknownGenre):
+			v.AddError("genres", "must only contain known genres")
+			app.failedValidationResponse(w, r, v.Errors)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -222,7 +253,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		app.notFoundResponse(w, r)
 		return
 	}
-	err = app.models.Movies.Delete(int64(id))
+	err = app.models.Movies.Delete(r.Context(), int64(id))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
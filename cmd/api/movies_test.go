@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"forum/internal/data"
+)
+
+// conflictingMovies is a MovieRepository whose updates always lose the race against
+// a concurrent edit.
+type conflictingMovies struct {
+	data.MovieRepository
+}
+
+func (conflictingMovies) Update(ctx context.Context, movie *data.Movie) error {
+	return data.ErrEditConflict
+}
+
+func TestMovieAccess(t *testing.T) {
+	app := newTestApplication(t)
+	_, inactive := newTestUser(t, app, "inactive@example.com", false, "editor")
+	_, nobody := newTestUser(t, app, "nobody@example.com", true)
+	_, viewer := newTestUser(t, app, "viewer@example.com", true, "viewer")
+	movie := newTestMovie(t, app, "Moana", 2016, 107, "animation")
+	path := fmt.Sprintf("/v1/movies/%d", movie.ID)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"anonymous list", http.MethodGet, "/v1/movies", "", http.StatusUnauthorized},
+		{"anonymous show", http.MethodGet, path, "", http.StatusUnauthorized},
+		{"anonymous genres", http.MethodGet, "/v1/genres", "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "/v1/movies", "AAAAAAAAAAAAAAAAAAAAAAAAAA", http.StatusUnauthorized},
+		{"malformed token", http.MethodGet, "/v1/movies", "abc", http.StatusUnauthorized},
+		{"inactive user", http.MethodGet, "/v1/movies", inactive, http.StatusForbidden},
+		{"no permissions", http.MethodGet, "/v1/movies", nobody, http.StatusForbidden},
+		{"viewer create", http.MethodPost, "/v1/movies", viewer, http.StatusForbidden},
+		{"viewer update", http.MethodPatch, path, viewer, http.StatusForbidden},
+		{"viewer delete", http.MethodDelete, path, viewer, http.StatusForbidden},
+		{"viewer list", http.MethodGet, "/v1/movies", viewer, http.StatusOK},
+		{"viewer show", http.MethodGet, path, viewer, http.StatusOK},
+		{"viewer genres", http.MethodGet, "/v1/genres", viewer, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request(t, app, tt.method, tt.path, tt.token, nil).wantStatus(t, tt.want)
+		})
+	}
+}
+
+func TestCreateMovie(t *testing.T) {
+	app := newTestApplication(t)
+	_, editor := newTestUser(t, app, "editor@example.com", true, "editor")
+
+	t.Run("created", func(t *testing.T) {
+		r := request(t, app, http.MethodPost, "/v1/movies", editor, map[string]any{
+			"title": "Black Panther", "year": 2018, "runtime": "134 mins", "genres": []string{"Sci-Fi", " action"},
+		})
+		r.wantStatus(t, http.StatusCreated)
+		movie := r.body["movie"].(map[string]any)
+		if got, want := r.header.Get("Location"), fmt.Sprintf("/v1/movies/%v", movie["id"]); got != want {
+			t.Errorf("got Location %q, want %q", got, want)
+		}
+		if movie["runtime"] != "134 mins" || movie["version"] != 1.0 || fmt.Sprint(movie["genres"]) != "[sci-fi action]" {
+			t.Errorf("got movie %v", movie)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		body  any
+		field string
+	}{
+		{"missing title", map[string]any{"year": 2018, "runtime": "134 mins", "genres": []string{"action"}}, "title"},
+		{"future year", map[string]any{"title": "X", "year": 3000, "runtime": "134 mins", "genres": []string{"action"}}, "year"},
+		{"missing runtime", map[string]any{"title": "X", "year": 2018, "genres": []string{"action"}}, "runtime"},
+		{"no genres", map[string]any{"title": "X", "year": 2018, "runtime": "134 mins", "genres": []string{}}, "genres"},
+		{"duplicate genres", map[string]any{"title": "X", "year": 2018, "runtime": "134 mins", "genres": []string{"action", "Action "}}, "genres"},
+		{"unknown genre", map[string]any{"title": "X", "year": 2018, "runtime": "134 mins", "genres": []string{"space opera"}}, "genres"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request(t, app, http.MethodPost, "/v1/movies", editor, tt.body).wantError(t, tt.field)
+		})
+	}
+
+	for _, body := range []string{"", `{"title": "X"`, `{"title": 1}`, `{"rating": 5}`, `{} {}`, `{"runtime": "long"}`} {
+		t.Run("bad request "+body, func(t *testing.T) {
+			request(t, app, http.MethodPost, "/v1/movies", editor, body).wantStatus(t, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestShowMovie(t *testing.T) {
+	app := newTestApplication(t)
+	_, viewer := newTestUser(t, app, "viewer@example.com", true, "viewer")
+	movie := newTestMovie(t, app, "Moana", 2016, 107, "animation", "adventure")
+
+	r := request(t, app, http.MethodGet, fmt.Sprintf("/v1/movies/%d", movie.ID), viewer, nil)
+	r.wantStatus(t, http.StatusOK)
+	got := r.body["movie"].(map[string]any)
+	if got["title"] != "Moana" || fmt.Sprint(got["genres"]) != "[adventure animation]" {
+		t.Errorf("got movie %v", got)
+	}
+
+	for _, path := range []string{"/v1/movies/99", "/v1/movies/0", "/v1/movies/-1", "/v1/movies/abc"} {
+		request(t, app, http.MethodGet, path, viewer, nil).wantStatus(t, http.StatusNotFound)
+	}
+}
+
+func TestUpdateMovie(t *testing.T) {
+	app := newTestApplication(t)
+	_, editor := newTestUser(t, app, "editor@example.com", true, "editor")
+	movie := newTestMovie(t, app, "Moana", 2016, 107, "animation")
+	path := fmt.Sprintf("/v1/movies/%d", movie.ID)
+
+	t.Run("updated", func(t *testing.T) {
+		r := request(t, app, http.MethodPatch, path, editor, map[string]any{"year": 2017, "genres": []string{"family"}})
+		r.wantStatus(t, http.StatusOK)
+		got := r.body["movie"].(map[string]any)
+		if got["title"] != "Moana" || got["year"] != 2017.0 || got["version"] != 2.0 {
+			t.Errorf("got movie %v", got)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		request(t, app, http.MethodPatch, path, editor, map[string]any{"title": ""}).wantError(t, "title")
+	})
+	t.Run("unknown genre", func(t *testing.T) {
+		request(t, app, http.MethodPatch, path, editor, map[string]any{"genres": []string{"space opera"}}).wantError(t, "genres")
+	})
+	t.Run("bad request", func(t *testing.T) {
+		request(t, app, http.MethodPatch, path, editor, `{"title": null, "director": "Ron Clements"}`).wantStatus(t, http.StatusBadRequest)
+	})
+	t.Run("not found", func(t *testing.T) {
+		request(t, app, http.MethodPatch, "/v1/movies/99", editor, map[string]any{"year": 2017}).wantStatus(t, http.StatusNotFound)
+	})
+	t.Run("edit conflict", func(t *testing.T) {
+		app.models.Movies = conflictingMovies{app.models.Movies}
+		request(t, app, http.MethodPatch, path, editor, map[string]any{"year": 2018}).wantStatus(t, http.StatusConflict)
+	})
+}
+
+func TestDeleteMovie(t *testing.T) {
+	app := newTestApplication(t)
+	_, editor := newTestUser(t, app, "editor@example.com", true, "editor")
+	movie := newTestMovie(t, app, "Moana", 2016, 107, "animation")
+	path := fmt.Sprintf("/v1/movies/%d", movie.ID)
+
+	request(t, app, http.MethodDelete, path, editor, nil).wantStatus(t, http.StatusOK)
+	request(t, app, http.MethodDelete, path, editor, nil).wantStatus(t, http.StatusNotFound)
+	request(t, app, http.MethodGet, path, editor, nil).wantStatus(t, http.StatusNotFound)
+}
+
+func TestListMovies(t *testing.T) {
+	app := newTestApplication(t)
+	_, viewer := newTestUser(t, app, "viewer@example.com", true, "viewer")
+	newTestMovie(t, app, "Moana", 2016, 107, "animation", "adventure")
+	newTestMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+	newTestMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	newTestMovie(t, app, "The Breakfast Club", 1986, 96, "drama")
+
+	titles := func(r testResponse) string {
+		var titles []any
+		for _, movie := range r.body["movies"].([]any) {
+			titles = append(titles, movie.(map[string]any)["title"])
+		}
+		return fmt.Sprint(titles)
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "[Moana Black Panther Deadpool The Breakfast Club]"},
+		{"title=the", "[Black Panther The Breakfast Club]"},
+		{"genres=action,adventure", "[Black Panther]"},
+		{"genres=Action,%20adventure", "[Black Panther]"},
+		{"sort=-year", "[Black Panther Moana Deadpool The Breakfast Club]"},
+		{"sort=title&page=2&page_size=3", "[The Breakfast Club]"},
+		{"q=club", "[The Breakfast Club]"},
+		{"q=pan*&sort=relevance", "[Black Panther]"},
+		{"page=3&page_size=3", "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r := request(t, app, http.MethodGet, "/v1/movies?"+tt.query, viewer, nil)
+			r.wantStatus(t, http.StatusOK)
+			if got := titles(r); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("metadata", func(t *testing.T) {
+		r := request(t, app, http.MethodGet, "/v1/movies?page_size=3&page=2", viewer, nil)
+		metadata := r.body["metadata"].(map[string]any)
+		if metadata["current_page"] != 2.0 || metadata["last_page"] != 2.0 || metadata["total_records"] != 4.0 {
+			t.Errorf("got metadata %v", metadata)
+		}
+	})
+
+	t.Run("highlight", func(t *testing.T) {
+		r := request(t, app, http.MethodGet, "/v1/movies?q=breakfast", viewer, nil)
+		movie := r.body["movies"].([]any)[0].(map[string]any)
+		if got := movie["title_highlight"]; got != "The <mark>Breakfast</mark> Club" {
+			t.Errorf("got highlight %q", got)
+		}
+		// Titles are typed in by users, so the markup in them is escaped.
+		newTestMovie(t, app, "<script>alert(1)</script> Heist", 2020, 90, "drama")
+		r = request(t, app, http.MethodGet, "/v1/movies?q=heist", viewer, nil)
+		movie = r.body["movies"].([]any)[0].(map[string]any)
+		if got := movie["title_highlight"]; got != "&lt;script&gt;alert(1)&lt;/script&gt; <mark>Heist</mark>" {
+			t.Errorf("got highlight %q", got)
+		}
+	})
+
+	t.Run("cursors", func(t *testing.T) {
+		r := request(t, app, http.MethodGet, "/v1/movies?sort=year&page_size=2&after=", viewer, nil)
+		r.wantStatus(t, http.StatusOK)
+		if got := titles(r); got != "[The Breakfast Club Moana]" {
+			t.Fatalf("got first page %s", got)
+		}
+		next := r.body["metadata"].(map[string]any)["next_cursor"].(string)
+		r = request(t, app, http.MethodGet, "/v1/movies?sort=year&page_size=2&after="+url.QueryEscape(next), viewer, nil)
+		if got := titles(r); got != "[Deadpool Black Panther]" {
+			t.Fatalf("got second page %s", got)
+		}
+		prev := r.body["metadata"].(map[string]any)["prev_cursor"].(string)
+		r = request(t, app, http.MethodGet, "/v1/movies?sort=year&page_size=2&before="+url.QueryEscape(prev), viewer, nil)
+		if got := titles(r); got != "[The Breakfast Club Moana]" {
+			t.Fatalf("got first page again %s", got)
+		}
+	})
+
+	invalid := []struct {
+		query string
+		field string
+	}{
+		{"page=0", "page"},
+		{"page=abc", "page"},
+		{"page_size=101", "page_size"},
+		{"sort=director", "sort"},
+		{"sort=relevance", "sort"},
+		{"after=abc", "after"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.query, func(t *testing.T) {
+			request(t, app, http.MethodGet, "/v1/movies?"+tt.query, viewer, nil).wantError(t, tt.field)
+		})
+	}
+}
+
+func TestListGenres(t *testing.T) {
+	app := newTestApplication(t)
+	_, viewer := newTestUser(t, app, "viewer@example.com", true, "viewer")
+	newTestMovie(t, app, "Moana", 2016, 107, "animation", "adventure")
+
+	r := request(t, app, http.MethodGet, "/v1/genres", viewer, nil)
+	r.wantStatus(t, http.StatusOK)
+	for _, genre := range r.body["genres"].([]any) {
+		genre := genre.(map[string]any)
+		want := 0.0
+		if genre["name"] == "animation" || genre["name"] == "adventure" {
+			want = 1
+		}
+		if genre["movie_count"] != want {
+			t.Errorf("got %v", genre)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"forum/internal/data"
+	"forum/internal/jsonlog"
+	"forum/internal/mailer"
+)
+
+// The handlers don't send emails themselves. They queue them in the email_outbox table,
+// in the same unit of work as the change the email is about, and the outbox workers
+// started by startOutbox() deliver them. An email which can't be sent is tried again
+// later, with the delay doubling every time, until it has had its maximum number of
+// attempts. It is then marked as failed, and stays that way until an admin retries it.
+
+// emailLease is how long a worker has to send an email it claimed before the other
+// workers consider it abandoned and send it themselves. It is well above the timeout
+// of the SMTP dialer.
+const emailLease = time.Minute
+
+// maxEmailBackoff caps the delay between two attempts at sending an email.
+const maxEmailBackoff = 6 * time.Hour
+
+// outbox holds what the outbox workers need to coordinate with the rest of the
+// application.
+type outbox struct {
+	// wakeup tells an idle worker that an email was just queued, so that it doesn't
+	// wait for the poll interval.
+	wakeup chan struct{}
+	// quit is closed when the application shuts down. The workers then deliver the
+	// emails which are due until there are none left or the drain deadline passes.
+	quit          chan struct{}
+	stopOnce      sync.Once
+	drainDeadline time.Time
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		wakeup: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+}
+
+// wake wakes up one idle worker, if there is one.
+func (o *outbox) wake() {
+	select {
+	case o.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// stop tells the workers to finish, giving them until the timeout to deliver the
+// emails which are due.
+func (o *outbox) stop(drainTimeout time.Duration) {
+	o.stopOnce.Do(func() {
+		o.drainDeadline = time.Now().Add(drainTimeout)
+		close(o.quit)
+	})
+}
+
+// stopping reports whether the workers have been told to stop, and if so whether the
+// drain deadline has passed.
+func (o *outbox) stopping() (stopping, pastDeadline bool) {
+	select {
+	case <-o.quit:
+		return true, time.Now().After(o.drainDeadline)
+	default:
+		return false, false
+	}
+}
+
+// The queueEmail() helper adds an email to the user, rendered from the named template
+// in the locale, to the outbox of the given models. These are usually those of a unit
+// of work, so that the email is only sent if the unit of work commits: call
+// app.outbox.wake() once it has. The email goes to user.Email, so pass a copy of the
+// user with another address to write to that address instead. Emails which aren't
+// transactional are left out for users who opted out of their category.
+func (app *application) queueEmail(ctx context.Context, models data.Models, user *data.User, locale, templateName string, templateData map[string]any) error {
+	// An unknown template is queued all the same, and fails when it is delivered.
+	category, ok := app.mailer.Templates().Category(templateName)
+	if ok && category != mailer.CategoryTransactional {
+		optOuts, err := models.OptOuts.GetAllForUser(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(optOuts, category) {
+			return nil
+		}
+	}
+	js, err := json.Marshal(templateData)
+	if err != nil {
+		return err
+	}
+	return models.Emails.Enqueue(ctx, &data.Email{Recipient: user.Email, Template: templateName, Locale: locale, Data: js})
+}
+
+// The emailLocale() helper returns the locale of the emails to a user: the locale they
+// chose if they did, and otherwise the best match for the Accept-Language header of
+// the request.
+func (app *application) emailLocale(r *http.Request, user *data.User) string {
+	templates := app.mailer.Templates()
+	if user.Locale != "" {
+		return templates.MatchLocale(user.Locale)
+	}
+	return templates.MatchLocale(mailer.ParseAcceptLanguage(r.Header.Get("Accept-Language"))...)
+}
+
+// startOutbox starts the outbox workers. They are counted in app.wg, and return once
+// app.outbox.stop() has been called and they have drained the outbox.
+func (app *application) startOutbox() {
+	for range app.config.outbox.workers {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			app.outboxWorker()
+		}()
+	}
+}
+
+func (app *application) outboxWorker() {
+	for {
+		stopping, pastDeadline := app.outbox.stopping()
+		if pastDeadline {
+			return
+		}
+		delivered, err := app.deliverEmail(context.Background())
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		if delivered && err == nil {
+			continue
+		}
+		// The outbox is empty, or the database is unavailable. Either way, wait for
+		// the next email or the next poll, unless it is time to stop.
+		if stopping {
+			return
+		}
+		select {
+		case <-app.outbox.wakeup:
+		case <-app.outbox.quit:
+		case <-time.After(app.config.outbox.pollInterval):
+		}
+	}
+}
+
+// deliverEmail claims the next due email and tries to send it, recording the outcome.
+// It reports whether there was an email to deliver.
+func (app *application) deliverEmail(ctx context.Context) (bool, error) {
+	email, err := app.models.Emails.Claim(ctx, emailLease)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	var templateData map[string]any
+	err = json.Unmarshal(email.Data, &templateData)
+	if err == nil {
+		err = app.mailer.Send(email.Recipient, email.Template, email.Locale, templateData)
+	}
+	if err == nil {
+		app.instruments.mailSends.Inc(email.Template, "success")
+		return true, app.models.Emails.MarkSent(ctx, email.ID)
+	}
+	app.instruments.mailSends.Inc(email.Template, "failure")
+	fields := jsonlog.Fields{
+		"email_id": email.ID,
+		"template": email.Template,
+		"attempts": email.Attempts,
+	}
+	// A template error will happen again on every attempt, so there is no point in
+	// retrying it.
+	if email.Attempts >= app.config.outbox.maxAttempts || errors.Is(err, mailer.ErrTemplate) {
+		app.logger.PrintError(err, fields)
+		app.instruments.mailDeadLetters.Inc(email.Template)
+		return true, app.models.Emails.MarkFailed(ctx, email.ID, err.Error())
+	}
+	retryAt := time.Now().Add(emailBackoff(app.config.outbox.backoff, email.Attempts))
+	fields["retry_at"] = retryAt
+	app.logger.PrintWarn(err.Error(), fields)
+	return true, app.models.Emails.Reschedule(ctx, email.ID, err.Error(), retryAt)
+}
+
+// emailBackoff returns the delay before the next attempt at an email which has failed
+// the given number of times: base, then twice that, and so on up to maxEmailBackoff,
+// plus up to a tenth of the delay again so that emails which failed together aren't
+// all retried at the same moment.
+func emailBackoff(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < maxEmailBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxEmailBackoff)
+	return delay + rand.N(delay/10+1)
+}
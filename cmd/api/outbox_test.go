@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"forum/internal/data"
+	"forum/internal/mailer"
+)
+
+// fakeSMTP is an SMTP server which keeps the messages it receives in memory. It
+// rejects the next failures messages with a temporary error.
+type fakeSMTP struct {
+	addr *net.TCPAddr
+
+	mu       sync.Mutex
+	messages []string
+	failures int
+}
+
+// newFakeSMTP starts a fakeSMTP on a free local port, and points the mailer of the app
+// at it.
+func newFakeSMTP(t *testing.T, app *application) *fakeSMTP {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &fakeSMTP{addr: l.Addr().(*net.TCPAddr)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	transport, err := mailer.NewSMTP("127.0.0.1", s.addr.Port, "", "", mailer.TLSNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.mailer = mailer.New(transport, testSender, app.mailer.Templates())
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost fake SMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(strings.ToUpper(line), " ")
+		switch verb {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "MAIL":
+			s.mu.Lock()
+			fail := s.failures > 0
+			if fail {
+				s.failures--
+			}
+			s.mu.Unlock()
+			if fail {
+				c.PrintfLine("451 4.3.0 try again later")
+				continue
+			}
+			c.PrintfLine("250 OK")
+		case "RCPT", "RSET", "NOOP":
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			message, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(message))
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) fail(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+func (s *fakeSMTP) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+// newOutboxTestApplication returns a test application whose emails go to a fakeSMTP.
+// Failed emails are retried straight away, up to three attempts.
+func newOutboxTestApplication(t *testing.T) (*application, *fakeSMTP) {
+	app := newTestApplication(t)
+	app.config.outbox.workers = 2
+	app.config.outbox.pollInterval = time.Hour
+	app.config.outbox.maxAttempts = 3
+	app.config.outbox.backoff = time.Nanosecond
+	app.config.outbox.drainTimeout = 5 * time.Second
+	return app, newFakeSMTP(t, app)
+}
+
+// deliver runs deliverEmail once and fails the test if it didn't find an email in the
+// outbox, or if recording the outcome failed.
+func deliver(t *testing.T, app *application) {
+	t.Helper()
+	delivered, err := app.deliverEmail(context.Background())
+	if err != nil || !delivered {
+		t.Fatalf("deliverEmail() = %v, %v; want an email to be delivered", delivered, err)
+	}
+}
+
+func outboxEmail(t *testing.T, app *application, id int) *data.Email {
+	t.Helper()
+	emails, _, err := app.models.Emails.GetAll(context.Background(), "", data.Filters{Page: 1, PageSize: 100, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range emails {
+		if email.ID == id {
+			return email
+		}
+	}
+	t.Fatalf("there is no email %d in the outbox", id)
+	return nil
+}
+
+func TestOutboxDelivery(t *testing.T) {
+	app, smtp := newOutboxTestApplication(t)
+	request(t, app, http.MethodPost, "/v1/users", "", map[string]any{
+		"name": "Alice Smith", "email": "alice@example.com", "password": testPassword,
+	}).wantStatus(t, http.StatusAccepted)
+
+	// Registering only queues the welcome email.
+	if got := smtp.received(); len(got) != 0 {
+		t.Fatalf("got %d emails before the outbox was delivered", len(got))
+	}
+	deliver(t, app)
+	got := smtp.received()
+	if len(got) != 1 || !strings.Contains(got[0], "To: alice@example.com") {
+		t.Fatalf("got emails %q, want the welcome email to alice", got)
+	}
+	if email := outboxEmail(t, app, 1); email.Status != data.EmailSent || email.Attempts != 1 {
+		t.Errorf("got %+v, want a sent email", email)
+	}
+	if delivered, err := app.deliverEmail(context.Background()); delivered || err != nil {
+		t.Errorf("deliverEmail() of an empty outbox = %v, %v", delivered, err)
+	}
+}
+
+func TestOutboxRetries(t *testing.T) {
+	app, smtp := newOutboxTestApplication(t)
+	ctx := context.Background()
+	err := app.queueEmail(ctx, app.models, &data.User{Email: "alice@example.com"}, mailer.DefaultLocale, "welcome", map[string]any{"activationToken": "TOKEN", "userID": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An email which the SMTP server turns down is tried again, until it runs out of
+	// attempts.
+	smtp.fail(3)
+	deliver(t, app)
+	if email := outboxEmail(t, app, 1); email.Status != data.EmailPending || email.Attempts != 1 || !strings.Contains(email.LastError, "try again later") {
+		t.Fatalf("got %+v, want a pending email with the SMTP error", email)
+	}
+	deliver(t, app)
+	deliver(t, app)
+	if email := outboxEmail(t, app, 1); email.Status != data.EmailFailed || email.Attempts != 3 {
+		t.Fatalf("got %+v, want a failed email", email)
+	}
+	if delivered, err := app.deliverEmail(ctx); delivered || err != nil {
+		t.Fatalf("deliverEmail() picked up a failed email: %v, %v", delivered, err)
+	}
+
+	// Admins can find the failed email and retry it.
+	_, token := newTestUser(t, app, "admin@example.com", true, "admin")
+	r := request(t, app, http.MethodGet, "/v1/emails?status=failed", token, nil)
+	r.wantStatus(t, http.StatusOK)
+	if emails := r.body["emails"].([]any); len(emails) != 1 {
+		t.Fatalf("got failed emails %v", emails)
+	}
+	request(t, app, http.MethodPost, "/v1/emails/1/retry", token, nil).wantStatus(t, http.StatusOK)
+	deliver(t, app)
+	if email := outboxEmail(t, app, 1); email.Status != data.EmailSent || len(smtp.received()) != 1 {
+		t.Fatalf("got %+v, want the retried email to be sent", email)
+	}
+	// Only failed emails can be retried.
+	request(t, app, http.MethodPost, "/v1/emails/1/retry", token, nil).wantStatus(t, http.StatusNotFound)
+}
+
+func TestOutboxTemplateError(t *testing.T) {
+	app, _ := newOutboxTestApplication(t)
+	err := app.queueEmail(context.Background(), app.models, &data.User{Email: "alice@example.com"}, mailer.DefaultLocale, "missing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trying again won't fix a missing template, so the email fails straight away.
+	deliver(t, app)
+	if email := outboxEmail(t, app, 1); email.Status != data.EmailFailed || email.Attempts != 1 {
+		t.Fatalf("got %+v, want a failed email", email)
+	}
+}
+
+func TestOutboxDrain(t *testing.T) {
+	app, smtp := newOutboxTestApplication(t)
+	app.startOutbox()
+	for i := range 5 {
+		err := app.queueEmail(context.Background(), app.models, &data.User{Email: fmt.Sprintf("user%d@example.com", i)}, mailer.DefaultLocale, "welcome", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The workers are waiting for the poll interval of an hour, so the emails only go
+	// out because of the shutdown.
+	app.outbox.stop(app.config.outbox.drainTimeout)
+	app.wg.Wait()
+	if got := smtp.received(); len(got) != 5 {
+		t.Fatalf("got %d emails, want all 5 to be delivered before the workers stop", len(got))
+	}
+}
+
+func TestEmailAdminAccess(t *testing.T) {
+	app := newTestApplication(t)
+	_, token := newTestUser(t, app, "alice@example.com", true, "editor")
+	request(t, app, http.MethodGet, "/v1/emails", token, nil).wantStatus(t, http.StatusForbidden)
+	request(t, app, http.MethodPost, "/v1/emails/1/retry", token, nil).wantStatus(t, http.StatusForbidden)
+
+	_, token = newTestUser(t, app, "admin@example.com", true, "admin")
+	request(t, app, http.MethodGet, "/v1/emails?status=lost", token, nil).wantError(t, "status")
+	request(t, app, http.MethodPost, "/v1/emails/1/retry", token, nil).wantStatus(t, http.StatusNotFound)
+}
+
+func TestEmailBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{30, maxEmailBackoff},
+	}
+	for _, tt := range tests {
+		got := emailBackoff(30*time.Second, tt.attempts)
+		if got < tt.want || got > tt.want+tt.want/10 {
+			t.Errorf("emailBackoff(30s, %d) = %v, want %v plus up to a tenth", tt.attempts, got, tt.want)
+		}
+	}
+}
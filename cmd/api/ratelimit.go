@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// A rateLimiter holds a token bucket for each client, keyed by whatever identifies the
+// client (an IP address or a user id). Buckets of clients which haven't been seen for
+// a while are evicted by startRateLimiterEviction().
+type rateLimiter struct {
+	rps     rate.Limit
+	burst   int
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+// How often the buckets of idle clients are evicted, and how long a client has to be
+// idle for its bucket to go. A client which comes back after that starts with a full
+// bucket, which it would have had by then anyway.
+const (
+	rateLimiterEvictInterval = time.Minute
+	rateLimiterIdleTimeout   = 3 * time.Minute
+)
+
+// rateLimiters keeps track of the rate limiters the router was built with, so that
+// startRateLimiterEviction() can evict the idle clients of all of them.
+type rateLimiters struct {
+	mu  sync.Mutex
+	all []*rateLimiter
+}
+
+// new returns a rate limiter which is evicted along with the others.
+func (ls *rateLimiters) new(rps float64, burst int) *rateLimiter {
+	l := &rateLimiter{
+		rps:     rate.Limit(rps),
+		burst:   burst,
+		clients: make(map[string]*client),
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.all = append(ls.all, l)
+	return l
+}
+
+// evict removes the idle clients of every rate limiter.
+func (ls *rateLimiters) evict(idle time.Duration) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, l := range ls.all {
+		l.evict(idle)
+	}
+}
+
+// startRateLimiterEviction starts a goroutine which evicts the idle clients of the rate
+// limiters every rateLimiterEvictInterval. It is counted in app.wg, and returns once
+// ctx is cancelled.
+func (app *application) startRateLimiterEviction(ctx context.Context) {
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		ticker := time.NewTicker(rateLimiterEvictInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				app.limiters.evict(rateLimiterIdleTimeout)
+			}
+		}
+	}()
+}
+
+// Define a client struct to hold the rate limiter and last seen time for each client.
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimitDecision is the outcome of taking a token from a client's bucket.
+type rateLimitDecision struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// take removes a token from the bucket of the client with the given key, if there is
+// one available.
+func (l *rateLimiter) take(key string) rateLimitDecision {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, found := l.clients[key]
+	if !found {
+		c = &client{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	decision := rateLimitDecision{limit: l.burst}
+	// Reserve a token and look at how long the client would have to wait for it. If
+	// it isn't available right now, cancel the reservation so that rejected requests
+	// don't use up the tokens of the requests that follow.
+	reservation := c.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	switch {
+	case !reservation.OK():
+		decision.retryAfter = time.Minute
+	case delay > 0:
+		reservation.CancelAt(now)
+		decision.retryAfter = delay
+	default:
+		decision.allowed = true
+	}
+	tokens := c.limiter.TokensAt(now)
+	decision.remaining = max(int(tokens), 0)
+	if l.rps > 0 {
+		decision.reset = time.Duration((float64(l.burst) - tokens) / float64(l.rps) * float64(time.Second))
+	}
+	return decision
+}
+
+// evict removes the clients which haven't been seen within the given duration.
+func (l *rateLimiter) evict(idle time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, c := range l.clients {
+		if time.Since(c.lastSeen) > idle {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// setRateLimitHeaders adds the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers from the IETF draft, and a Retry-After header when the request is rejected.
+func setRateLimitHeaders(w http.ResponseWriter, decision rateLimitDecision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.reset)))
+	if !decision.allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(decision.retryAfter), 1)))
+	}
+}
+
+// clientIP returns the IP address of the client which made the request. When the
+// request comes from one of the trusted proxies, the address is taken from the
+// X-Forwarded-For header instead: we walk it from the right, as each proxy appends the
+// address it received the request from, and stop at the first address which isn't a
+// trusted proxy. Addresses left of that could have been made up by the client.
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(addr, trustedProxies) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop
+		if !isTrustedProxy(hop, trustedProxies) {
+			break
+		}
+	}
+	return addr.Unmap().String()
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a space separated list of IP addresses and CIDR ranges.
+func parseTrustedProxies(val string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Fields(val) {
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
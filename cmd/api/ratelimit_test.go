@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRateLimitedApplication returns a test application with rate limiting on, and a
+// router built once so that the buckets last from one request to the next. Each client
+// gets two requests, and then has to wait a minute for the next.
+func newRateLimitedApplication(t *testing.T) (*application, http.Handler) {
+	t.Helper()
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 1.0 / 60
+	app.config.limiter.burst = 2
+	app.config.limiter.strictRps = 1.0 / 60
+	app.config.limiter.strictBurst = 2
+	return app, app.router()
+}
+
+func serve(h http.Handler, remoteAddr, token string) int {
+	r := httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+	r.RemoteAddr = remoteAddr
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	return rr.Code
+}
+
+func TestRateLimit(t *testing.T) {
+	app, h := newRateLimitedApplication(t)
+	_, alice := newTestUser(t, app, "alice@example.com", true)
+
+	// Guessing tokens uses up the bucket of the IP address like any other request.
+	for _, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if got := serve(h, "192.0.2.1:1234", "AAAAAAAAAAAAAAAAAAAAAAAAAA"); got != want {
+			t.Fatalf("got status %d, want %d", got, want)
+		}
+	}
+	if got := serve(h, "192.0.2.1:1234", alice); got != http.StatusTooManyRequests {
+		t.Fatalf("got status %d for a valid token from the same address, want 429", got)
+	}
+
+	// Alice's own bucket limits her across addresses.
+	for i, addr := range []string{"192.0.2.2:1234", "192.0.2.3:1234", "192.0.2.4:1234"} {
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		if got := serve(h, addr, alice); got != want {
+			t.Fatalf("request %d: got status %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestRateLimitStrict(t *testing.T) {
+	app, _ := newRateLimitedApplication(t)
+	app.config.limiter.burst = 10
+	h := app.router()
+	newTestUser(t, app, "alice@example.com", true)
+	// Each address can only ask for a couple of password reset emails in a row, so
+	// that nobody can flood the inbox of a user with them.
+	for _, want := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodPost, "/v1/tokens/password-reset", strings.NewReader(`{"email": "alice@example.com"}`))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		if rr.Code != want {
+			t.Fatalf("got status %d, want %d", rr.Code, want)
+		}
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	app, h := newRateLimitedApplication(t)
+	serve(h, "192.0.2.1:1234", "")
+	// The strict limiters, the IP limiter and the user limiter were all registered.
+	if len(app.limiters.all) < 3 {
+		t.Fatalf("got %d rate limiters", len(app.limiters.all))
+	}
+	app.limiters.evict(time.Hour)
+	if clientCount(app) == 0 {
+		t.Fatal("a client which was just seen was evicted")
+	}
+	app.limiters.evict(-time.Second)
+	if n := clientCount(app); n != 0 {
+		t.Fatalf("got %d clients after they were all evicted", n)
+	}
+
+	// The eviction goroutine stops once its context is cancelled.
+	ctx, stop := context.WithCancel(context.Background())
+	app.startRateLimiterEviction(ctx)
+	stop()
+	app.wg.Wait()
+}
+
+func clientCount(app *application) int {
+	n := 0
+	for _, l := range app.limiters.all {
+		n += len(l.clients)
+	}
+	return n
+}
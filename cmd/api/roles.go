@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"forum/internal/data"
+	"forum/internal/validator"
+)
+
+// The listRolesHandler returns every role along with the permission codes it grants.
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJson(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showUserAccessHandler returns the roles and permissions of the user with the id
+// from the URL.
+func (app *application) showUserAccessHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	app.writeUserAccess(w, r, user)
+}
+
+// The grantUserRolesHandler grants the roles listed in the request body to a user.
+func (app *application) grantUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(len(input.Roles) > 0, "roles", "must contain at least 1 role")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Roles.AddForUser(r.Context(), user.ID, input.Roles...)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrUnknownRole):
+			v.AddError("roles", "must only contain existing roles")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.writeUserAccess(w, r, user)
+}
+
+// The revokeUserRoleHandler revokes the role named in the URL from a user.
+func (app *application) revokeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	err := app.models.Roles.RemoveForUser(r.Context(), user.ID, r.PathValue("role"))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserAccess(w, r, user)
+}
+
+// The grantUserPermissionsHandler grants the permission codes listed in the request
+// body to a user directly, independently of their roles.
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(len(input.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Permissions.AddForUser(r.Context(), user.ID, input.Permissions...)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrUnknownPermission):
+			v.AddError("permissions", "must only contain existing permissions")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.writeUserAccess(w, r, user)
+}
+
+// The revokeUserPermissionHandler revokes a permission granted directly to a user. It
+// doesn't affect the permissions the user holds through their roles.
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	err := app.models.Permissions.RemoveForUser(r.Context(), user.ID, r.PathValue("code"))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserAccess(w, r, user)
+}
+
+// readUserParam looks up the user with the id from the URL. If there is no such user,
+// or anything else goes wrong, it sends the error response itself and returns false.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// writeUserAccess sends the roles of a user, the permissions granted to them directly
+// and the permissions they end up holding from both.
+func (app *application) writeUserAccess(w http.ResponseWriter, r *http.Request, user *data.User) {
+	roles, err := app.models.Roles.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	direct, err := app.models.Permissions.GetDirectForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	effective, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	access := envelope{
+		"user_id":               user.ID,
+		"roles":                 roles,
+		"permissions":           direct,
+		"effective_permissions": effective,
+	}
+	err = app.writeJson(w, http.StatusOK, envelope{"access": access}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
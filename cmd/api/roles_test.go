@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRoleManagement(t *testing.T) {
+	app := newTestApplication(t)
+	_, admin := newTestUser(t, app, "admin@example.com", true, "admin")
+	_, editor := newTestUser(t, app, "editor@example.com", true, "editor")
+	user, _ := newTestUser(t, app, "alice@example.com", true, "viewer")
+	base := fmt.Sprintf("/v1/users/%d", user.ID)
+
+	access := func(r testResponse) string {
+		r.wantStatus(t, http.StatusOK)
+		a := r.body["access"].(map[string]any)
+		return fmt.Sprint(a["roles"], a["permissions"], a["effective_permissions"])
+	}
+
+	t.Run("list roles", func(t *testing.T) {
+		r := request(t, app, http.MethodGet, "/v1/roles", admin, nil)
+		r.wantStatus(t, http.StatusOK)
+		if got := fmt.Sprint(r.body["roles"]); got != "[map[name:admin permissions:[metrics:view movies:read movies:write]] map[name:editor permissions:[movies:read movies:write]] map[name:viewer permissions:[movies:read]]]" {
+			t.Errorf("got roles %s", got)
+		}
+	})
+	t.Run("show", func(t *testing.T) {
+		if got := access(request(t, app, http.MethodGet, base+"/permissions", admin, nil)); got != "[viewer] [] [movies:read]" {
+			t.Errorf("got %s", got)
+		}
+	})
+	t.Run("grant role", func(t *testing.T) {
+		if got := access(request(t, app, http.MethodPost, base+"/roles", admin, map[string]any{"roles": []string{"editor", "viewer"}})); got != "[editor viewer] [] [movies:read movies:write]" {
+			t.Errorf("got %s", got)
+		}
+	})
+	t.Run("revoke role", func(t *testing.T) {
+		if got := access(request(t, app, http.MethodDelete, base+"/roles/editor", admin, nil)); got != "[viewer] [] [movies:read]" {
+			t.Errorf("got %s", got)
+		}
+	})
+	t.Run("grant permission", func(t *testing.T) {
+		if got := access(request(t, app, http.MethodPost, base+"/permissions", admin, map[string]any{"permissions": []string{"metrics:view"}})); got != "[viewer] [metrics:view] [metrics:view movies:read]" {
+			t.Errorf("got %s", got)
+		}
+	})
+	t.Run("revoke permission", func(t *testing.T) {
+		if got := access(request(t, app, http.MethodDelete, base+"/permissions/metrics:view", admin, nil)); got != "[viewer] [] [movies:read]" {
+			t.Errorf("got %s", got)
+		}
+	})
+
+	invalid := []struct {
+		path  string
+		body  map[string]any
+		field string
+	}{
+		{"/roles", map[string]any{"roles": []string{"editor", "owner"}}, "roles"},
+		{"/roles", map[string]any{"roles": []string{}}, "roles"},
+		{"/permissions", map[string]any{"permissions": []string{"movies:delete"}}, "permissions"},
+		{"/permissions", map[string]any{}, "permissions"},
+	}
+	for _, tt := range invalid {
+		t.Run(fmt.Sprint("invalid ", tt.body), func(t *testing.T) {
+			request(t, app, http.MethodPost, base+tt.path, admin, tt.body).wantError(t, tt.field)
+		})
+	}
+	t.Run("unknown role granted nothing", func(t *testing.T) {
+		if got := access(request(t, app, http.MethodGet, base+"/permissions", admin, nil)); got != "[viewer] [] [movies:read]" {
+			t.Errorf("got %s", got)
+		}
+	})
+	t.Run("bad request", func(t *testing.T) {
+		request(t, app, http.MethodPost, base+"/roles", admin, `{"roles": "editor"}`).wantStatus(t, http.StatusBadRequest)
+	})
+
+	denied := []struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{http.MethodGet, "/v1/roles", "", http.StatusUnauthorized},
+		{http.MethodGet, "/v1/roles", editor, http.StatusForbidden},
+		{http.MethodGet, base + "/permissions", editor, http.StatusForbidden},
+		{http.MethodPost, base + "/permissions", editor, http.StatusForbidden},
+		{http.MethodDelete, base + "/permissions/movies:read", editor, http.StatusForbidden},
+		{http.MethodPost, base + "/roles", editor, http.StatusForbidden},
+		{http.MethodDelete, base + "/roles/viewer", editor, http.StatusForbidden},
+		{http.MethodGet, "/v1/users/99/permissions", admin, http.StatusNotFound},
+		{http.MethodPost, "/v1/users/99/roles", admin, http.StatusNotFound},
+		{http.MethodDelete, "/v1/users/abc/roles/viewer", admin, http.StatusNotFound},
+	}
+	for _, tt := range denied {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			request(t, app, tt.method, tt.path, tt.token, nil).wantStatus(t, tt.want)
+		})
+	}
+}
@@ -3,25 +3,161 @@ package main
 import (
 	"expvar"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func (app *application) router() http.Handler {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/healthcheck", app.healthcheckHandler)
+	rt := newRouter(app)
+	rt.handle(http.MethodGet, "/v1/healthcheck", http.HandlerFunc(app.healthcheckHandler))
+	rt.handle(http.MethodGet, "/v1/healthcheck/live", http.HandlerFunc(app.livenessHandler))
+	rt.handle(http.MethodGet, "/v1/healthcheck/ready", http.HandlerFunc(app.readinessHandler))
 	// Use the requirePermission() middleware on each of the /v1/movies** endpoints,
 	// passing in the required permission code as the first parameter
-	mux.HandleFunc("/v1/home", app.requirePermisson("movies:read", http.HandlerFunc(app.listMoviesHandler)))
-	mux.HandleFunc("/v1/movies", app.requirePermisson("movies:write", http.HandlerFunc(app.createMovieHandler)))
-	mux.HandleFunc("/v1/onemovies", app.requirePermisson("movies:read", http.HandlerFunc(app.showMovieHandler)))
-	mux.HandleFunc("/v1/updatemovies", app.requirePermisson("movies:write", http.HandlerFunc(app.updateMovieHandler)))
-	mux.HandleFunc("/v1/delete", app.requirePermisson("movies:write", http.HandlerFunc(app.deleteMovieHandler)))
+	rt.handle(http.MethodGet, "/v1/movies", app.requirePermisson(allOf("movies:read"), http.HandlerFunc(app.listMoviesHandler)))
+	rt.handle(http.MethodPost, "/v1/movies", app.requirePermisson(allOf("movies:write"), http.HandlerFunc(app.createMovieHandler)))
+	rt.handle(http.MethodGet, "/v1/movies/{id}", app.requirePermisson(allOf("movies:read"), http.HandlerFunc(app.showMovieHandler)))
+	rt.handle(http.MethodPatch, "/v1/movies/{id}", app.requirePermisson(allOf("movies:write"), http.HandlerFunc(app.updateMovieHandler)))
+	rt.handle(http.MethodDelete, "/v1/movies/{id}", app.requirePermisson(allOf("movies:write"), http.HandlerFunc(app.deleteMovieHandler)))
+	rt.handle(http.MethodGet, "/v1/genres", app.requirePermisson(allOf("movies:read"), http.HandlerFunc(app.listGenresHandler)))
 	// Add the route for the POST /v1/users endpoint.
-	mux.HandleFunc("/v1/users", app.registerUserHandler)
-	mux.HandleFunc("/v1/users/activated", app.activateUserHandler)
-	mux.HandleFunc("/v1/users/password", app.updateUserPasswordHandler)
-	mux.HandleFunc("/v1/tokens/authentication", app.createAuthenticationTokenHandler)
-	mux.HandleFunc("/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	rt.handle(http.MethodPost, "/v1/users", app.rateLimitStrict(http.HandlerFunc(app.registerUserHandler)))
+	rt.handle(http.MethodPut, "/v1/users/activated", http.HandlerFunc(app.activateUserHandler))
+	rt.handle(http.MethodPut, "/v1/users/password", http.HandlerFunc(app.updateUserPasswordHandler))
+	rt.handle(http.MethodPut, "/v1/users/email", http.HandlerFunc(app.confirmEmailHandler))
+	rt.handle(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	rt.handle(http.MethodPatch, "/v1/users/me", app.requireAuthenticatedUser(app.updateCurrentUserHandler))
+	rt.handle(http.MethodDelete, "/v1/users/me", app.rateLimitStrict(app.requireAuthenticatedUser(app.deleteCurrentUserHandler)))
+	rt.handle(http.MethodGet, "/v1/users/me/email-opt-outs", app.requireActivatedUser(app.showEmailOptOutsHandler))
+	rt.handle(http.MethodPut, "/v1/users/me/email-opt-outs", app.requireActivatedUser(app.updateEmailOptOutsHandler))
+	rt.handle(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.listSessionsHandler))
+	rt.handle(http.MethodDelete, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.deleteAllSessionsHandler))
+	rt.handle(http.MethodDelete, "/v1/users/me/sessions/{id}", app.requireAuthenticatedUser(app.deleteSessionHandler))
+	// The role and permission management endpoints are only open to admins.
+	admin := hasRole("admin")
+	rt.handle(http.MethodGet, "/v1/roles", app.requirePermisson(admin, http.HandlerFunc(app.listRolesHandler)))
+	rt.handle(http.MethodGet, "/v1/users/{id}/permissions", app.requirePermisson(admin, http.HandlerFunc(app.showUserAccessHandler)))
+	rt.handle(http.MethodPost, "/v1/users/{id}/permissions", app.requirePermisson(admin, http.HandlerFunc(app.grantUserPermissionsHandler)))
+	rt.handle(http.MethodDelete, "/v1/users/{id}/permissions/{code}", app.requirePermisson(admin, http.HandlerFunc(app.revokeUserPermissionHandler)))
+	rt.handle(http.MethodPost, "/v1/users/{id}/roles", app.requirePermisson(admin, http.HandlerFunc(app.grantUserRolesHandler)))
+	rt.handle(http.MethodDelete, "/v1/users/{id}/roles/{role}", app.requirePermisson(admin, http.HandlerFunc(app.revokeUserRoleHandler)))
+	rt.handle(http.MethodGet, "/v1/log-level", app.requirePermisson(admin, http.HandlerFunc(app.showLogLevelHandler)))
+	rt.handle(http.MethodPut, "/v1/log-level", app.requirePermisson(admin, http.HandlerFunc(app.updateLogLevelHandler)))
+	rt.handle(http.MethodGet, "/v1/emails", app.requirePermisson(admin, http.HandlerFunc(app.listEmailsHandler)))
+	rt.handle(http.MethodPost, "/v1/emails/{id}/retry", app.requirePermisson(admin, http.HandlerFunc(app.retryEmailHandler)))
+	rt.handle(http.MethodPost, "/v1/tokens/authentication", app.rateLimitStrict(http.HandlerFunc(app.createAuthenticationTokenHandler)))
+	rt.handle(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	// Refresh tokens are only issued in jwt mode.
+	if app.config.tokens.mode == authModeJWT {
+		rt.handle(http.MethodPost, "/v1/tokens/refresh", app.rateLimitStrict(http.HandlerFunc(app.refreshTokenHandler)))
+	}
+	rt.handle(http.MethodPost, "/v1/tokens/password-reset", app.rateLimitStrict(http.HandlerFunc(app.createPasswordResetTokenHandler)))
+	rt.handle(http.MethodPost, "/v1/tokens/activation", app.rateLimitStrict(http.HandlerFunc(app.createActivationTokenHandler)))
 	// Reagister a new Get /debug/vars endpont pointing to the expvar handler
-	mux.Handle("/v1/metrics", expvar.Handler())
-	return app.metrics(app.recoverPanic(app.enableCORS(app.authenticate(mux))))
+	rt.handle(http.MethodGet, "/v1/metrics", expvar.Handler())
+
+	// The movie endpoints used to live on ad-hoc paths with the id in the query string,
+	// and answered any method. Keep serving them with the handlers they used to call, so
+	// that existing clients keep working. Redirecting them instead would send a GET
+	// /v1/delete to GET /v1/movies/{id}, which means something else entirely.
+	rt.handleAny("/v1/home", app.requirePermisson(allOf("movies:read"), http.HandlerFunc(app.listMoviesHandler)))
+	rt.handleAny("/v1/onemovies", app.legacyMovieRoute(app.requirePermisson(allOf("movies:read"), http.HandlerFunc(app.showMovieHandler))))
+	rt.handleAny("/v1/updatemovies", app.legacyMovieRoute(app.requirePermisson(allOf("movies:write"), http.HandlerFunc(app.updateMovieHandler))))
+	rt.handleAny("/v1/delete", app.legacyMovieRoute(app.requirePermisson(allOf("movies:write"), http.HandlerFunc(app.deleteMovieHandler))))
+
+	// Serve the Prometheus metrics here, to users with the metrics:view permission,
+	// unless they have a listen address of their own.
+	if app.config.metrics.addr == "" {
+		rt.handle(http.MethodGet, "/metrics", app.requirePermisson(allOf("metrics:view"), app.instruments.registry.Handler()))
+	}
+
+	// The requestID() middleware comes first, so that every log entry written for the
+	// request can include its id. The limit on IP addresses comes before authenticate(),
+	// and the limit on users after it, as it needs to know who the user is.
+	return app.requestID(app.metrics(app.recoverPanic(app.enableCORS(app.rateLimitIP(app.authenticate(app.rateLimitUser(rt.mux)))))))
+}
+
+// router wraps a http.ServeMux and records which methods are registered for each path
+// pattern. The mux itself answers requests for unknown methods with a plain-text 405,
+// so for every path we also register a method-less fallback, which the mux only picks
+// when none of the method-specific patterns match. The fallback answers OPTIONS
+// requests and sends our own JSON 405 response, both with an Allow header.
+type router struct {
+	app     *application
+	mux     *http.ServeMux
+	methods map[string][]string
+}
+
+func newRouter(app *application) *router {
+	rt := &router{
+		app:     app,
+		mux:     http.NewServeMux(),
+		methods: make(map[string][]string),
+	}
+	// The "/" pattern matches every path which no other pattern does, so it acts as
+	// our custom 404 handler.
+	rt.handleAny("/", http.HandlerFunc(app.notFoundResponse))
+	return rt
+}
+
+func (rt *router) handle(method, pattern string, handler http.Handler) {
+	rt.mux.Handle(method+" "+pattern, recordRoute(pattern, handler))
+	if _, exists := rt.methods[pattern]; !exists {
+		rt.handleAny(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", rt.allow(pattern))
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			rt.app.methodNotAllowedResponse(w, r)
+		}))
+	}
+	rt.methods[pattern] = append(rt.methods[pattern], method)
+}
+
+// handleAny registers a handler for a path pattern regardless of the method.
+func (rt *router) handleAny(pattern string, handler http.Handler) {
+	rt.mux.Handle(pattern, recordRoute(pattern, handler))
+}
+
+// recordRoute stores the pattern a request was matched with in its requestInfo, so that
+// the metrics can be labelled by route rather than by the actual path, which would
+// give every movie id its own set of metrics.
+func recordRoute(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := contextGetRequestInfo(r); info != nil {
+			info.route = pattern
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow returns the value of the Allow header for a path pattern. A GET route also
+// serves HEAD requests.
+func (rt *router) allow(pattern string) string {
+	methods := []string{http.MethodOptions}
+	for _, method := range rt.methods[pattern] {
+		methods = append(methods, method)
+		if method == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// The legacyMovieRoute middleware serves the old single movie endpoints, which took the
+// id from the query string, by copying it to the {id} path value that readIDParam()
+// reads.
+func (app *application) legacyMovieRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id < 1 {
+			app.notFoundResponse(w, r)
+			return
+		}
+		r.SetPathValue("id", strconv.Itoa(id))
+		next.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	app := newTestApplication(t)
+	_, admin := newTestUser(t, app, "admin@example.com", true, "admin")
+	_, editor := newTestUser(t, app, "editor@example.com", true, "editor")
+
+	t.Run("not found", func(t *testing.T) {
+		request(t, app, http.MethodGet, "/v1/films", "", nil).wantStatus(t, http.StatusNotFound)
+	})
+	t.Run("method not allowed", func(t *testing.T) {
+		r := request(t, app, http.MethodPut, "/v1/movies/1", editor, nil)
+		r.wantStatus(t, http.StatusMethodNotAllowed)
+		if got := r.header.Get("Allow"); got != "DELETE, GET, HEAD, OPTIONS, PATCH" {
+			t.Errorf("got Allow %q", got)
+		}
+	})
+	t.Run("options", func(t *testing.T) {
+		r := request(t, app, http.MethodOptions, "/v1/users", "", nil)
+		r.wantStatus(t, http.StatusNoContent)
+		if got := r.header.Get("Allow"); got != "OPTIONS, POST" {
+			t.Errorf("got Allow %q", got)
+		}
+	})
+
+	// The legacy paths call the handlers they always did, whatever the method, so a GET
+	// of /v1/delete still deletes the movie rather than showing it.
+	t.Run("legacy paths", func(t *testing.T) {
+		movie := newTestMovie(t, app, "Moana", 2016, 107, "animation")
+		path := func(legacy string) string { return fmt.Sprintf("%s?id=%d", legacy, movie.ID) }
+
+		r := request(t, app, http.MethodGet, "/v1/home?title=moana", editor, nil)
+		r.wantStatus(t, http.StatusOK)
+		if movies := r.body["movies"].([]any); len(movies) != 1 {
+			t.Errorf("got movies %v", movies)
+		}
+		r = request(t, app, http.MethodPost, path("/v1/onemovies"), editor, nil)
+		r.wantStatus(t, http.StatusOK)
+		if got := r.body["movie"].(map[string]any)["title"]; got != "Moana" {
+			t.Errorf("got title %v", got)
+		}
+		r = request(t, app, http.MethodPost, path("/v1/updatemovies"), editor, map[string]any{"year": 2017})
+		r.wantStatus(t, http.StatusOK)
+		if got := r.body["movie"].(map[string]any)["year"]; got != 2017.0 {
+			t.Errorf("got year %v", got)
+		}
+		request(t, app, http.MethodGet, path("/v1/delete"), editor, nil).wantStatus(t, http.StatusOK)
+		request(t, app, http.MethodGet, path("/v1/onemovies"), editor, nil).wantStatus(t, http.StatusNotFound)
+	})
+	t.Run("legacy permissions", func(t *testing.T) {
+		request(t, app, http.MethodGet, "/v1/onemovies?id=1", "", nil).wantStatus(t, http.StatusUnauthorized)
+	})
+	t.Run("legacy without id", func(t *testing.T) {
+		for _, path := range []string{"/v1/onemovies", "/v1/delete?id=abc", "/v1/updatemovies?id=0"} {
+			request(t, app, http.MethodGet, path, editor, nil).wantStatus(t, http.StatusNotFound)
+		}
+	})
+
+	t.Run("expvar", func(t *testing.T) {
+		request(t, app, http.MethodGet, "/v1/metrics", "", nil).wantStatus(t, http.StatusOK)
+	})
+
+	for name, tt := range map[string]struct {
+		token string
+		want  int
+	}{
+		"metrics anonymous": {"", http.StatusUnauthorized},
+		"metrics editor":    {editor, http.StatusForbidden},
+		"metrics admin":     {admin, http.StatusOK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			request(t, app, http.MethodGet, "/metrics", tt.token, nil).wantStatus(t, tt.want)
+		})
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"forum/internal/jsonlog"
 )
 
 func (app *application) serve() error {
@@ -22,6 +24,10 @@ func (app *application) serve() error {
 	// Create a shutdownError channel. We will use this to receive any errors returned
 	// by the graceful Shutdown() function.
 	shutDownError := make(chan error)
+	// The token janitor and the eviction of idle rate limiter clients run until the
+	// shutdown cancels their context.
+	tasksCtx, stopTasks := context.WithCancel(context.Background())
+	defer stopTasks()
 	// Start a background goroutine
 	go func() {
 		// Create a quit channel which carries os.Signal values
@@ -33,9 +39,16 @@ func (app *application) serve() error {
 		// Read the signal from the quit channel. This code will block until a signal is
 		// received.
 		s := <-quit
-		app.logger.PrintInfo("caught signal", map[string]string{
+		app.logger.PrintInfo("caught signal", jsonlog.Fields{
 			"signal": s.String(),
 		})
+		// Fail the readiness check from now on, and give load balancers the drain
+		// delay to notice that and stop sending us new requests.
+		app.draining.Store(true)
+		if app.config.shutdown.drainDelay > 0 {
+			app.logger.PrintInfo("draining", jsonlog.Fields{"delay": app.config.shutdown.drainDelay})
+			time.Sleep(app.config.shutdown.drainDelay)
+		}
 		// Create a context with a 20-second timeout
 		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
@@ -48,15 +61,45 @@ func (app *application) serve() error {
 		if err != nil {
 			shutDownError <- err
 		}
+		// No more emails will be queued, so tell the outbox workers to deliver the ones
+		// which are due and then stop.
+		app.outbox.stop(app.config.outbox.drainTimeout)
+		// The token janitor and the eviction have nothing to finish, so they can stop
+		// straight away.
+		stopTasks()
 		// Log a message to say that we're waiting for any background goroutines to
 		// complete their tasks.
-		app.logger.PrintInfo("completing background tasks", map[string]string{
+		app.logger.PrintInfo("completing background tasks", jsonlog.Fields{
 			"addr": srv.Addr,
 		})
 		app.wg.Wait()
 		shutDownError <- nil
 	}()
-	app.logger.PrintInfo("starting server", map[string]string{
+	// If the metrics have a listen address of their own, serve them there. This is
+	// meant for an address which only the monitoring system can reach, so the
+	// endpoint isn't protected by a permission.
+	if app.config.metrics.addr != "" {
+		metricsSrv := &http.Server{
+			Addr:         app.config.metrics.addr,
+			Handler:      app.instruments.registry.Handler(),
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+		srv.RegisterOnShutdown(func() {
+			metricsSrv.Close()
+		})
+		go func() {
+			app.logger.PrintInfo("starting metrics server", jsonlog.Fields{"addr": metricsSrv.Addr})
+			err := metricsSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, jsonlog.Fields{"addr": metricsSrv.Addr})
+			}
+		}()
+	}
+	app.startOutbox()
+	app.startTokenJanitor(tasksCtx)
+	app.startRateLimiterEviction(tasksCtx)
+	app.logger.PrintInfo("starting server", jsonlog.Fields{
 		"addr": srv.Addr,
 		"env":  app.config.env,
 	})
@@ -77,7 +120,7 @@ func (app *application) serve() error {
 	}
 	// At this point we know that the graceful shutdown completed successfully and we
 	// log a "stopped server" message.
-	app.logger.PrintInfo("stopped server", map[string]string{
+	app.logger.PrintInfo("stopped server", jsonlog.Fields{
 		"addr": srv.Addr,
 	})
 	return nil
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"forum/internal/data"
+)
+
+// The sessions of a user are their authentication tokens, one for every time they
+// signed in, or in jwt mode their refresh tokens. These endpoints let them see where
+// they are signed in and sign out the devices they no longer use, or which they don't
+// recognize. Signing a device out in jwt mode stops it from getting new access tokens,
+// while the access token it already has works until it expires.
+
+// sessionScope returns the scope of the tokens which are the sessions of the users.
+func (app *application) sessionScope() string {
+	if app.config.tokens.mode == authModeJWT {
+		return data.ScopeRefresh
+	}
+	return data.ScopeAuthentication
+}
+
+// The listSessionsHandler returns the sessions of the authenticated user which haven't
+// expired, most recently used first, marking the one the request was made with.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	sessions, err := app.models.Tokens.GetSessionsForUser(r.Context(), app.sessionScope(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token := app.contextGetToken(r)
+	for _, session := range sessions {
+		if token.signed {
+			session.Current = session.ID == token.sessionID
+		} else {
+			session.Current = session.IsToken(token.plaintext)
+		}
+	}
+	err = app.writeJson(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteSessionHandler signs the authenticated user out of one of their sessions.
+// The sessions of other users are reported as not found.
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	err = app.models.Tokens.DeleteSession(r.Context(), app.sessionScope(), user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAllSessionsHandler signs the authenticated user out everywhere, including
+// the session the request was made with.
+func (app *application) deleteAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	err := app.models.Tokens.DeleteAllForUser(r.Context(), app.sessionScope(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "all sessions successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/data"
+	"forum/internal/jsonlog"
+)
+
+// signIn creates an authentication token for alice@example.com from a client with the
+// given user agent, and returns it.
+func signIn(t *testing.T, app *application, userAgent string) string {
+	t.Helper()
+	r := requestWithHeader(t, app, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{
+		"email": "alice@example.com", "password": testPassword,
+	}, http.Header{"User-Agent": {userAgent}})
+	r.wantStatus(t, http.StatusCreated)
+	return r.body["authenrication_token"].(map[string]any)["token"].(string)
+}
+
+func TestSessions(t *testing.T) {
+	app := newTestApplication(t)
+	// Alice starts out with a session which was created without a client.
+	_, desktop := newTestUser(t, app, "alice@example.com", true)
+	_, bobToken := newTestUser(t, app, "bob@example.com", true)
+	laptop := signIn(t, app, "Firefox")
+	phone := signIn(t, app, "Safari")
+	tablet := signIn(t, app, "Chrome")
+
+	r := request(t, app, http.MethodGet, "/v1/users/me/sessions", phone, nil)
+	r.wantStatus(t, http.StatusOK)
+	sessions := r.body["sessions"].([]any)
+	if len(sessions) != 4 {
+		t.Fatalf("got sessions %v, want the four of Alice", sessions)
+	}
+	var laptopID float64
+	for _, s := range sessions {
+		session := s.(map[string]any)
+		if got, want := session["current"], session["user_agent"] == "Safari"; got != want {
+			t.Errorf("got current %v for the %v session", got, session["user_agent"])
+		}
+		if session["user_agent"] != "" && session["ip"] != "192.0.2.1" || session["created_at"] == nil || session["last_used_at"] == nil {
+			t.Errorf("got session %v", session)
+		}
+		if _, ok := session["token"]; ok {
+			t.Errorf("the session %v gives its token away", session)
+		}
+		if session["user_agent"] == "Firefox" {
+			laptopID = session["id"].(float64)
+		}
+	}
+
+	// Alice signs the laptop out from her phone. Bob can't do that for her.
+	path := fmt.Sprintf("/v1/users/me/sessions/%d", int(laptopID))
+	request(t, app, http.MethodDelete, path, bobToken, nil).wantStatus(t, http.StatusNotFound)
+	request(t, app, http.MethodGet, "/v1/users/me", laptop, nil).wantStatus(t, http.StatusOK)
+	request(t, app, http.MethodDelete, path, phone, nil).wantStatus(t, http.StatusOK)
+	request(t, app, http.MethodGet, "/v1/users/me", laptop, nil).wantStatus(t, http.StatusUnauthorized)
+	request(t, app, http.MethodDelete, path, phone, nil).wantStatus(t, http.StatusNotFound)
+	request(t, app, http.MethodDelete, "/v1/users/me/sessions/abc", phone, nil).wantStatus(t, http.StatusNotFound)
+
+	// She signs out of her phone.
+	request(t, app, http.MethodDelete, "/v1/tokens/authentication", phone, nil).wantStatus(t, http.StatusOK)
+	request(t, app, http.MethodGet, "/v1/users/me", phone, nil).wantStatus(t, http.StatusUnauthorized)
+	request(t, app, http.MethodDelete, "/v1/tokens/authentication", "", nil).wantStatus(t, http.StatusUnauthorized)
+
+	// Then she signs out everywhere, which leaves Bob signed in.
+	signIn(t, app, "Edge")
+	request(t, app, http.MethodDelete, "/v1/users/me/sessions", tablet, nil).wantStatus(t, http.StatusOK)
+	request(t, app, http.MethodGet, "/v1/users/me", tablet, nil).wantStatus(t, http.StatusUnauthorized)
+	request(t, app, http.MethodGet, "/v1/users/me", desktop, nil).wantStatus(t, http.StatusUnauthorized)
+	r = request(t, app, http.MethodGet, "/v1/users/me/sessions", bobToken, nil)
+	r.wantStatus(t, http.StatusOK)
+	if sessions := r.body["sessions"].([]any); len(sessions) != 1 {
+		t.Errorf("got sessions %v, want Bob's session to be left alone", sessions)
+	}
+}
+
+func TestTokenJanitor(t *testing.T) {
+	app := newTestApplication(t)
+	user, token := newTestUser(t, app, "alice@example.com", true)
+	ctx := context.Background()
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopePasswordReset} {
+		if _, err := app.models.Tokens.New(ctx, user.ID, -time.Minute, scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A failed email is kept for as long as the tokens in it could still be used, so
+	// that an admin can retry it.
+	email := &data.Email{Recipient: "alice@example.com", Template: "password-reset", Data: []byte(`{}`)}
+	if err := app.models.Emails.Enqueue(ctx, email); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Emails.MarkFailed(ctx, email.ID, "mailbox unavailable"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The janitor deletes the expired tokens as soon as it starts, and stops once its
+	// context is cancelled.
+	janitorCtx, stop := context.WithCancel(ctx)
+	app.startTokenJanitor(janitorCtx)
+	stop()
+	app.wg.Wait()
+	if deleted, err := app.models.Tokens.DeleteExpired(ctx); deleted != 0 || err != nil {
+		t.Fatalf("DeleteExpired() = %d, %v; want the janitor to have deleted the expired tokens", deleted, err)
+	}
+	request(t, app, http.MethodGet, "/v1/users/me", token, nil).wantStatus(t, http.StatusOK)
+	outboxEmail(t, app, email.ID)
+}
+
+// untouchableTokens is a TokenRepository which can't record the use of a token.
+type untouchableTokens struct {
+	data.TokenRepository
+}
+
+func (untouchableTokens) Touch(ctx context.Context, tokenPlaintext string, ttl time.Duration, ip string) error {
+	return errors.New("database is locked")
+}
+
+func TestTouchFailure(t *testing.T) {
+	app := newTestApplication(t)
+	var buf bytes.Buffer
+	app.logger = jsonlog.New(&buf, jsonlog.LevelInfo)
+	_, token := newTestUser(t, app, "alice@example.com", true)
+	app.models.Tokens = untouchableTokens{app.models.Tokens}
+
+	// The request still goes through, and the error is logged with its request id.
+	r := request(t, app, http.MethodGet, "/v1/users/me", token, nil)
+	r.wantStatus(t, http.StatusOK)
+	want := fmt.Sprintf(`"message":"database is locked","properties":{"request_id":%q`, r.header.Get("X-Request-ID"))
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("got log:\n%s", buf.String())
+	}
+}
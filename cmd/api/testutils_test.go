@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"forum/internal/data"
+	"forum/internal/jsonlog"
+	"forum/internal/jwt"
+	"forum/internal/mailer"
+)
+
+// newTestApplication returns an application backed by the in-memory models, with rate
+// limiting off, logs discarded and a mailer which keeps the emails in memory. The
+// readiness check reports the database as up.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+	var cfg config
+	cfg.env = "testing"
+	cfg.cursor.secret = strings.Repeat("s", 32)
+	cfg.tokens.passwordResetTTL = 45 * time.Minute
+	cfg.tokens.authenticationTTL = 12 * time.Hour
+	cfg.tokens.janitorInterval = time.Hour
+	cfg.tokens.mode = authModeOpaque
+	cfg.tokens.accessTTL = 15 * time.Minute
+	cfg.tokens.refreshTTL = 30 * 24 * time.Hour
+	templates, err := mailer.LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{
+		config:      cfg,
+		logger:      jsonlog.New(io.Discard, jsonlog.LevelInfo),
+		models:      data.NewMemoryModels(),
+		mailer:      mailer.New(mailer.NewRecorder(), testSender, templates),
+		outbox:      newOutbox(),
+		instruments: newInstruments(nil),
+		readinessChecks: map[string]func(ctx context.Context) error{
+			"database": func(ctx context.Context) error { return nil },
+		},
+	}
+	// Wait for the welcome emails and other background tasks before the next test.
+	t.Cleanup(app.wg.Wait)
+	return app
+}
+
+// newJWTTestApplication returns a test application in jwt mode, signing its access
+// tokens with an HS256 key.
+func newJWTTestApplication(t *testing.T) *application {
+	t.Helper()
+	app := newTestApplication(t)
+	keys, err := jwt.ParseKeySet("test-1:HS256:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.config.tokens.mode = authModeJWT
+	app.accessTokens = keys
+	return app
+}
+
+const testSender = "Greenlight <no-reply@greenlight.test>"
+
+// newMailRecorder gives the app a mailer which records the emails it sends, and returns
+// the recorder.
+func newMailRecorder(app *application) *mailer.Recorder {
+	recorder := mailer.NewRecorder()
+	app.mailer = mailer.New(recorder, testSender, app.mailer.Templates())
+	return recorder
+}
+
+// testResponse is a response recorded from the application's router, with its body
+// decoded if it is JSON.
+type testResponse struct {
+	status int
+	header http.Header
+	body   map[string]any
+}
+
+// request sends a request through the whole middleware chain and router. A non-empty
+// token is sent as a bearer token, and a non-nil body is encoded as JSON unless it is
+// a string, which is sent as it is.
+func request(t *testing.T, app *application, method, path, token string, body any) testResponse {
+	t.Helper()
+	return requestWithHeader(t, app, method, path, token, body, nil)
+}
+
+// requestWithHeader is like request, and also sends the given header fields.
+func requestWithHeader(t *testing.T, app *application, method, path, token string, body any, header http.Header) testResponse {
+	t.Helper()
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(body)
+	default:
+		js, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(js)
+	}
+	r := httptest.NewRequest(method, path, reader)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	app.router().ServeHTTP(rr, r)
+	res := testResponse{status: rr.Code, header: rr.Header()}
+	if rr.Header().Get("Content-Type") == "application/json" {
+		if err := json.Unmarshal(rr.Body.Bytes(), &res.body); err != nil {
+			t.Fatalf("%s %s: decoding response body %q: %v", method, path, rr.Body.String(), err)
+		}
+	}
+	return res
+}
+
+// wantStatus fails the test if the response doesn't have the expected status code.
+func (res testResponse) wantStatus(t *testing.T, want int) {
+	t.Helper()
+	if res.status != want {
+		t.Fatalf("got status %d, want %d; body: %v", res.status, want, res.body)
+	}
+}
+
+// wantError fails the test unless the response is a validation failure with an error
+// for the given field.
+func (res testResponse) wantError(t *testing.T, field string) {
+	t.Helper()
+	res.wantStatus(t, http.StatusUnprocessableEntity)
+	errs, _ := res.body["error"].(map[string]any)
+	if _, ok := errs[field]; !ok {
+		t.Fatalf("got errors %v, want one for %q", res.body["error"], field)
+	}
+}
+
+const testPassword = "pa55word1234"
+
+// Hashing a password with bcrypt takes a noticeable amount of time, so every test user
+// shares the password of this one, which is hashed once.
+var hashedTestUser = sync.OnceValue(func() data.User {
+	var user data.User
+	if err := user.Password.Set(testPassword); err != nil {
+		panic(err)
+	}
+	return user
+})
+
+// newTestUser inserts a user with the testPassword and the given roles, and returns the
+// user along with an authentication token for them.
+func newTestUser(t *testing.T, app *application, email string, activated bool, roles ...string) (*data.User, string) {
+	t.Helper()
+	user := &data.User{Name: "Test User", Email: email, Activated: activated}
+	user.Password = hashedTestUser().Password
+	if err := app.models.Users.Insert(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Roles.AddForUser(context.Background(), user.ID, roles...); err != nil {
+		t.Fatal(err)
+	}
+	token, err := app.models.Tokens.New(context.Background(), user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token.Plaintext
+}
+
+// newTestMovie inserts a movie and returns it.
+func newTestMovie(t *testing.T, app *application, title string, year int32, runtime data.Runtime, genres ...string) *data.Movie {
+	t.Helper()
+	movie := &data.Movie{Title: title, Year: year, Runtime: runtime, Genres: genres}
+	if err := app.models.Movies.Insert(context.Background(), movie); err != nil {
+		t.Fatal(err)
+	}
+	return movie
+}
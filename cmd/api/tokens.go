@@ -2,14 +2,35 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"forum/internal/data"
+	"forum/internal/jsonlog"
+	"forum/internal/jwt"
 	"forum/internal/validator"
 )
 
+// How long the tokens we email to users stay valid.
+const (
+	activationTokenTTL  = 12 * time.Hour
+	emailChangeTokenTTL = 24 * time.Hour
+)
+
+// The kinds of authentication token the API can issue on sign-in, chosen with the
+// -auth-token-mode flag. In opaque mode the client gets a random token which is looked
+// up in the database on every request. In jwt mode it gets a short-lived access token,
+// signed so that it can be checked without the database, and a long-lived refresh
+// token to get new ones with.
+const (
+	authModeOpaque = "opaque"
+	authModeJWT    = "jwt"
+)
+
+// maxUserAgentLength caps the User-Agent header kept with an authentication token.
+const maxUserAgentLength = 256
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email    string `json:"email"`
@@ -31,7 +52,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// Lookup the user record based on the email address. If no matching user was
 	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
 	// Unauthorized response to the client (we will create this helper in a moment).
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -53,15 +74,23 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	// Add for authenticated user
-	err = app.models.Permissions.AddForUser(user.ID, "movies:write")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+	// OtherWise, if password is correct, we generate a new authentication token, which
+	// remembers the client it was issued to so that the user can tell their sessions
+	// apart.
+	userAgent := truncate(r.UserAgent(), maxUserAgentLength)
+	ip := clientIP(r, app.config.limiter.trustedProxies)
+	// In jwt mode the session is a refresh token instead, which comes with the first
+	// access token.
+	if app.config.tokens.mode == authModeJWT {
+		refresh, err := app.models.Tokens.NewSession(r.Context(), data.ScopeRefresh, user.ID, app.config.tokens.refreshTTL, userAgent, ip)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.writeTokenPair(w, r, user, refresh)
 		return
 	}
-	// OtherWise, if password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope `authentication`
-	token, err := app.models.Tokens.New(user.ID, 12*time.Hour, data.ScopeAuthentication)
+	token, err := app.models.Tokens.NewSession(r.Context(), data.ScopeAuthentication, user.ID, app.config.tokens.authenticationTTL, userAgent, ip)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -74,9 +103,13 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 }
 
-func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+// The refreshTokenHandler swaps a refresh token for a new access token and a new
+// refresh token, which replaces the old one. A refresh token can only be used once, so
+// if one which was already swapped comes back, either the client or someone who stole
+// it used it before: we can't tell which, so the whole session is revoked.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Email string `json:"email"`
+		Token string `json:"token"`
 	}
 	err := app.readJson(w, r, &input)
 	if err != nil {
@@ -84,52 +117,259 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 	v := validator.New()
-	if data.ValidateEmail(v, input.Email); v.Valid() {
+	if data.ValidateTokenPlainText(v, input.Token); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	// Try to retrive the corresponding user record for the email address. If it can't
-	// be found, return an error message to the client
-	user, err := app.models.Users.GetByEmail(input.Email)
+	refresh, err := app.models.Tokens.GetRefreshToken(r.Context(), input.Token)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("email", "no matching email address found")
+			v.AddError("token", "invalid or expired refresh token")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	// Return an error message if the user is not activated
-	if !user.Activated {
-		v.AddError("email", "user account must be activated")
-		app.failedValidationResponse(w, r, v.Errors)
+	if refresh.Rotated {
+		app.revokeReusedRefreshToken(w, r, refresh)
 		return
 	}
-	// Otherwise, create a new password reset token with a 45-minute expiry time.
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	// Look the user up, so that the access token carries the current state of their
+	// account.
+	user, err := app.models.Users.Get(r.Context(), refresh.UserId)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	fmt.Println("passwordReset handler-userToken: ", token.Plaintext)
-	app.background(func() {
-		data := map[string]any{
-			"passwordResetToken": token.Plaintext,
+	var next *data.Token
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		next, err = tx.Tokens.Rotate(r.Context(), refresh, app.config.tokens.refreshTTL, clientIP(r, app.config.limiter.trustedProxies))
+		return err
+	})
+	if err != nil {
+		switch {
+		// Another request rotated the token first, which is as much a reuse as a
+		// token which comes back later.
+		case errors.Is(err, data.ErrEditConflict):
+			app.revokeReusedRefreshToken(w, r, refresh)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
-		// Since email addresses MAY be case sensitive, notice that we are sending this
-		// email using the address stored in our database for the user --- not to the
-		// input.Email address provided by the client in this request.
-		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		return
+	}
+	app.writeTokenPair(w, r, user, next)
+}
+
+// The revokeReusedRefreshToken() helper deletes the session of a refresh token which
+// was used after it had been rotated, and turns the request down.
+func (app *application) revokeReusedRefreshToken(w http.ResponseWriter, r *http.Request, refresh *data.Token) {
+	err := app.models.Tokens.DeleteFamily(r.Context(), refresh.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.logger.PrintWarn("refresh token reused, session revoked", jsonlog.Fields{
+		"user_id":  refresh.UserId,
+		"token_id": refresh.ID,
+		"ip":       clientIP(r, app.config.limiter.trustedProxies),
+	})
+	v := validator.New()
+	v.AddError("token", "invalid or expired refresh token")
+	app.failedValidationResponse(w, r, v.Errors)
+}
+
+// The writeTokenPair() helper signs an access token for the session of the refresh
+// token, and sends the two of them with a 201 Created status code.
+func (app *application) writeTokenPair(w http.ResponseWriter, r *http.Request, user *data.User, refresh *data.Token) {
+	access, err := app.newAccessToken(user, refresh)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJson(w, http.StatusCreated, envelope{"authenrication_token": access, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// newAccessToken signs an access token for the user, for the session of the refresh
+// token. The Token it returns only has its plaintext, expiry and scope set, which is
+// all a client sees of a token.
+func (app *application) newAccessToken(user *data.User, refresh *data.Token) (*data.Token, error) {
+	now := time.Now()
+	expiry := now.Add(app.config.tokens.accessTTL).Truncate(time.Second)
+	plaintext, err := app.accessTokens.Sign(jwt.Claims{
+		Subject:   strconv.Itoa(user.ID),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiry.Unix(),
+		SessionID: refresh.ID,
+		Activated: user.Activated,
+		Version:   user.Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &data.Token{Plaintext: plaintext, Expiry: expiry, Scope: data.ScopeAuthentication}, nil
+}
+
+// userForAccessToken checks an access token and returns the user it was issued to,
+// along with the id of its session. The user only has the fields the token carries
+// set: their id, whether they are activated and the version of their record. Handlers
+// which need the rest of the account use app.currentUser().
+func (app *application) userForAccessToken(token string) (*data.User, int, error) {
+	claims, err := app.accessTokens.Verify(token, time.Now())
+	if err != nil {
+		return nil, 0, err
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil || id < 1 {
+		return nil, 0, jwt.ErrInvalidToken
+	}
+	return &data.User{ID: id, Activated: claims.Activated, Version: claims.Version}, claims.SessionID, nil
+}
+
+// The deleteAuthenticationTokenHandler signs the user out, by deleting the token they
+// authenticated the request with. In jwt mode that is the session of the access token,
+// which can't be used to get new ones any more, though it works itself until it
+// expires.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	token := app.contextGetToken(r)
+	if token.signed {
+		err = app.models.Tokens.DeleteSession(r.Context(), data.ScopeRefresh, app.contextGetUser(r).ID, token.sessionID)
+		// The session may have been revoked already, from another device.
+		if errors.Is(err, data.ErrRecordNotFound) {
+			err = nil
+		}
+	} else {
+		err = app.models.Tokens.Delete(r.Context(), data.ScopeAuthentication, token.plaintext)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "you have been signed out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createPasswordResetTokenHandler emails a password reset token to the user with the
+// given address. So that it can't be used to find out which addresses have an account,
+// it sends the same response whether or not there is an activated user with the
+// address, and only sends an email if there is.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Try to retrieve the corresponding user record for the email address. Users who
+	// don't exist or haven't been activated get no email, but the client isn't told.
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	case user.Activated:
+		// Replace the password reset tokens the user already has with a new one, so
+		// that only the latest email works, and queue the email with it in the same
+		// unit of work.
+		err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+			err := tx.Tokens.DeleteAllForUser(r.Context(), data.ScopePasswordReset, user.ID)
+			if err != nil {
+				return err
+			}
+			token, err := tx.Tokens.New(r.Context(), user.ID, app.config.tokens.passwordResetTTL, data.ScopePasswordReset)
+			if err != nil {
+				return err
+			}
+			// Since email addresses MAY be case sensitive, notice that we are sending
+			// this email using the address stored in our database for the user --- not
+			// to the input.Email address provided by the client in this request.
+			return app.queueEmail(r.Context(), tx, user, app.emailLocale(r, user), "password-reset", map[string]any{
+				"passwordResetToken": token.Plaintext,
+				"expiry":             token.Expiry,
+				"name":               user.Name,
+			})
+		})
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.serverErrorResponse(w, r, err)
+			return
 		}
-	})
-	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+		app.outbox.wake()
+	}
+	env := envelope{"message": "if there is an activated account with this email address, an email will be sent to it containing password reset instructions"}
 	err = app.writeJson(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createActivationTokenHandler sends a user who hasn't activated their account yet
+// a new activation token, for when the one in their welcome email has expired or been
+// lost. The tokens sent before stop working.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// As with password resets, only a user who exists and hasn't been activated yet
+	// gets an email, and the client gets the same response either way, so that the
+	// endpoint can't be used to find out which email addresses have an account.
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	case !user.Activated:
+		// Delete the activation tokens the user already has, create a new one and
+		// queue the email with it, as one unit of work.
+		err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+			err := tx.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.ID)
+			if err != nil {
+				return err
+			}
+			token, err := tx.Tokens.New(r.Context(), user.ID, activationTokenTTL, data.ScopeActivation)
+			if err != nil {
+				return err
+			}
+			return app.queueEmail(r.Context(), tx, user, app.emailLocale(r, user), "activation-resend", map[string]any{
+				"activationToken": token.Plaintext,
+				"expiry":          token.Expiry,
+				"name":            user.Name,
+			})
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.outbox.wake()
+	}
+	env := envelope{"message": "if there is an account waiting for activation with this email address, an email will be sent to it containing activation instructions"}
+	err = app.writeJson(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
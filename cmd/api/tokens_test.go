@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/data"
+)
+
+func TestCreateAuthenticationToken(t *testing.T) {
+	app := newTestApplication(t)
+	newTestUser(t, app, "alice@example.com", true, "viewer")
+
+	t.Run("created", func(t *testing.T) {
+		r := request(t, app, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{
+			"email": "alice@example.com", "password": testPassword,
+		})
+		r.wantStatus(t, http.StatusCreated)
+		token, _ := r.body["authenrication_token"].(map[string]any)
+		plaintext, _ := token["token"].(string)
+		// The new token authenticates the user.
+		request(t, app, http.MethodGet, "/v1/movies", plaintext, nil).wantStatus(t, http.StatusOK)
+	})
+
+	for name, body := range map[string]map[string]any{
+		"wrong password": {"email": "alice@example.com", "password": "wrong password"},
+		"unknown email":  {"email": "bob@example.com", "password": testPassword},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := request(t, app, http.MethodPost, "/v1/tokens/authentication", "", body)
+			r.wantStatus(t, http.StatusUnauthorized)
+			if got := r.body["error"]; got != "invalid authentication credentials" {
+				t.Errorf("got error %v", got)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		r := request(t, app, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{"email": "alice", "password": ""})
+		r.wantError(t, "email")
+		r.wantError(t, "password")
+	})
+	t.Run("bad request", func(t *testing.T) {
+		request(t, app, http.MethodPost, "/v1/tokens/authentication", "", `{"email": "alice@example.com"} x`).wantStatus(t, http.StatusBadRequest)
+	})
+}
+
+func TestCreatePasswordResetToken(t *testing.T) {
+	app := newTestApplication(t)
+	for _, body := range []string{"", `{"email": true}`, `{"name": "Alice"}`} {
+		request(t, app, http.MethodPost, "/v1/tokens/password-reset", "", body).wantStatus(t, http.StatusBadRequest)
+	}
+	request(t, app, http.MethodPost, "/v1/tokens/password-reset", "", map[string]any{"email": "alice"}).wantError(t, "email")
+
+	// Whether or not there is an activated account with the address, the response is
+	// the same, so that it doesn't give away who has an account.
+	newTestUser(t, app, "alice@example.com", true)
+	newTestUser(t, app, "bob@example.com", false)
+	var messages []any
+	for _, email := range []string{"alice@example.com", "bob@example.com", "nobody@example.com"} {
+		r := request(t, app, http.MethodPost, "/v1/tokens/password-reset", "", map[string]any{"email": email})
+		r.wantStatus(t, http.StatusAccepted)
+		messages = append(messages, r.body["message"])
+	}
+	if messages[0] != messages[1] || messages[0] != messages[2] {
+		t.Errorf("got messages %q, want them to be the same", messages)
+	}
+	// But only the activated user gets an email.
+	deliver(t, app)
+	if delivered, err := app.deliverEmail(context.Background()); delivered || err != nil {
+		t.Errorf("deliverEmail() = %v, %v; want only one email to be queued", delivered, err)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	app := newTestApplication(t)
+	mail := newMailRecorder(app)
+	app.config.tokens.passwordResetTTL = 10 * time.Minute
+	const newPassword = "a new and better password"
+
+	// Register and activate Alice, then sign her in.
+	request(t, app, http.MethodPost, "/v1/users", "", map[string]any{
+		"name": "Alice Smith", "email": "alice@example.com", "password": testPassword,
+	}).wantStatus(t, http.StatusAccepted)
+	deliver(t, app)
+	request(t, app, http.MethodPut, "/v1/users/activated", "", map[string]any{
+		"token": emailToken(t, mail.Messages()[0]),
+	}).wantStatus(t, http.StatusOK)
+	login := func(password string) testResponse {
+		return request(t, app, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{
+			"email": "alice@example.com", "password": password,
+		})
+	}
+	r := login(testPassword)
+	r.wantStatus(t, http.StatusCreated)
+	session := r.body["authenrication_token"].(map[string]any)["token"].(string)
+	request(t, app, http.MethodGet, "/v1/users/me", session, nil).wantStatus(t, http.StatusOK)
+
+	// She forgets her password, and asks for a reset code.
+	before := time.Now()
+	request(t, app, http.MethodPost, "/v1/tokens/password-reset", "", map[string]any{"email": "alice@example.com"}).wantStatus(t, http.StatusAccepted)
+	deliver(t, app)
+	msg := mail.Messages()[1]
+	if msg.To != "alice@example.com" || msg.Subject != "Reset your Greenlight password" {
+		t.Fatalf("got email to %q about %q, want the password reset email", msg.To, msg.Subject)
+	}
+	token := emailToken(t, msg)
+	// The code expires after the configured TTL. The minute may have turned since the
+	// request was made.
+	expiry := func(at time.Time) string { return at.Add(10 * time.Minute).UTC().Format("2006-01-02 15:04 UTC") }
+	if !strings.Contains(msg.PlainBody, expiry(before)) && !strings.Contains(msg.PlainBody, expiry(time.Now())) {
+		t.Errorf("want the reset code to expire in 10 minutes:\n%s", msg.PlainBody)
+	}
+
+	// Asking again replaces the code, so that only the one in the latest email works.
+	request(t, app, http.MethodPost, "/v1/tokens/password-reset", "", map[string]any{"email": "alice@example.com"}).wantStatus(t, http.StatusAccepted)
+	deliver(t, app)
+	stale := token
+	token = emailToken(t, mail.Messages()[2])
+	request(t, app, http.MethodPut, "/v1/users/password", "", map[string]any{
+		"password": newPassword, "token": stale,
+	}).wantError(t, "token")
+
+	t.Run("invalid", func(t *testing.T) {
+		r := request(t, app, http.MethodPut, "/v1/users/password", "", map[string]any{"password": "short", "token": "abc"})
+		r.wantError(t, "password")
+		r.wantError(t, "token")
+		request(t, app, http.MethodPut, "/v1/users/password", "", map[string]any{
+			"password": newPassword, "token": strings.Repeat("A", 26),
+		}).wantError(t, "token")
+	})
+
+	// The code sets her new password.
+	r = request(t, app, http.MethodPut, "/v1/users/password", "", map[string]any{"password": newPassword, "token": token})
+	r.wantStatus(t, http.StatusOK)
+
+	// The devices she was signed in on are signed out, and only the new password works.
+	request(t, app, http.MethodGet, "/v1/users/me", session, nil).wantStatus(t, http.StatusUnauthorized)
+	login(testPassword).wantStatus(t, http.StatusUnauthorized)
+	login(newPassword).wantStatus(t, http.StatusCreated)
+
+	// She is told that her password was changed.
+	deliver(t, app)
+	msg = mail.Messages()[3]
+	if msg.To != "alice@example.com" || msg.Subject != "Your Greenlight password was changed" {
+		t.Fatalf("got email to %q about %q, want the password changed email", msg.To, msg.Subject)
+	}
+
+	// The code can only be used once.
+	request(t, app, http.MethodPut, "/v1/users/password", "", map[string]any{
+		"password": "yet another password", "token": token,
+	}).wantError(t, "token")
+	login(newPassword).wantStatus(t, http.StatusCreated)
+}
+
+// signInPair signs alice@example.com in to a jwt mode app, and returns her access and
+// refresh tokens.
+func signInPair(t *testing.T, app *application) (string, string) {
+	t.Helper()
+	r := request(t, app, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{
+		"email": "alice@example.com", "password": testPassword,
+	})
+	r.wantStatus(t, http.StatusCreated)
+	return tokenPair(t, r)
+}
+
+func tokenPair(t *testing.T, r testResponse) (string, string) {
+	t.Helper()
+	access, _ := r.body["authenrication_token"].(map[string]any)["token"].(string)
+	refresh, _ := r.body["refresh_token"].(map[string]any)["token"].(string)
+	if access == "" || refresh == "" {
+		t.Fatalf("got %v, want an access token and a refresh token", r.body)
+	}
+	return access, refresh
+}
+
+func refresh(t *testing.T, app *application, token string) testResponse {
+	t.Helper()
+	return request(t, app, http.MethodPost, "/v1/tokens/refresh", "", map[string]any{"token": token})
+}
+
+func TestRefreshTokens(t *testing.T) {
+	app := newJWTTestApplication(t)
+	alice, opaque := newTestUser(t, app, "alice@example.com", true, "viewer")
+	access, refreshToken := signInPair(t, app)
+
+	// The access token authenticates Alice, and carries her permissions. Opaque tokens
+	// aren't accepted in jwt mode.
+	request(t, app, http.MethodGet, "/v1/movies", access, nil).wantStatus(t, http.StatusOK)
+	r := request(t, app, http.MethodGet, "/v1/users/me", access, nil)
+	r.wantStatus(t, http.StatusOK)
+	if got := r.body["user"].(map[string]any)["email"]; got != "alice@example.com" {
+		t.Errorf("got email %v, want the full account of Alice", got)
+	}
+	request(t, app, http.MethodGet, "/v1/users/me", opaque, nil).wantStatus(t, http.StatusUnauthorized)
+	request(t, app, http.MethodGet, "/v1/users/me", refreshToken, nil).wantStatus(t, http.StatusUnauthorized)
+
+	// Refreshing swaps the refresh token for a new one, in the same session.
+	r = refresh(t, app, refreshToken)
+	r.wantStatus(t, http.StatusCreated)
+	newAccess, newRefresh := tokenPair(t, r)
+	request(t, app, http.MethodGet, "/v1/movies", newAccess, nil).wantStatus(t, http.StatusOK)
+	r = request(t, app, http.MethodGet, "/v1/users/me/sessions", newAccess, nil)
+	r.wantStatus(t, http.StatusOK)
+	sessions := r.body["sessions"].([]any)
+	if len(sessions) != 1 || sessions[0].(map[string]any)["current"] != true {
+		t.Fatalf("got sessions %v, want the current one only", sessions)
+	}
+
+	// Using the old refresh token again revokes the session, so that the new refresh
+	// token stops working too.
+	refresh(t, app, refreshToken).wantError(t, "token")
+	refresh(t, app, newRefresh).wantError(t, "token")
+	refresh(t, app, "not a token").wantError(t, "token")
+
+	// Signing out revokes the session of the access token.
+	access, refreshToken = signInPair(t, app)
+	request(t, app, http.MethodDelete, "/v1/tokens/authentication", access, nil).wantStatus(t, http.StatusOK)
+	refresh(t, app, refreshToken).wantError(t, "token")
+
+	// Changing the password revokes the refresh tokens too.
+	_, refreshToken = signInPair(t, app)
+	reset, err := app.models.Tokens.New(context.Background(), alice.ID, time.Hour, data.ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request(t, app, http.MethodPut, "/v1/users/password", "", map[string]any{
+		"password": "a new password", "token": reset.Plaintext,
+	}).wantStatus(t, http.StatusOK)
+	refresh(t, app, refreshToken).wantError(t, "token")
+}
+
+func TestRefreshTokensOpaqueMode(t *testing.T) {
+	app := newTestApplication(t)
+	newTestUser(t, app, "alice@example.com", true)
+	r := request(t, app, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{
+		"email": "alice@example.com", "password": testPassword,
+	})
+	r.wantStatus(t, http.StatusCreated)
+	if _, ok := r.body["refresh_token"]; ok {
+		t.Errorf("got a refresh token in opaque mode")
+	}
+	refresh(t, app, "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU").wantStatus(t, http.StatusNotFound)
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"forum/internal/data"
+	"forum/internal/mailer"
 	"forum/internal/validator"
 )
 
@@ -16,6 +18,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Name     string `json:"name"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Locale   string `json:"locale"`
 	}
 	err := app.readJson(w, r, &input)
 	if err != nil {
@@ -30,6 +33,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Name:      input.Name,
 		Email:     input.Email,
 		Activated: false,
+		Locale:    input.Locale,
 	}
 	// Use the Password.Set() method to generate and store the hashed and plaintext
 	// passwords.
@@ -41,12 +45,41 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	v := validator.New()
 	// Validate the user struct and return the error messages to the client if any of
 	// the checks fail.
-	if data.ValidateUser(v, &user); !v.Valid() {
+	data.ValidateUser(v, &user)
+	if data.ValidateLocale(v, user.Locale, app.mailer.Templates().Locales()); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	// Insert the user data into the database
-	err = app.models.Users.Insert(&user)
+	// Insert the user data into the database, give them the "viewer" role, which lets
+	// them read movies, generate an activation token for them and queue the welcome
+	// email with the token. These happen in a single unit of work, so that a failure
+	// part way through doesn't leave behind a user without a role or a way to
+	// activate their account.
+	var token *data.Token
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Insert(r.Context(), &user)
+		if err != nil {
+			return err
+		}
+		err = tx.Roles.AddForUser(r.Context(), user.ID, "viewer")
+		if err != nil {
+			return err
+		}
+		token, err = tx.Tokens.New(r.Context(), user.ID, activationTokenTTL, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+		// As there are multiple pieces of data that we want to pass to our email
+		// templates, we create a map to act as a 'holding structure' for the data. This
+		// contains the plaintext version of the activation token for the user and its
+		// expiry, along with their name and ID.
+		return app.queueEmail(r.Context(), tx, &user, app.emailLocale(r, &user), "welcome", map[string]any{
+			"activationToken": token.Plaintext,
+			"expiry":          token.Expiry,
+			"name":            user.Name,
+			"userID":          user.ID,
+		})
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -57,41 +90,10 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-	// Add the "movies:read" permission for the new user
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-	// After the yser records has been created in the database,generate a new activation
-	// token for the user.
-	token, err := app.models.Tokens.New(user.ID, 12*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-	fmt.Println(token.Plaintext)
-	// As we mentioned briefly in the last chapter, sending the welcome email from the
-	// registerUserHandler method adds quite a lot of latency to the total request/response
-	// round-trip for the client.
-	// One way we could reduce this latency is by sending the email in a background goroutine.
-	// This would effectively ‘decouple’ the task of sending an email from the rest of the code in
-	// our registerUseHandler, and means that we could return a HTTP response to the client
-	// without waiting for the email sending to complete
-	app.background(func() {
-		// As there are now multiple pieces of data that we want to pass to our email
-		// templates, we create a map to act as a 'holding structure' for the data. This
-		// contains the plaintext version of the activation token for the user, along
-		// with their ID
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
-	})
+	// Sending the welcome email from the handler would add quite a lot of latency to
+	// the request, and the email would be lost if the SMTP server was down. Instead an
+	// outbox worker sends it in the background, retrying if it has to.
+	app.outbox.wake()
 	// Note that we also change this to send the client a 202 Accepted status code.
 	// This status code indicates that the request has been accepted for processing, but
 	// the processing has not been completed.
@@ -117,24 +119,102 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	// Retrieve the details of the user associated with the token using the
-	// GetForToken() method (which we will create in a minute). If no matching record
-	// is found, then we let the client know that the token they provided is not valid.
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlainText)
+	// Retrieve the details of the user associated with the token, activate them and
+	// delete all of their activation tokens, as one unit of work so that an activated
+	// user is never left with live activation tokens. If no matching record is found,
+	// then we let the client know that the token they provided is not valid.
+	var user *data.User
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		var err error
+		user, err = tx.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlainText)
+		if err != nil {
+			return err
+		}
+		user.Activated = true
+		err = tx.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+		return tx.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.ID)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddError("token", "invalid or expired activtion token")
 			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	user.Activated = true
-	err = app.models.Users.Update(user)
+	// Send the updated user details to the client in a json response
+	err = app.writeJson(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateUserPasswordHandler sets a new password for the user a password reset token
+// was sent to. The token can only be used once, and every device the user was signed in
+// on is signed out, in case the reset is because someone else knew the old password.
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlainText(v, input.TokenPlaintext)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Hash the new password before starting the unit of work below, as bcrypt is slow
+	// and the transaction should be kept short.
+	var changed data.User
+	err = changed.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Retrieve the details of the user associated with the password reset token, set
+	// the new password, delete all of their password reset and authentication tokens
+	// and queue the email telling them their password was changed, as one unit of work.
+	// Saving the user checks for edit conflicts as normal, and an error message is
+	// returned if no matching record was found for the token.
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		user, err := tx.Users.GetForToken(r.Context(), data.ScopePasswordReset, input.TokenPlaintext)
+		if err != nil {
+			return err
+		}
+		user.Password = changed.Password
+		err = tx.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+		for _, scope := range []string{data.ScopePasswordReset, data.ScopeAuthentication, data.ScopeRefresh} {
+			err = tx.Tokens.DeleteAllForUser(r.Context(), scope, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return app.queueEmail(r.Context(), tx, user, app.emailLocale(r, user), "password-changed", map[string]any{
+			"changedAt": time.Now(),
+			"name":      user.Name,
+		})
+	})
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -142,59 +222,242 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-	// If everything went succesfully, then we delete all activation tokens for the
-	// user
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	app.outbox.wake()
+	// Send the user a confirmation message.
+	env := envelope{"message": "your password was successfully reset"}
+	err = app.writeJson(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The currentUser() helper returns the full account of the authenticated user. The
+// user authenticate() finds for an access token only has what the token carries, so
+// in that case it is looked up. If it is gone, the token is treated as invalid.
+func (app *application) currentUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	user := app.contextGetUser(r)
+	if !app.contextGetToken(r).signed {
+		return user, true
+	}
+	user, err := app.models.Users.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// The showCurrentUserHandler returns the account of the authenticated user.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.currentUser(w, r)
+	if !ok {
 		return
 	}
-	// Send the updated user details to the client in a json response
-	err = app.writeJson(w, http.StatusOK, envelope{"user": user}, nil)
+	err := app.writeJson(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+// The updateCurrentUserHandler changes the name, email address and locale of the
+// authenticated user. A new email address doesn't replace the current one straight
+// away: it is kept as the pending email until the user confirms it with the token we
+// send there, so that a typo can't lock them out of their account.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
 	var input struct {
-		password string `json:"password"`
-		token    string `json:"token"`
+		Name   *string `json:"name"`
+		Email  *string `json:"email"`
+		Locale *string `json:"locale"`
 	}
 	err := app.readJson(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Locale != nil {
+		user.Locale = *input.Locale
+	}
 	v := validator.New()
-	data.ValidatePasswordPlaintext(v, input.password)
-	data.ValidateTokenPlainText(v, input.token)
-	if v.Valid() {
+	// Asking for the current address again cancels a pending change, and asking for
+	// the pending address again sends a new confirmation token.
+	if input.Email != nil {
+		user.PendingEmail = ""
+		if *input.Email != user.Email {
+			data.ValidateEmail(v, *input.Email)
+			user.PendingEmail = *input.Email
+		}
+	}
+	data.ValidateUser(v, user)
+	if data.ValidateLocale(v, user.Locale, app.mailer.Templates().Locales()); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	// Retrieve the details of the user associated with the password reset token,
-	// returning an error message if no matching record was found.
-	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.token)
+	// Save the user, and if their email is changing, replace any confirmation token
+	// sent for an earlier change and queue the email with the new one, sent to the new
+	// address. Saving the user fails with an edit conflict if their account was changed
+	// since this request authenticated them.
+	changingEmail := input.Email != nil && user.PendingEmail != ""
+	// The unit of work may run more than once, so it saves a copy of the user each
+	// time, which starts out at the version the user was read at.
+	var updated data.User
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		updated = *user
+		if changingEmail {
+			_, err := tx.Users.GetByEmail(r.Context(), user.PendingEmail)
+			if err == nil {
+				return data.ErrDuplicateEmail
+			}
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				return err
+			}
+		}
+		err := tx.Users.Update(r.Context(), &updated)
+		if err != nil {
+			return err
+		}
+		if input.Email == nil {
+			return nil
+		}
+		err = tx.Tokens.DeleteAllForUser(r.Context(), data.ScopeEmailChange, user.ID)
+		if err != nil || !changingEmail {
+			return err
+		}
+		token, err := tx.Tokens.New(r.Context(), user.ID, emailChangeTokenTTL, data.ScopeEmailChange)
+		if err != nil {
+			return err
+		}
+		recipient := updated
+		recipient.Email = updated.PendingEmail
+		return app.queueEmail(r.Context(), tx, &recipient, app.emailLocale(r, &updated), "email-change-confirmation", map[string]any{
+			"emailChangeToken": token.Plaintext,
+			"expiry":           token.Expiry,
+			"name":             user.Name,
+			"newEmail":         user.PendingEmail,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if changingEmail {
+		app.outbox.wake()
+	}
+	err = app.writeJson(w, http.StatusOK, envelope{"user": updated}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The confirmEmailHandler replaces the email address of a user with their pending
+// email, given the token we sent to the pending address. As the token proves that the
+// address belongs to the user, it also activates a user who hadn't activated their
+// account yet, like one who mistyped their address when they signed up.
+func (app *application) confirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlainText string `json:"token"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlainText(v, input.TokenPlainText); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	var user *data.User
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		var err error
+		user, err = tx.Users.GetForToken(r.Context(), data.ScopeEmailChange, input.TokenPlainText)
+		if err != nil {
+			return err
+		}
+		// The change may have been cancelled since the token was sent.
+		if user.PendingEmail == "" {
+			return data.ErrRecordNotFound
+		}
+		user.Email = user.PendingEmail
+		user.PendingEmail = ""
+		user.Activated = true
+		err = tx.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+		return tx.Tokens.DeleteAllForUser(r.Context(), data.ScopeEmailChange, user.ID)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired password reset token")
+			v.AddError("token", "invalid or expired email confirmation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
 			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	// Set the new password for the user.
-	err = user.Password.Set(input.password)
+	err = app.writeJson(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteCurrentUserHandler deletes the account of the authenticated user, once
+// they have confirmed it with their password so that a stolen token isn't enough.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.currentUser(w, r)
+	if !ok {
 		return
 	}
-	// Save the updated user record in our database, checking for any edit conflicts as
-	// normal.
-	err = app.models.Users.Update(user)
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	// Deleting the user deletes their tokens, roles and permissions along with them.
+	err = app.models.Users.Delete(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -204,16 +467,94 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		}
 		return
 	}
-	// If everything was successful, then delete all password reset tokens for the user.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "your account was successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showEmailOptOutsHandler returns the categories of email the current user has
+// opted out of, along with the categories they can opt out of.
+func (app *application) showEmailOptOutsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	optOuts, err := app.models.OptOuts.GetAllForUser(r.Context(), user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Send the user a confirmation message.
-	env := envelope{"message": "your password was successfully reset"}
-	err = app.writeJson(w, http.StatusOK, env, nil)
+	app.writeEmailOptOuts(w, r, optOuts)
+}
+
+// The updateEmailOptOutsHandler replaces the categories of email the current user has
+// opted out of with those in the request body. Transactional emails, like the password
+// reset emails, can't be opted out of.
+func (app *application) updateEmailOptOutsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	var input struct {
+		OptOuts []string `json:"opt_outs"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.OptOuts != nil, "opt_outs", "must be provided")
+	v.Check(validator.Unique(input.OptOuts), "opt_outs", "must not contain duplicate values")
+	for _, category := range input.OptOuts {
+		v.Check(validator.PermittedValue(category, optionalEmailCategories()...), "opt_outs", "must only contain "+strings.Join(optionalEmailCategories(), ", "))
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Opt in to the categories which are no longer listed and out of the new ones, as
+	// one unit of work so that a failure doesn't leave half of the change behind.
+	var optOuts []string
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		current, err := tx.OptOuts.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		var optIns []string
+		for _, category := range current {
+			if !slices.Contains(input.OptOuts, category) {
+				optIns = append(optIns, category)
+			}
+		}
+		err = tx.OptOuts.RemoveForUser(r.Context(), user.ID, optIns...)
+		if err != nil {
+			return err
+		}
+		err = tx.OptOuts.AddForUser(r.Context(), user.ID, input.OptOuts...)
+		if err != nil {
+			return err
+		}
+		optOuts, err = tx.OptOuts.GetAllForUser(r.Context(), user.ID)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeEmailOptOuts(w, r, optOuts)
+}
+
+func (app *application) writeEmailOptOuts(w http.ResponseWriter, r *http.Request, optOuts []string) {
+	env := envelope{"email_opt_outs": envelope{
+		"opted_out":  optOuts,
+		"categories": optionalEmailCategories(),
+	}}
+	err := app.writeJson(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// optionalEmailCategories returns the categories of email users can opt out of, which
+// is all of them but the transactional one.
+func optionalEmailCategories() []string {
+	return slices.DeleteFunc(slices.Clone(mailer.Categories), func(category string) bool {
+		return category == mailer.CategoryTransactional
+	})
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"forum/internal/data"
+	"forum/internal/mailer"
+)
+
+// conflictingUsers is a UserRepository whose updates always lose the race against a
+// concurrent edit.
+type conflictingUsers struct {
+	data.UserRepository
+}
+
+func (conflictingUsers) Update(ctx context.Context, user *data.User) error {
+	return data.ErrEditConflict
+}
+
+// failingTokens is a TokenRepository which can't create tokens.
+type failingTokens struct {
+	data.TokenRepository
+}
+
+func (failingTokens) New(ctx context.Context, userID int, ttl time.Duration, scope string) (*data.Token, error) {
+	return nil, errors.New("disk full")
+}
+
+func TestRegisterUser(t *testing.T) {
+	app := newTestApplication(t)
+
+	t.Run("registered", func(t *testing.T) {
+		r := request(t, app, http.MethodPost, "/v1/users", "", map[string]any{
+			"name": "Alice Smith", "email": "alice@example.com", "password": testPassword,
+		})
+		r.wantStatus(t, http.StatusAccepted)
+		user := r.body["user"].(map[string]any)
+		if user["email"] != "alice@example.com" || user["activated"] != false {
+			t.Errorf("got user %v", user)
+		}
+		if _, ok := user["password"]; ok {
+			t.Error("the response includes the password")
+		}
+		// New users can read movies once they have activated their account.
+		roles, err := app.models.Roles.GetAllForUser(context.Background(), int(user["id"].(float64)))
+		if err != nil || len(roles) != 1 || roles[0] != "viewer" {
+			t.Errorf("got roles %v, %v", roles, err)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		body  map[string]any
+		field string
+	}{
+		{"duplicate email", map[string]any{"name": "Alice", "email": "alice@example.com", "password": testPassword}, "email"},
+		{"invalid email", map[string]any{"name": "Bob", "email": "bob", "password": testPassword}, "email"},
+		{"missing name", map[string]any{"email": "bob@example.com", "password": testPassword}, "name"},
+		{"short password", map[string]any{"name": "Bob", "email": "bob@example.com", "password": "pa55"}, "password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request(t, app, http.MethodPost, "/v1/users", "", tt.body).wantError(t, tt.field)
+		})
+	}
+
+	t.Run("bad request", func(t *testing.T) {
+		request(t, app, http.MethodPost, "/v1/users", "", `{"name": "Bob", "admin": true}`).wantStatus(t, http.StatusBadRequest)
+	})
+
+	// A user whose activation token couldn't be created isn't left behind.
+	t.Run("rolled back", func(t *testing.T) {
+		tokens := app.models.Tokens
+		app.models.Tokens = failingTokens{tokens}
+		defer func() { app.models.Tokens = tokens }()
+		request(t, app, http.MethodPost, "/v1/users", "", map[string]any{
+			"name": "Bob", "email": "bob@example.com", "password": testPassword,
+		}).wantStatus(t, http.StatusInternalServerError)
+		if _, err := app.models.Users.GetByEmail(context.Background(), "bob@example.com"); !errors.Is(err, data.ErrRecordNotFound) {
+			t.Errorf("got %v, want the user to be gone", err)
+		}
+	})
+}
+
+func TestActivateUser(t *testing.T) {
+	app := newTestApplication(t)
+	user, _ := newTestUser(t, app, "alice@example.com", false)
+	token, err := app.models.Tokens.New(context.Background(), user.ID, time.Hour, data.ScopeActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := app.models.Tokens.New(context.Background(), user.ID, -time.Minute, data.ScopeActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("expired token", func(t *testing.T) {
+		request(t, app, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": expired.Plaintext}).wantError(t, "token")
+	})
+	t.Run("malformed token", func(t *testing.T) {
+		request(t, app, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": "abc"}).wantError(t, "token")
+	})
+	t.Run("bad request", func(t *testing.T) {
+		request(t, app, http.MethodPut, "/v1/users/activated", "", `{"token": 1}`).wantStatus(t, http.StatusBadRequest)
+	})
+	t.Run("edit conflict", func(t *testing.T) {
+		users := app.models.Users
+		app.models.Users = conflictingUsers{users}
+		defer func() { app.models.Users = users }()
+		request(t, app, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": token.Plaintext}).wantStatus(t, http.StatusConflict)
+	})
+	t.Run("activated", func(t *testing.T) {
+		r := request(t, app, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": token.Plaintext})
+		r.wantStatus(t, http.StatusOK)
+		if got := r.body["user"].(map[string]any)["activated"]; got != true {
+			t.Errorf("got activated %v", got)
+		}
+	})
+	t.Run("token used up", func(t *testing.T) {
+		request(t, app, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": token.Plaintext}).wantError(t, "token")
+	})
+}
+
+func TestUpdateUserPassword(t *testing.T) {
+	app := newTestApplication(t)
+	for _, body := range []string{"", `{"password": `, `["password"]`} {
+		request(t, app, http.MethodPut, "/v1/users/password", "", body).wantStatus(t, http.StatusBadRequest)
+	}
+}
+
+func TestActivationEmail(t *testing.T) {
+	app := newTestApplication(t)
+	mail := newMailRecorder(app)
+	r := request(t, app, http.MethodPost, "/v1/users", "", map[string]any{
+		"name": "Alice Smith", "email": "alice@example.com", "password": testPassword,
+	})
+	r.wantStatus(t, http.StatusAccepted)
+	if delivered, err := app.deliverEmail(context.Background()); !delivered || err != nil {
+		t.Fatalf("deliverEmail() = %v, %v", delivered, err)
+	}
+
+	messages := mail.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("got %d emails, want the welcome email", len(messages))
+	}
+	msg := messages[0]
+	if msg.To != "alice@example.com" || msg.From != testSender || msg.Subject != "Welcome to Greenlight!" {
+		t.Errorf("got email to %q from %q about %q", msg.To, msg.From, msg.Subject)
+	}
+	id := fmt.Sprintf("your user ID number is %v.", r.body["user"].(map[string]any)["id"])
+	if !strings.Contains(msg.PlainBody, id) || !strings.Contains(msg.HTMLBody, id) {
+		t.Errorf("the email doesn't contain %q", id)
+	}
+	// The token in the email activates the account.
+	r = request(t, app, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": emailToken(t, msg)})
+	r.wantStatus(t, http.StatusOK)
+	if got := r.body["user"].(map[string]any)["activated"]; got != true {
+		t.Errorf("got activated %v", got)
+	}
+}
+
+// emailToken returns the token in an email, which is on a line of its own.
+func emailToken(t *testing.T, msg mailer.Message) string {
+	t.Helper()
+	match := regexp.MustCompile(`(?m)^\s+([A-Z2-7]{26})$`).FindStringSubmatch(msg.PlainBody)
+	if match == nil {
+		t.Fatalf("no token in the email:\n%s", msg.PlainBody)
+	}
+	return match[1]
+}
+
+func TestEmailLocale(t *testing.T) {
+	app := newTestApplication(t)
+	mail := newMailRecorder(app)
+	register := func(email, locale, acceptLanguage string) testResponse {
+		body := map[string]any{"name": "Alice Smith", "email": email, "password": testPassword, "locale": locale}
+		return requestWithHeader(t, app, http.MethodPost, "/v1/users", "", body, http.Header{"Accept-Language": {acceptLanguage}})
+	}
+
+	// Without a locale of their own, users get their emails in the language of their
+	// browser, or in English if we don't speak it.
+	register("fr@example.com", "", "fr-CH, fr;q=0.9, en;q=0.8").wantStatus(t, http.StatusAccepted)
+	register("de@example.com", "", "de").wantStatus(t, http.StatusAccepted)
+	// A locale of their own wins over the header.
+	r := register("chosen@example.com", "fr", "en")
+	r.wantStatus(t, http.StatusAccepted)
+	if got := r.body["user"].(map[string]any)["locale"]; got != "fr" {
+		t.Errorf("got locale %v, want fr", got)
+	}
+	register("klingon@example.com", "tlh", "").wantError(t, "locale")
+
+	for range 3 {
+		deliver(t, app)
+	}
+	subjects := map[string]string{}
+	for _, msg := range mail.Messages() {
+		subjects[msg.To] = msg.Subject
+	}
+	want := map[string]string{
+		"fr@example.com":     "Bienvenue sur Greenlight !",
+		"de@example.com":     "Welcome to Greenlight!",
+		"chosen@example.com": "Bienvenue sur Greenlight !",
+	}
+	if !maps.Equal(subjects, want) {
+		t.Errorf("got subjects %v, want %v", subjects, want)
+	}
+}
+
+func TestEmailOptOuts(t *testing.T) {
+	app := newTestApplication(t)
+	user, token := newTestUser(t, app, "alice@example.com", true, "viewer")
+
+	r := request(t, app, http.MethodGet, "/v1/users/me/email-opt-outs", token, nil)
+	r.wantStatus(t, http.StatusOK)
+	if got := r.body["email_opt_outs"].(map[string]any)["opted_out"].([]any); len(got) != 0 {
+		t.Fatalf("got opt-outs %v for a new user", got)
+	}
+	request(t, app, http.MethodPut, "/v1/users/me/email-opt-outs", token, map[string]any{"opt_outs": []string{"transactional"}}).wantError(t, "opt_outs")
+	request(t, app, http.MethodPut, "/v1/users/me/email-opt-outs", "", map[string]any{"opt_outs": []string{}}).wantStatus(t, http.StatusUnauthorized)
+	r = request(t, app, http.MethodPut, "/v1/users/me/email-opt-outs", token, map[string]any{"opt_outs": []string{"announcements"}})
+	r.wantStatus(t, http.StatusOK)
+	if got := r.body["email_opt_outs"].(map[string]any)["opted_out"].([]any); len(got) != 1 || got[0] != "announcements" {
+		t.Fatalf("got opt-outs %v, want announcements", got)
+	}
+
+	// Announcements are no longer queued for the user, but transactional emails are.
+	templates, err := mailer.ParseTemplates(fstest.MapFS{
+		"en/news.tmpl":    {Data: []byte(`{{define "category"}}announcements{{end}}{{define "subject"}}News{{end}}{{define "plainBody"}}News{{end}}{{define "htmlBody"}}News{{end}}`)},
+		"en/welcome.tmpl": {Data: []byte(`{{define "subject"}}Hi{{end}}{{define "plainBody"}}Hi{{end}}{{define "htmlBody"}}Hi{{end}}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := mailer.NewRecorder()
+	app.mailer = mailer.New(recorder, testSender, templates)
+	ctx := context.Background()
+	for _, name := range []string{"news", "welcome"} {
+		if err := app.queueEmail(ctx, app.models, user, mailer.DefaultLocale, name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	emails, _, err := app.models.Emails.GetAll(ctx, "", data.Filters{Page: 1, PageSize: 10, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].Template != "welcome" {
+		t.Fatalf("got emails %v, want only the welcome email", emails)
+	}
+
+	// Opting back in is a matter of leaving the category out.
+	request(t, app, http.MethodPut, "/v1/users/me/email-opt-outs", token, map[string]any{"opt_outs": []string{}}).wantStatus(t, http.StatusOK)
+	if err := app.queueEmail(ctx, app.models, user, mailer.DefaultLocale, "news", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, meta, _ := app.models.Emails.GetAll(ctx, "", data.Filters{Page: 1, PageSize: 10, Sort: "id", SortSafelist: []string{"id"}}); meta.TotalRecords != 2 {
+		t.Errorf("got %d emails, want the announcement to be queued", meta.TotalRecords)
+	}
+}
+
+func TestResendActivationToken(t *testing.T) {
+	app := newTestApplication(t)
+	mail := newMailRecorder(app)
+	request(t, app, http.MethodPost, "/v1/users", "", map[string]any{
+		"name": "Alice Smith", "email": "alice@example.com", "password": testPassword,
+	}).wantStatus(t, http.StatusAccepted)
+	deliver(t, app)
+	welcomeToken := emailToken(t, mail.Messages()[0])
+
+	request(t, app, http.MethodPost, "/v1/tokens/activation", "", map[string]any{"email": "alice"}).wantError(t, "email")
+	// An unknown address gets the same response as Alice's, but no email.
+	unknown := request(t, app, http.MethodPost, "/v1/tokens/activation", "", map[string]any{"email": "bob@example.com"})
+	unknown.wantStatus(t, http.StatusAccepted)
+	r := request(t, app, http.MethodPost, "/v1/tokens/activation", "", map[string]any{"email": "alice@example.com"})
+	r.wantStatus(t, http.StatusAccepted)
+	if unknown.body["message"] != r.body["message"] {
+		t.Errorf("got message %q for an unknown address and %q for Alice", unknown.body["message"], r.body["message"])
+	}
+	deliver(t, app)
+	if delivered, err := app.deliverEmail(context.Background()); delivered || err != nil {
+		t.Fatalf("deliverEmail() = %v, %v; want only Alice's email to be queued", delivered, err)
+	}
+	msg := mail.Messages()[1]
+	if msg.To != "alice@example.com" || msg.Subject != "Your new Greenlight activation code" {
+		t.Fatalf("got email to %q about %q", msg.To, msg.Subject)
+	}
+
+	// Only the new token activates the account.
+	request(t, app, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": welcomeToken}).wantError(t, "token")
+	request(t, app, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": emailToken(t, msg)}).wantStatus(t, http.StatusOK)
+
+	// Once she is activated, Alice gets no more activation emails.
+	request(t, app, http.MethodPost, "/v1/tokens/activation", "", map[string]any{"email": "alice@example.com"}).wantStatus(t, http.StatusAccepted)
+	if delivered, err := app.deliverEmail(context.Background()); delivered || err != nil {
+		t.Errorf("deliverEmail() = %v, %v; want no email for an activated user", delivered, err)
+	}
+}
+
+func TestCurrentUser(t *testing.T) {
+	app := newTestApplication(t)
+	mail := newMailRecorder(app)
+	_, token := newTestUser(t, app, "alice@example.com", true)
+	newTestUser(t, app, "bob@example.com", true)
+
+	request(t, app, http.MethodGet, "/v1/users/me", "", nil).wantStatus(t, http.StatusUnauthorized)
+	r := request(t, app, http.MethodGet, "/v1/users/me", token, nil)
+	r.wantStatus(t, http.StatusOK)
+	if got := r.body["user"].(map[string]any)["email"]; got != "alice@example.com" {
+		t.Fatalf("got email %v", got)
+	}
+
+	r = request(t, app, http.MethodPatch, "/v1/users/me", token, map[string]any{"name": "Alice", "locale": "fr"})
+	r.wantStatus(t, http.StatusOK)
+	if user := r.body["user"].(map[string]any); user["name"] != "Alice" || user["locale"] != "fr" {
+		t.Fatalf("got user %v", user)
+	}
+	request(t, app, http.MethodPatch, "/v1/users/me", token, map[string]any{"name": ""}).wantError(t, "name")
+	request(t, app, http.MethodPatch, "/v1/users/me", token, map[string]any{"locale": "xx"}).wantError(t, "locale")
+	request(t, app, http.MethodPatch, "/v1/users/me", token, map[string]any{"email": "bob@example.com"}).wantError(t, "email")
+	request(t, app, http.MethodPatch, "/v1/users/me", token, map[string]any{"email": "alice"}).wantError(t, "email")
+
+	t.Run("edit conflict", func(t *testing.T) {
+		users := app.models.Users
+		app.models.Users = conflictingUsers{users}
+		defer func() { app.models.Users = users }()
+		request(t, app, http.MethodPatch, "/v1/users/me", token, map[string]any{"name": "Stale"}).wantStatus(t, http.StatusConflict)
+	})
+
+	// A new email address only replaces the current one once it is confirmed with the
+	// token sent there, in the language of the user.
+	r = request(t, app, http.MethodPatch, "/v1/users/me", token, map[string]any{"email": "alice@example.org"})
+	r.wantStatus(t, http.StatusOK)
+	if user := r.body["user"].(map[string]any); user["email"] != "alice@example.com" || user["pending_email"] != "alice@example.org" {
+		t.Fatalf("got user %v", user)
+	}
+	deliver(t, app)
+	msg := mail.Messages()[0]
+	if msg.To != "alice@example.org" || msg.Subject != "Confirmez votre nouvelle adresse e-mail Greenlight" {
+		t.Fatalf("got email to %q about %q", msg.To, msg.Subject)
+	}
+	// Renaming the user leaves the pending change alone.
+	request(t, app, http.MethodPatch, "/v1/users/me", token, map[string]any{"name": "Alice Smith"}).wantStatus(t, http.StatusOK)
+	request(t, app, http.MethodPut, "/v1/users/email", "", map[string]any{"token": "ABCDEFGHIJKLMNOPQRSTUVWXYZ"}).wantError(t, "token")
+	r = request(t, app, http.MethodPut, "/v1/users/email", "", map[string]any{"token": emailToken(t, msg)})
+	r.wantStatus(t, http.StatusOK)
+	if user := r.body["user"].(map[string]any); user["email"] != "alice@example.org" || user["pending_email"] != nil {
+		t.Fatalf("got user %v", user)
+	}
+	request(t, app, http.MethodPut, "/v1/users/email", "", map[string]any{"token": emailToken(t, msg)}).wantError(t, "token")
+
+	// Asking for the current address again cancels a pending change, and its token
+	// no longer works.
+	request(t, app, http.MethodPatch, "/v1/users/me", token, map[string]any{"email": "alice@example.net"}).wantStatus(t, http.StatusOK)
+	r = request(t, app, http.MethodPatch, "/v1/users/me", token, map[string]any{"email": "alice@example.org"})
+	r.wantStatus(t, http.StatusOK)
+	if got := r.body["user"].(map[string]any)["pending_email"]; got != nil {
+		t.Fatalf("got pending email %v after cancelling the change", got)
+	}
+	deliver(t, app)
+	request(t, app, http.MethodPut, "/v1/users/email", "", map[string]any{"token": emailToken(t, mail.Messages()[1])}).wantError(t, "token")
+}
+
+func TestDeleteCurrentUser(t *testing.T) {
+	app := newTestApplication(t)
+	user, token := newTestUser(t, app, "alice@example.com", true, "viewer")
+
+	request(t, app, http.MethodDelete, "/v1/users/me", "", map[string]any{"password": testPassword}).wantStatus(t, http.StatusUnauthorized)
+	request(t, app, http.MethodDelete, "/v1/users/me", token, map[string]any{}).wantError(t, "password")
+	request(t, app, http.MethodDelete, "/v1/users/me", token, map[string]any{"password": "wrong password"}).wantStatus(t, http.StatusUnauthorized)
+	request(t, app, http.MethodDelete, "/v1/users/me", token, map[string]any{"password": testPassword}).wantStatus(t, http.StatusOK)
+
+	if _, err := app.models.Users.Get(context.Background(), user.ID); !errors.Is(err, data.ErrRecordNotFound) {
+		t.Fatalf("got %v, want the user to be gone", err)
+	}
+	// The tokens of the user went with them.
+	request(t, app, http.MethodGet, "/v1/users/me", token, nil).wantStatus(t, http.StatusUnauthorized)
+	// The address is free to sign up with again.
+	request(t, app, http.MethodPost, "/v1/users", "", map[string]any{
+		"name": "Alice Smith", "email": "alice@example.com", "password": testPassword,
+	}).wantStatus(t, http.StatusAccepted)
+}
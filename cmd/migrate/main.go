@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"forum/internal/data"
+	migratedb "forum/migrateDB"
+)
+
+const usage = `Usage: migrate [flags] <command> [arguments]
+
+Commands:
+  up             apply all pending migrations
+  down N         roll back the N most recently applied migrations
+  goto V         migrate up or down to version V
+  status         list migrations and whether they are applied
+  force V        record version V as current without running any migration
+  create NAME    create a new pair of up/down migration files
+
+Flags:
+`
+
+func main() {
+	var dsn string
+	flag.StringVar(&dsn, "db-dsn", "./migrateDB/test.db", "Database DSN: a SQLite file path or a postgres:// URL")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(dsn, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dsn, command string, args []string) error {
+	// Creating migration files only touches the source tree, so handle it before
+	// opening the database.
+	if command == "create" {
+		if len(args) != 1 {
+			return errors.New("create requires a migration name")
+		}
+		paths, err := migratedb.Create(migratedb.Dir, args[0])
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			fmt.Println("created", path)
+		}
+		return nil
+	}
+
+	db, err := data.Open(dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = db.CheckFTS5(context.Background())
+	if err != nil {
+		return err
+	}
+	migrator, err := migratedb.New(db.Pool(), db.Dialect.String())
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		err = migrator.Up()
+	case "down":
+		var n int
+		if n, err = intArg(args, "down"); err == nil {
+			err = migrator.Down(n)
+		}
+	case "goto":
+		var v int
+		if v, err = intArg(args, "goto"); err == nil {
+			err = migrator.Goto(v)
+		}
+	case "force":
+		var v int
+		if v, err = intArg(args, "force"); err == nil {
+			err = migrator.Force(v)
+		}
+	case "status":
+		return printStatus(migrator)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+	switch {
+	case errors.Is(err, migratedb.ErrNoChange):
+		fmt.Println("no change")
+	case err != nil:
+		return err
+	}
+	version, err := migrator.Version()
+	if err != nil {
+		return err
+	}
+	fmt.Println("current version:", version)
+	return nil
+}
+
+func intArg(args []string, command string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("%s requires exactly one numeric argument", command)
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid number %q", command, args[0])
+	}
+	return n, nil
+}
+
+func printStatus(migrator *migratedb.Migrator) error {
+	statuses, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, s := range statuses {
+		status, appliedAt := "pending", ""
+		if s.Applied {
+			status, appliedAt = "applied", s.AppliedAt.Format("2006-01-02 15:04:05")
+			if s.Modified {
+				status = "modified"
+			}
+		}
+		fmt.Fprintf(tw, "%06d\t%s\t%s\t%s\n", s.Version, s.Name, status, appliedAt)
+	}
+	return tw.Flush()
+}
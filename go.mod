@@ -1,12 +1,16 @@
 module forum
 
-go 1.20
+go 1.22
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/felixge/httpsnoop v1.0.2
 	github.com/go-mail/mail/v2 v2.3.0
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.16
 	golang.org/x/crypto v0.9.0
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
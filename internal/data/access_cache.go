@@ -0,0 +1,123 @@
+package data
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Access holds the roles of a user and the permissions they hold, both directly and
+// through those roles.
+type Access struct {
+	Roles       []string
+	Permissions Permissions
+}
+
+// AccessCache keeps the Access of recently seen users in memory, so that protected
+// endpoints don't have to query the roles and permissions tables on every request.
+// Entries expire after the TTL and are also invalidated explicitly whenever the roles
+// or permissions of a user change. Each entry records the Version of the user it was
+// loaded for, so that any update to the user record misses the cache as well. A nil
+// *AccessCache is valid and caches nothing.
+type AccessCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[int]accessCacheEntry
+	swept   time.Time
+
+	hits          atomic.Int64
+	misses        atomic.Int64
+	invalidations atomic.Int64
+}
+
+type accessCacheEntry struct {
+	access  Access
+	version int
+	expires time.Time
+}
+
+// AccessCacheStats is a snapshot of the cache counters, for publishing with expvar.
+type AccessCacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Invalidations int64 `json:"invalidations"`
+	Entries       int   `json:"entries"`
+}
+
+// NewAccessCache returns a cache whose entries live for ttl. A ttl of zero or less
+// disables the cache and NewAccessCache returns nil.
+func NewAccessCache(ttl time.Duration) *AccessCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &AccessCache{ttl: ttl, entries: make(map[int]accessCacheEntry)}
+}
+
+// get returns the cached Access for a user, provided that it was stored for the same
+// version of the user and hasn't expired yet.
+func (c *AccessCache) get(userID, version int) (Access, bool) {
+	if c == nil {
+		return Access{}, false
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[userID]
+	if ok && (entry.version != version || time.Now().After(entry.expires)) {
+		delete(c.entries, userID)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return Access{}, false
+	}
+	c.hits.Add(1)
+	return entry.access, true
+}
+
+func (c *AccessCache) set(userID, version int, access Access) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Once per TTL, take the chance to drop the expired entries of users who haven't
+	// come back, so that the map doesn't keep growing with every user who ever made a
+	// request.
+	now := time.Now()
+	if now.Sub(c.swept) > c.ttl {
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+		c.swept = now
+	}
+	c.entries[userID] = accessCacheEntry{access: access, version: version, expires: now.Add(c.ttl)}
+}
+
+// Invalidate drops the cached Access of a user.
+func (c *AccessCache) Invalidate(userID int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.entries, userID)
+	c.mu.Unlock()
+	c.invalidations.Add(1)
+}
+
+// Stats returns the current values of the cache counters.
+func (c *AccessCache) Stats() AccessCacheStats {
+	if c == nil {
+		return AccessCacheStats{}
+	}
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+	return AccessCacheStats{
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Invalidations: c.invalidations.Load(),
+		Entries:       entries,
+	}
+}
@@ -0,0 +1,495 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum/internal/jsonlog"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// A Dialect is one of the SQL databases the models can work against.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case SQLite:
+		return "sqlite"
+	case Postgres:
+		return "postgres"
+	default:
+		return ""
+	}
+}
+
+// driver returns the name the database/sql driver of the dialect is registered under.
+func (d Dialect) driver() string {
+	if d == Postgres {
+		return "postgres"
+	}
+	return "sqlite3"
+}
+
+var schemeRX = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*)://`)
+
+// ParseDSN works out the dialect of a DSN from its scheme and returns it along with the
+// data source name to hand to the driver. postgres:// and postgresql:// URLs select
+// PostgreSQL. Anything without a scheme, including SQLite's own file: URIs, is taken to
+// be the path of a SQLite database, which can also be written as sqlite://path.
+func ParseDSN(dsn string) (Dialect, string, error) {
+	parts := schemeRX.FindStringSubmatch(dsn)
+	if parts == nil {
+		return SQLite, dsn, nil
+	}
+	switch strings.ToLower(parts[1]) {
+	case "postgres", "postgresql":
+		return Postgres, dsn, nil
+	case "sqlite", "sqlite3":
+		return SQLite, strings.TrimPrefix(dsn, parts[0]), nil
+	default:
+		return 0, "", fmt.Errorf("unsupported database scheme %q", parts[1])
+	}
+}
+
+// DefaultQueryTimeout is how long a model method waits for the database unless the DB
+// is given a different timeout with SetQueryTimeout().
+const DefaultQueryTimeout = 3 * time.Second
+
+// DB is a connection pool along with the dialect of the database behind it. The models
+// write their queries once, with SQLite-style placeholders (? and ?NNN), and DB rewrites
+// them for the dialect before handing them to the driver. It also reports queries which
+// were canceled or ran out of time as ErrQueryCanceled and ErrQueryTimeout, and logs
+// the queries which take longer than the slow query threshold.
+type DB struct {
+	pool *sql.DB
+	// tx is set on the DBs which WithTx() hands to its function, and makes every query
+	// run inside that transaction.
+	tx           *txState
+	Dialect      Dialect
+	queryTimeout time.Duration
+	slowQuery    time.Duration
+	logger       *jsonlog.Logger
+}
+
+// txState is the transaction a DB is bound to.
+type txState struct {
+	tx *sql.Tx
+	// savepoints counts the savepoints taken so far, for naming the next one.
+	savepoints int
+	// afterCommit holds the functions to run once the transaction has committed.
+	afterCommit []func()
+}
+
+// querier is the subset of methods shared by *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Open opens a connection pool for the DSN, choosing the driver with ParseDSN(). Like
+// sql.Open(), it doesn't connect to the database.
+func Open(dsn string) (*DB, error) {
+	dialect, source, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only enforces foreign keys, and with them the ON DELETE CASCADE clauses of
+	// our schema, when this is switched on for each connection. The driver does that
+	// for us when the DSN asks for it.
+	if dialect == SQLite && !strings.Contains(source, "_foreign_keys=") && !strings.Contains(source, "_fk=") {
+		separator := "?"
+		if strings.Contains(source, "?") {
+			separator = "&"
+		}
+		source += separator + "_foreign_keys=on"
+	}
+	pool, err := sql.Open(dialect.driver(), source)
+	if err != nil {
+		return nil, err
+	}
+	return NewDB(pool, dialect), nil
+}
+
+// NewDB wraps an already open connection pool.
+func NewDB(pool *sql.DB, dialect Dialect) *DB {
+	return &DB{pool: pool, Dialect: dialect, queryTimeout: DefaultQueryTimeout}
+}
+
+// SetQueryTimeout sets how long each model method may take. The timeout applies on
+// top of the deadline of the context the method is called with.
+func (db *DB) SetQueryTimeout(timeout time.Duration) {
+	db.queryTimeout = timeout
+}
+
+// SetSlowQueryLog makes the DB log a warning for every query which takes at least the
+// threshold. A threshold of zero switches the log off.
+func (db *DB) SetSlowQueryLog(threshold time.Duration, logger *jsonlog.Logger) {
+	db.slowQuery, db.logger = threshold, logger
+}
+
+// withTimeout returns a copy of ctx which is also canceled after the query timeout.
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+// conn returns what the queries of the DB run on: the transaction it is bound to, or
+// else the connection pool.
+func (db *DB) conn() querier {
+	if db.tx != nil {
+		return db.tx.tx
+	}
+	return db.pool
+}
+
+// afterCommit runs f once the transaction the DB is bound to has committed, or right
+// away when the DB isn't bound to one. The models use it to invalidate the access
+// cache, so that a concurrent request can't fill the cache with the old roles again
+// before the new ones are visible to it.
+func (db *DB) afterCommit(f func()) {
+	if db.tx == nil {
+		f()
+		return
+	}
+	db.tx.afterCommit = append(db.tx.afterCommit, f)
+}
+
+// Pool returns the underlying connection pool, for configuring it and reading its
+// statistics.
+func (db *DB) Pool() *sql.DB {
+	return db.pool
+}
+
+func (db *DB) PingContext(ctx context.Context) error {
+	return db.pool.PingContext(ctx)
+}
+
+// ErrNoFTS5 is returned by CheckFTS5 when the SQLite driver was compiled without the
+// FTS5 extension, which the movie search and its migration need.
+var ErrNoFTS5 = errors.New("SQLite was built without FTS5, build with -tags sqlite_fts5")
+
+// CheckFTS5 returns ErrNoFTS5 for a SQLite database without FTS5, so that callers can
+// stop with a clear error before the migrations fail halfway through.
+func (db *DB) CheckFTS5(ctx context.Context) error {
+	if db.Dialect != SQLite {
+		return nil
+	}
+	var enabled bool
+	err := db.pool.QueryRowContext(ctx, "SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrNoFTS5
+	}
+	return nil
+}
+
+func (db *DB) Close() error {
+	return db.pool.Close()
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	defer db.observe(query, time.Now())
+	query, args = db.Dialect.rebind(query, args)
+	result, err := db.conn().ExecContext(ctx, query, args...)
+	return result, contextError(ctx, err)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*Rows, error) {
+	defer db.observe(query, time.Now())
+	query, args = db.Dialect.rebind(query, args)
+	rows, err := db.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return &Rows{Rows: rows, ctx: ctx}, nil
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *Row {
+	defer db.observe(query, time.Now())
+	query, args = db.Dialect.rebind(query, args)
+	return &Row{row: db.conn().QueryRowContext(ctx, query, args...), ctx: ctx}
+}
+
+// BeginTx starts a transaction whose query methods rewrite the placeholders the same
+// way. On a DB which is already bound to a transaction it takes a savepoint instead,
+// so that the models can use transactions of their own inside WithTx(): committing
+// the inner transaction releases the savepoint and rolling it back only undoes what
+// was done since the savepoint.
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	if db.tx != nil {
+		db.tx.savepoints++
+		name := fmt.Sprintf("savepoint_%d", db.tx.savepoints)
+		_, err := db.ExecContext(ctx, "SAVEPOINT "+name)
+		if err != nil {
+			return nil, err
+		}
+		return &Tx{db: db, ctx: ctx, savepoint: name}, nil
+	}
+	tx, err := db.pool.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	bound := *db
+	bound.tx = &txState{tx: tx}
+	return &Tx{db: &bound, ctx: ctx}, nil
+}
+
+// maxTxAttempts is how many times WithTx() tries a transaction which keeps failing
+// because the database is busy.
+const maxTxAttempts = 5
+
+// WithTx runs fn in a transaction, handing it a DB whose queries all run inside the
+// transaction. The transaction is committed if fn returns nil and rolled back
+// otherwise, and the error from fn is returned as it is.
+//
+// When the database is too busy to let the transaction through (SQLITE_BUSY from
+// SQLite, a serialization failure or a deadlock from PostgreSQL) the whole
+// transaction is retried after a short, growing delay, so fn may run more than once
+// and mustn't have effects outside of the database. On a DB which is already bound to
+// a transaction, fn simply runs as part of that transaction.
+func (db *DB) WithTx(ctx context.Context, fn func(db *DB) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	delay := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := db.runTx(ctx, fn)
+		if err == nil || !isBusy(err) || attempt == maxTxAttempts {
+			return err
+		}
+		// Add some jitter, so that the transactions which got in each other's way
+		// don't all come back at the same moment.
+		timer := time.NewTimer(delay + rand.N(delay))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return contextError(ctx, err)
+		}
+		delay *= 2
+	}
+}
+
+// runTx makes a single attempt at the transaction of WithTx().
+func (db *DB) runTx(ctx context.Context, fn func(db *DB) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(tx.db)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// observe logs a query if it has taken longer than the slow query threshold since
+// start.
+func (db *DB) observe(query string, start time.Time) {
+	duration := time.Since(start)
+	if db.slowQuery <= 0 || duration < db.slowQuery || db.logger == nil {
+		return
+	}
+	db.logger.PrintWarn("slow query", jsonlog.Fields{
+		"query":    strings.Join(strings.Fields(query), " "),
+		"duration": duration,
+		"dialect":  db.Dialect.String(),
+	})
+}
+
+// Tx is a transaction started with DB.BeginTx(), or a savepoint within one.
+type Tx struct {
+	// db is bound to the transaction.
+	db        *DB
+	ctx       context.Context
+	savepoint string
+	done      bool
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return tx.db.ExecContext(ctx, query, args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...any) (*Rows, error) {
+	return tx.db.QueryContext(ctx, query, args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...any) *Row {
+	return tx.db.QueryRowContext(ctx, query, args...)
+}
+
+// Commit commits the transaction, or releases the savepoint. When the context the
+// transaction was started with is done, database/sql has already rolled it back and
+// Commit fails with ErrQueryCanceled or ErrQueryTimeout.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	if tx.savepoint != "" {
+		_, err := tx.db.ExecContext(tx.ctx, "RELEASE SAVEPOINT "+tx.savepoint)
+		return err
+	}
+	err := tx.db.tx.tx.Commit()
+	if err != nil {
+		return contextError(tx.ctx, err)
+	}
+	for _, f := range tx.db.tx.afterCommit {
+		f()
+	}
+	return nil
+}
+
+// Rollback rolls the transaction back, or undoes everything since the savepoint. Like
+// sql.Tx.Rollback(), it returns sql.ErrTxDone after Commit(), so it can be deferred.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	if tx.savepoint != "" {
+		_, err := tx.db.ExecContext(tx.ctx, "ROLLBACK TO SAVEPOINT "+tx.savepoint)
+		if err != nil {
+			return err
+		}
+		_, err = tx.db.ExecContext(tx.ctx, "RELEASE SAVEPOINT "+tx.savepoint)
+		return err
+	}
+	return tx.db.tx.tx.Rollback()
+}
+
+// Row is the result of QueryRowContext(). The error from its Scan() method reports a
+// canceled query the same way as the other query methods do.
+type Row struct {
+	row *sql.Row
+	ctx context.Context
+}
+
+func (r *Row) Scan(dest ...any) error {
+	return contextError(r.ctx, r.row.Scan(dest...))
+}
+
+// Rows is the result of QueryContext(). Its Err() method reports a query which was
+// canceled while the rows were being read the same way as the other query methods do.
+type Rows struct {
+	*sql.Rows
+	ctx context.Context
+}
+
+func (r *Rows) Err() error {
+	return contextError(r.ctx, r.Rows.Err())
+}
+
+// contextError converts an error from a query whose context is done into
+// ErrQueryTimeout when the context ran out of time, or ErrQueryCanceled otherwise.
+// The drivers report this in different ways (SQLite returns the context error while
+// PostgreSQL reports that the statement was canceled), so the context is what decides.
+// The original error stays in the chain for errors.Is() and the logs.
+func contextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", ErrQueryCanceled, err)
+}
+
+// rebind rewrites the SQLite-style placeholders of a query for the dialect. SQLite
+// takes the query as it is. PostgreSQL only understands $N, and insists on being able
+// to infer the type of every parameter up to the highest one used, so the parameters
+// are renumbered in the order they first appear and the arguments of any which the
+// query doesn't use are dropped. Following SQLite, a bare ? is numbered one higher than
+// the highest parameter before it. Placeholders inside string literals are left alone.
+func (d Dialect) rebind(query string, args []any) (string, []any) {
+	if d != Postgres {
+		return query, args
+	}
+	var (
+		b        strings.Builder
+		numbers  = make(map[int]int)
+		rebound  []any
+		highest  int
+		inString bool
+	)
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c == '\'' {
+			inString = !inString
+		}
+		if c != '?' || inString {
+			b.WriteByte(c)
+			continue
+		}
+		j := i + 1
+		for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+			j++
+		}
+		n := highest + 1
+		if j > i+1 {
+			n, _ = strconv.Atoi(query[i+1 : j])
+		}
+		highest = max(highest, n)
+		i = j - 1
+		number, ok := numbers[n]
+		if !ok {
+			var arg any
+			if n <= len(args) {
+				arg = args[n-1]
+			}
+			rebound = append(rebound, arg)
+			number = len(rebound)
+			numbers[n] = number
+		}
+		b.WriteString("$" + strconv.Itoa(number))
+	}
+	return b.String(), rebound
+}
+
+// isUniqueViolation reports whether an error from either driver is the violation of a
+// UNIQUE constraint or index.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// See https://www.postgresql.org/docs/current/errcodes-appendix.html
+		return pqErr.Code == "23505"
+	}
+	return false
+}
+
+// isBusy reports whether err means that the database couldn't run a statement because
+// of other transactions, and that trying the whole transaction again may succeed.
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// serialization_failure and deadlock_detected.
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	return false
+}
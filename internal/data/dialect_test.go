@@ -0,0 +1,69 @@
+package data
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		dsn     string
+		dialect Dialect
+		source  string
+	}{
+		{"./migrateDB/test.db", SQLite, "./migrateDB/test.db"},
+		{"file:test.db?cache=shared", SQLite, "file:test.db?cache=shared"},
+		{"sqlite:///tmp/test.db", SQLite, "/tmp/test.db"},
+		{"postgres://greenlight@localhost/greenlight", Postgres, "postgres://greenlight@localhost/greenlight"},
+		{"postgresql://localhost/greenlight?sslmode=disable", Postgres, "postgresql://localhost/greenlight?sslmode=disable"},
+	}
+	for _, tt := range tests {
+		dialect, source, err := ParseDSN(tt.dsn)
+		if err != nil || dialect != tt.dialect || source != tt.source {
+			t.Errorf("ParseDSN(%q) = %v, %q, %v; want %v, %q", tt.dsn, dialect, source, err, tt.dialect, tt.source)
+		}
+	}
+	if _, _, err := ParseDSN("mysql://localhost/greenlight"); err == nil {
+		t.Error("ParseDSN() accepted an unsupported scheme")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		args      []any
+		wantQuery string
+		wantArgs  []any
+	}{
+		{"positional", "SELECT ? WHERE a = ?", []any{1, 2}, "SELECT $1 WHERE a = $2", []any{1, 2}},
+		{"numbered and repeated", "WHERE a = ?2 OR b = ?1 OR c = ?2", []any{1, 2}, "WHERE a = $1 OR b = $2 OR c = $1", []any{2, 1}},
+		{"unused arguments", "LIMIT ?4 OFFSET ?7", []any{1, 2, 3, 4, nil, nil, 7}, "LIMIT $1 OFFSET $2", []any{4, 7}},
+		{"bare after numbered", "WHERE a = ?3 AND b = ?", []any{1, 2, 3, 4}, "WHERE a = $1 AND b = $2", []any{3, 4}},
+		{"string literal", "WHERE a LIKE '%?' || ?1", []any{"x"}, "WHERE a LIKE '%?' || $1", []any{"x"}},
+	}
+	for _, tt := range tests {
+		query, args := Postgres.rebind(tt.query, tt.args)
+		if query != tt.wantQuery || !slices.Equal(args, tt.wantArgs) {
+			t.Errorf("%s: got %q %v, want %q %v", tt.name, query, args, tt.wantQuery, tt.wantArgs)
+		}
+		if query, _ := SQLite.rebind(tt.query, tt.args); query != tt.query {
+			t.Errorf("%s: SQLite rewrote the query to %q", tt.name, query)
+		}
+	}
+}
+
+func TestTsQuery(t *testing.T) {
+	tests := map[string]string{
+		"dark knight":         "(dark) & (knight)",
+		`"the dark knight"`:   "(the <-> dark <-> knight)",
+		"pan* sci-fi":         "(pan:*) & (sci <-> fi)",
+		"it's & | ! ( ) : <>": "(it <-> s)",
+		"   ":                 "",
+	}
+	for search, want := range tests {
+		if got := tsQuery(search); got != want {
+			t.Errorf("tsQuery(%q) = %q, want %q", search, got, want)
+		}
+	}
+}
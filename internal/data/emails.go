@@ -0,0 +1,237 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"forum/internal/validator"
+)
+
+// The statuses of an email in the outbox. An email is pending until it has either been
+// sent or failed too many times, after which it stays failed until an admin retries it.
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+)
+
+// An Email is a message waiting in the outbox, or one which has already left it. The
+// template data is kept as JSON, and isn't part of the JSON representation of an Email
+// as it usually contains tokens.
+type Email struct {
+	ID            int             `json:"id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Recipient     string          `json:"recipient"`
+	Template      string          `json:"template"`
+	Locale        string          `json:"locale"`
+	Data          json.RawMessage `json:"-"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastError     string          `json:"last_error,omitempty"`
+	SentAt        *time.Time      `json:"sent_at,omitempty"`
+}
+
+// ValidateEmailStatus checks a status used to filter the outbox, where the empty string
+// stands for every status.
+func ValidateEmailStatus(v *validator.Validator, status string) {
+	v.Check(validator.PermittedValue(status, "", EmailPending, EmailSent, EmailFailed), "status", "must be pending, sent or failed")
+}
+
+// EmailModel is the outbox of the emails the application sends.
+type EmailModel struct {
+	DB *DB
+}
+
+// emailColumns is the select list for scanning an Email with scanEmail().
+const emailColumns = `id, created_at, recipient, template, locale, data, status, attempts, next_attempt_at, last_error, sent_at`
+
+// rowScanner is implemented by both *Row and *Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanEmail(row rowScanner, dest ...any) (*Email, error) {
+	var (
+		email  Email
+		data   string
+		sentAt sql.NullTime
+	)
+	err := row.Scan(append(dest,
+		&email.ID,
+		&email.CreatedAt,
+		&email.Recipient,
+		&email.Template,
+		&email.Locale,
+		&data,
+		&email.Status,
+		&email.Attempts,
+		&email.NextAttemptAt,
+		&email.LastError,
+		&sentAt,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+	email.Data = json.RawMessage(data)
+	if sentAt.Valid {
+		email.SentAt = &sentAt.Time
+	}
+	return &email, nil
+}
+
+// Enqueue adds an email to the outbox, due straight away. Called on the Models of a
+// unit of work, the email is only queued if the rest of the unit of work commits.
+func (m EmailModel) Enqueue(ctx context.Context, email *Email) error {
+	query := `
+	INSERT INTO email_outbox (recipient, template, locale, data, status, next_attempt_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	RETURNING id, created_at`
+	email.Status = EmailPending
+	email.NextAttemptAt = time.Now()
+	args := []any{email.Recipient, email.Template, email.Locale, string(email.Data), email.Status, email.NextAttemptAt}
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&email.ID, &email.CreatedAt)
+}
+
+// Claim picks the pending email which has been due the longest, counts an attempt at
+// sending it and hides it from the other workers for the lease, after which it becomes
+// due again in case its worker died before it could record the outcome. It returns
+// ErrRecordNotFound when no email is due.
+func (m EmailModel) Claim(ctx context.Context, lease time.Duration) (*Email, error) {
+	// Two workers may pick the same row in the subquery, but the second one's update
+	// then finds that the row is no longer due and claims nothing. PostgreSQL can skip
+	// the rows which another worker is busy claiming instead.
+	var skipLocked string
+	if m.DB.Dialect == Postgres {
+		skipLocked = "FOR UPDATE SKIP LOCKED"
+	}
+	query := fmt.Sprintf(`
+	UPDATE email_outbox
+	SET attempts = attempts + 1, next_attempt_at = ?1
+	WHERE id = (
+		SELECT id FROM email_outbox
+		WHERE status = ?3 AND next_attempt_at <= ?2
+		ORDER BY next_attempt_at, id
+		LIMIT 1
+		%s
+	) AND status = ?3 AND next_attempt_at <= ?2
+	RETURNING %s`, skipLocked, emailColumns)
+	now := time.Now()
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	email, err := scanEmail(m.DB.QueryRowContext(ctx, query, now.Add(lease), now, EmailPending))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRecordNotFound
+	}
+	return email, err
+}
+
+// MarkSent records that an email was delivered. Its data is dropped, as there is no
+// reason to keep the tokens in it any longer.
+func (m EmailModel) MarkSent(ctx context.Context, id int) error {
+	query := `
+	UPDATE email_outbox
+	SET status = ?, data = '{}', last_error = '', sent_at = ?
+	WHERE id = ?`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, EmailSent, time.Now(), id)
+	return err
+}
+
+// Reschedule records a failed attempt at delivering an email which should be tried
+// again at the given time.
+func (m EmailModel) Reschedule(ctx context.Context, id int, lastError string, at time.Time) error {
+	query := `
+	UPDATE email_outbox
+	SET last_error = ?, next_attempt_at = ?
+	WHERE id = ?`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, lastError, at, id)
+	return err
+}
+
+// MarkFailed moves an email to the dead letters after its last failed attempt. The
+// workers leave it alone from then on.
+func (m EmailModel) MarkFailed(ctx context.Context, id int, lastError string) error {
+	query := `
+	UPDATE email_outbox
+	SET status = ?, last_error = ?
+	WHERE id = ?`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, EmailFailed, lastError, id)
+	return err
+}
+
+// DeleteFailed deletes the failed emails which were queued before the given time, and
+// returns how many there were. Once the tokens in an email have expired there is no
+// point in retrying it, and no reason to keep the tokens around.
+func (m EmailModel) DeleteFailed(ctx context.Context, queuedBefore time.Time) (int64, error) {
+	query := `
+	DELETE FROM email_outbox
+	WHERE status = ? AND created_at < ?`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, EmailFailed, queuedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Retry puts a failed email back in the queue, due straight away and with its
+// attempts counted from zero again. It returns ErrRecordNotFound if there is no failed
+// email with the id.
+func (m EmailModel) Retry(ctx context.Context, id int) (*Email, error) {
+	query := fmt.Sprintf(`
+	UPDATE email_outbox
+	SET status = ?1, attempts = 0, next_attempt_at = ?2
+	WHERE id = ?3 AND status = ?4
+	RETURNING %s`, emailColumns)
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	email, err := scanEmail(m.DB.QueryRowContext(ctx, query, EmailPending, time.Now(), id, EmailFailed))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRecordNotFound
+	}
+	return email, err
+}
+
+// GetAll returns a page of the emails with the given status, or of every email if the
+// status is empty.
+func (m EmailModel) GetAll(ctx context.Context, status string, filter Filters) ([]*Email, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), %s
+	FROM email_outbox
+	WHERE status = ?1 OR ?1 = ''
+	ORDER BY %s %s, id ASC
+	LIMIT ?2 OFFSET ?3`, emailColumns, filter.sortColumn(), filter.sortDirection())
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, status, filter.limit(), filter.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	emails := []*Email{}
+	for rows.Next() {
+		email, err := scanEmail(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		emails = append(emails, email)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return emails, calculateMetadata(totalRecords, filter.Page, filter.PageSize), nil
+}
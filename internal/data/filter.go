@@ -1,6 +1,9 @@
 package data
 
 import (
+	"math"
+	"strings"
+
 	"forum/internal/validator"
 )
 
@@ -9,26 +12,42 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	// Keyset switches the listing from offset to keyset (cursor) pagination. In that
+	// mode Page is ignored and the listing starts after the After cursor or ends before
+	// the Before cursor; with neither set it starts at the beginning.
+	Keyset bool
+	After  *Cursor
+	Before *Cursor
 }
 
 // Check that the client-provided Sort field matches one of the entries in our safelist
 // and if it does, extract the column name from the Sort field by stripping the leading
 // hyphen character (if one exists).
-// func (f Filters) sortColumn() string {
-// 	for _, safeValue := range f.SortSafelist {
-// 		if f.Sort == safeValue {
-// 			return strings.TrimPrefix(f.Sort, "-")
-// 		}
-// 	}
-// 	panic("unsafe sort parametr: " + f.Sort)
-// }
-
-// func (f Filters) sortDirection() string {
-// 	if strings.HasPrefix(f.Sort, "-") {
-// 		return "DESC"
-// 	}
-// 	return "ASC"
-// }
+func (f Filters) sortColumn() string {
+	for _, safeValue := range f.SortSafelist {
+		if f.Sort == safeValue {
+			return strings.TrimPrefix(f.Sort, "-")
+		}
+	}
+	panic("unsafe sort parametr: " + f.Sort)
+}
+
+// Return the sort direction ("ASC" or "DESC") depending on the prefix character of the
+// Sort field.
+func (f Filters) sortDirection() string {
+	if strings.HasPrefix(f.Sort, "-") {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func (f Filters) limit() int {
+	return f.PageSize
+}
+
+func (f Filters) offset() int {
+	return (f.Page - 1) * f.PageSize
+}
 
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
@@ -38,4 +57,45 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	// A cursor only makes sense for the sort order it was issued for, and a listing
+	// can be paged in one direction at a time.
+	v.Check(f.After == nil || f.Before == nil, "after", "must not be used together with before")
+	v.Check(f.After == nil || f.After.Sort == f.Sort, "after", "does not match the sort parameter")
+	v.Check(f.Before == nil || f.Before.Sort == f.Sort, "before", "does not match the sort parameter")
+	// Relevance is a per-query score rather than a column, so it can't be used to
+	// position a cursor.
+	v.Check(!f.Keyset || f.Sort != "relevance", "sort", "relevance can't be used with cursor pagination")
+}
+
+// Define a new Metadata struct for holding the pagination metadata.
+type Metadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records,omitempty"`
+	// Next and Prev are only set for keyset pagination. They point just past the last
+	// and before the first row of the page, and are nil when there are no rows in that
+	// direction.
+	Next *Cursor `json:"-"`
+	Prev *Cursor `json:"-"`
+}
+
+// The calculateMetadata() function calculates the appropriate pagination metadata
+// values given the total number of records, current page, and page size values. Note
+// that the last page value is calculated using the math.Ceil() function, which rounds
+// up a float to the nearest integer. So, for example, if there were 12 records in total
+// and a page size of 5, the last page value would be math.Ceil(12/5) = 3.
+func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		// Note that we return an empty Metadata struct if there are no records.
+		return Metadata{}
+	}
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
 }
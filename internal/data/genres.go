@@ -0,0 +1,138 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Define an error for genres which are not part of the managed vocabulary in the
+// genres table.
+var ErrUnknownGenre = errors.New("unknown genre")
+
+// Genre is an entry of the genre vocabulary, along with the number of movies which
+// have that genre.
+type Genre struct {
+	ID         int    `json:"-"`
+	Name       string `json:"name"`
+	MovieCount int    `json:"movie_count"`
+}
+
+// NormalizeGenres trims the space around the genre names given by a client and lower
+// cases them, as the names in the vocabulary are, so that "Action" and " action" both
+// mean the action genre. A nil slice stays nil.
+func NormalizeGenres(genres []string) []string {
+	if genres == nil {
+		return nil
+	}
+	normalized := make([]string, len(genres))
+	for i, genre := range genres {
+		normalized[i] = strings.ToLower(strings.TrimSpace(genre))
+	}
+	return normalized
+}
+
+type GenreModel struct {
+	DB *DB
+}
+
+// The GetAll() method returns the whole genre vocabulary in alphabetical order.
+func (m GenreModel) GetAll(ctx context.Context) ([]*Genre, error) {
+	query := `
+	SELECT genres.id, genres.name, count(movies_genres.movie_id)
+	FROM genres
+	LEFT JOIN movies_genres ON movies_genres.genre_id = genres.id
+	GROUP BY genres.id, genres.name
+	ORDER BY genres.name`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	genres := []*Genre{}
+	for rows.Next() {
+		var genre Genre
+		err := rows.Scan(&genre.ID, &genre.Name, &genre.MovieCount)
+		if err != nil {
+			return nil, err
+		}
+		genres = append(genres, &genre)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return genres, nil
+}
+
+// setMovieGenres replaces the genres of a movie. It returns ErrUnknownGenre if any of
+// the names isn't in the vocabulary, in which case the caller should roll back the
+// transaction.
+func setMovieGenres(ctx context.Context, tx dbtx, movieID int, genres []string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM movies_genres WHERE movie_id = ?`, movieID)
+	if err != nil {
+		return err
+	}
+	if len(genres) == 0 {
+		return nil
+	}
+	// PostgreSQL can't infer the type of a parameter in the select list of an
+	// INSERT ... SELECT, hence the cast.
+	query := fmt.Sprintf(`
+	INSERT INTO movies_genres (movie_id, genre_id)
+	SELECT CAST(?1 AS BIGINT), genres.id FROM genres WHERE genres.name IN (%s)`, placeholders(2, len(genres)))
+	args := append([]any{movieID}, stringsToAny(genres)...)
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	// The genres have already been checked for duplicates, so any missing row means
+	// that one of the names didn't match the vocabulary.
+	if rowsAffected != int64(len(genres)) {
+		return ErrUnknownGenre
+	}
+	return nil
+}
+
+// movieGenres returns the genre names of the given movies, keyed by movie id.
+func movieGenres(ctx context.Context, db dbtx, movies []*Movie) (map[int][]string, error) {
+	genres := make(map[int][]string, len(movies))
+	if len(movies) == 0 {
+		return genres, nil
+	}
+	ids := make([]any, len(movies))
+	for i, movie := range movies {
+		ids[i] = movie.ID
+	}
+	query := fmt.Sprintf(`
+	SELECT movies_genres.movie_id, genres.name
+	FROM movies_genres
+	INNER JOIN genres ON genres.id = movies_genres.genre_id
+	WHERE movies_genres.movie_id IN (%s)
+	ORDER BY genres.name`, placeholders(1, len(ids)))
+	rows, err := db.QueryContext(ctx, query, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			movieID int
+			name    string
+		)
+		if err := rows.Scan(&movieID, &name); err != nil {
+			return nil, err
+		}
+		genres[movieID] = append(genres[movieID], name)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return genres, nil
+}
@@ -0,0 +1,782 @@
+//go:build sqlite_fts5
+
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/jsonlog"
+	migratedb "forum/migrateDB"
+
+	"github.com/lib/pq"
+)
+
+// The integration tests run every model against a freshly migrated SQLite database and,
+// when GREENLIGHT_TEST_POSTGRES_DSN holds a postgres:// URL, against PostgreSQL too.
+// Each PostgreSQL test works in a schema of its own, which is dropped afterwards.
+//
+// The SQLite database needs FTS5, so the tests are only built with the tag which
+// compiles it in:
+//
+//	go test -tags sqlite_fts5 ./internal/data
+const postgresDSNVar = "GREENLIGHT_TEST_POSTGRES_DSN"
+
+// forEachDialect runs fn against a new database of every available dialect.
+func forEachDialect(t *testing.T, fn func(t *testing.T, models Models)) {
+	t.Run("sqlite", func(t *testing.T) {
+		fn(t, NewModels(openTestSQLite(t), time.Minute))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		fn(t, NewModels(openTestPostgres(t), time.Minute))
+	})
+}
+
+func openTestSQLite(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migrateTestDB(t, db)
+	return db
+}
+
+func openTestPostgres(t *testing.T) *DB {
+	t.Helper()
+	dsn := os.Getenv(postgresDSNVar)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNVar)
+	}
+	admin, err := Open(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	schema := "greenlight_test_" + hex.EncodeToString(suffix)
+	ctx := context.Background()
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+	// lib/pq sends the parameters it doesn't know itself to the server as run-time
+	// settings, so this makes the new schema the default one for every connection.
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	db, err := Open(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migrateTestDB(t, db)
+	return db
+}
+
+func migrateTestDB(t *testing.T, db *DB) {
+	t.Helper()
+	migrator, err := migratedb.New(db.Pool(), db.Dialect.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CheckFTS5(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// Check that the down migrations work too, and that the up migrations can run
+	// again after them.
+	if err := migrator.Goto(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func insertTestUser(t *testing.T, models Models, email string) *User {
+	t.Helper()
+	user := &User{Name: "Test User", Email: email, Activated: true}
+	if err := user.Password.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Users.Insert(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestUserModel(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, models Models) {
+		ctx := context.Background()
+		alice := insertTestUser(t, models, "alice@example.com")
+		if alice.ID == 0 || alice.CreatedAt.IsZero() || alice.Version != 1 {
+			t.Fatalf("Insert() didn't fill in the generated fields: %+v", alice)
+		}
+		bob := insertTestUser(t, models, "bob@example.com")
+
+		duplicate := &User{Name: "Alice Again", Email: "alice@example.com"}
+		duplicate.Password.Set("pa55word1234")
+		if err := models.Users.Insert(ctx, duplicate); !errors.Is(err, ErrDuplicateEmail) {
+			t.Fatalf("Insert() with a taken email: got %v, want ErrDuplicateEmail", err)
+		}
+
+		got, err := models.Users.GetByEmail(ctx, "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != alice.ID || !got.Activated {
+			t.Fatalf("GetByEmail() = %+v, want %+v", got, alice)
+		}
+		if match, _ := got.Password.Matches("pa55word1234"); !match {
+			t.Fatal("the password hash didn't survive the round trip")
+		}
+		if _, err := models.Users.Get(ctx, bob.ID+100); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("Get() of a missing user: got %v, want ErrRecordNotFound", err)
+		}
+
+		got.Name = "Alice"
+		got.Locale = "fr"
+		got.PendingEmail = "alice@example.org"
+		if err := models.Users.Update(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != 2 {
+			t.Fatalf("Update() left the version at %d, want 2", got.Version)
+		}
+		if updated, err := models.Users.Get(ctx, alice.ID); err != nil || updated.Name != "Alice" || updated.Locale != "fr" || updated.PendingEmail != "alice@example.org" {
+			t.Fatalf("Get() after Update() = %+v, %v", updated, err)
+		}
+		stale := *alice
+		stale.Name = "Stale"
+		if err := models.Users.Update(ctx, &stale); !errors.Is(err, ErrEditConflict) {
+			t.Fatalf("Update() of a stale version: got %v, want ErrEditConflict", err)
+		}
+		bob.Email = "alice@example.com"
+		if err := models.Users.Update(ctx, bob); !errors.Is(err, ErrDuplicateEmail) {
+			t.Fatalf("Update() to a taken email: got %v, want ErrDuplicateEmail", err)
+		}
+
+		// Deleting a user takes a current version, and deletes their tokens with them.
+		token, err := models.Tokens.New(ctx, alice.ID, time.Hour, ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Users.Delete(ctx, &stale); !errors.Is(err, ErrEditConflict) {
+			t.Fatalf("Delete() of a stale version: got %v, want ErrEditConflict", err)
+		}
+		if err := models.Users.Delete(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.Users.Get(ctx, alice.ID); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("Get() of a deleted user: got %v, want ErrRecordNotFound", err)
+		}
+		if _, err := models.Users.GetForToken(ctx, ScopeAuthentication, token.Plaintext); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("GetForToken() with a token of a deleted user: got %v, want ErrRecordNotFound", err)
+		}
+		if err := models.Users.Delete(ctx, got); !errors.Is(err, ErrEditConflict) {
+			t.Fatalf("Delete() of a deleted user: got %v, want ErrEditConflict", err)
+		}
+	})
+}
+
+func TestMovieModel(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, models Models) {
+		ctx := context.Background()
+		movies := []*Movie{
+			{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+			{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"sci-fi", "action", "adventure"}},
+			{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+			{Title: "The Breakfast Club", Year: 1986, Runtime: 96, Genres: []string{"drama"}},
+		}
+		for _, movie := range movies {
+			if err := models.Movies.Insert(ctx, movie); err != nil {
+				t.Fatal(err)
+			}
+		}
+		unknown := &Movie{Title: "Nope", Year: 2000, Runtime: 100, Genres: []string{"drama", "nope"}}
+		if err := models.Movies.Insert(ctx, unknown); !errors.Is(err, ErrUnknownGenre) {
+			t.Fatalf("Insert() with an unknown genre: got %v, want ErrUnknownGenre", err)
+		}
+
+		panther, err := models.Movies.Get(ctx, movies[1].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"action", "adventure", "sci-fi"}; !slices.Equal(panther.Genres, want) {
+			t.Fatalf("Get() genres = %v, want %v", panther.Genres, want)
+		}
+		panther.Genres = []string{"action"}
+		if err := models.Movies.Update(ctx, panther); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Movies.Update(ctx, movies[1]); !errors.Is(err, ErrEditConflict) {
+			t.Fatalf("Update() of a stale version: got %v, want ErrEditConflict", err)
+		}
+
+		sorts := []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime", "relevance"}
+		filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: sorts}
+		list := func(title string, genres []string, search string, filters Filters) []string {
+			t.Helper()
+			page, _, err := models.Movies.GetAll(ctx, title, genres, search, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			titles := []string{}
+			for _, movie := range page {
+				titles = append(titles, movie.Title)
+			}
+			return titles
+		}
+		check := func(name string, got []string, want ...string) {
+			t.Helper()
+			if !slices.Equal(got, want) {
+				t.Errorf("%s: got %q, want %q", name, got, want)
+			}
+		}
+		check("title filter", list("PANTHER", nil, "", filters), "Black Panther")
+		check("genre filter", list("", []string{"action", "comedy"}, "", filters), "Deadpool")
+		byYear := filters
+		byYear.Sort = "-year"
+		check("sort", list("", nil, "", byYear), "Black Panther", "Moana", "Deadpool", "The Breakfast Club")
+		check("search", list("", nil, "breakfast", filters), "The Breakfast Club")
+		check("prefix search", list("", nil, "pan*", filters), "Black Panther")
+		check("phrase search", list("", nil, `"breakfast club"`, filters), "The Breakfast Club")
+
+		found, _, err := models.Movies.GetAll(ctx, "", nil, "panther", filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || !strings.Contains(found[0].TitleHighlight, "<mark>Panther</mark>") {
+			t.Errorf("search highlight: got %+v", found)
+		}
+		// The highlighted title is HTML, so the markup in a title has to be escaped.
+		heist := &Movie{Title: `<script>alert("x")</script> Heist`, Year: 2020, Runtime: 100, Genres: []string{"drama"}}
+		if err := models.Movies.Insert(ctx, heist); err != nil {
+			t.Fatal(err)
+		}
+		found, _, err = models.Movies.GetAll(ctx, "", nil, "heist", filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; <mark>Heist</mark>"; len(found) != 1 || found[0].TitleHighlight != want {
+			t.Errorf("search highlight of a title with markup: got %+v, want %q", found, want)
+		}
+		if err := models.Movies.Delete(ctx, int64(heist.ID)); err != nil {
+			t.Fatal(err)
+		}
+
+		keyset := Filters{PageSize: 3, Sort: "title", SortSafelist: sorts, Keyset: true}
+		first, metadata, err := models.Movies.GetAll(ctx, "", nil, "", keyset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(first) != 3 || metadata.Next == nil {
+			t.Fatalf("first keyset page: got %d movies and next cursor %v", len(first), metadata.Next)
+		}
+		keyset.After = metadata.Next
+		check("second keyset page", list("", nil, "", keyset), "The Breakfast Club")
+
+		if err := models.Movies.Delete(ctx, int64(movies[0].ID)); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Movies.Delete(ctx, int64(movies[0].ID)); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("Delete() of a deleted movie: got %v, want ErrRecordNotFound", err)
+		}
+		check("after delete", list("", []string{"adventure"}, "", filters))
+	})
+}
+
+func TestTokenModel(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, models Models) {
+		ctx := context.Background()
+		user := insertTestUser(t, models, "alice@example.com")
+		token, err := models.Tokens.New(ctx, user.ID, time.Hour, ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := models.Users.GetForToken(ctx, ScopeAuthentication, token.Plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != user.ID {
+			t.Fatalf("GetForToken() returned user %d, want %d", got.ID, user.ID)
+		}
+		if _, err := models.Users.GetForToken(ctx, ScopeActivation, token.Plaintext); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("GetForToken() with the wrong scope: got %v, want ErrRecordNotFound", err)
+		}
+
+		expired, err := models.Tokens.New(ctx, user.ID, -time.Minute, ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.Users.GetForToken(ctx, ScopeAuthentication, expired.Plaintext); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("GetForToken() with an expired token: got %v, want ErrRecordNotFound", err)
+		}
+
+		// The expired token stays in the table until the janitor deletes it.
+		if deleted, err := models.Tokens.DeleteExpired(ctx); err != nil || deleted != 1 {
+			t.Fatalf("DeleteExpired() = %d, %v; want the expired token to be deleted", deleted, err)
+		}
+
+		if err := models.Tokens.DeleteAllForUser(ctx, ScopeAuthentication, user.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.Users.GetForToken(ctx, ScopeAuthentication, token.Plaintext); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("GetForToken() after DeleteAllForUser(): got %v, want ErrRecordNotFound", err)
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, models Models) {
+		ctx := context.Background()
+		alice := insertTestUser(t, models, "alice@example.com")
+		bob := insertTestUser(t, models, "bob@example.com")
+		laptop, err := models.Tokens.NewSession(ctx, ScopeAuthentication, alice.ID, time.Hour, "Firefox", "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		phone, err := models.Tokens.NewSession(ctx, ScopeAuthentication, alice.ID, time.Hour, "Safari", "192.0.2.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.Tokens.New(ctx, alice.ID, time.Hour, ScopePasswordReset); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.Tokens.NewSession(ctx, ScopeAuthentication, bob.ID, time.Hour, "Chrome", "192.0.2.3"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the authentication tokens of the user are their sessions.
+		sessions, err := models.Tokens.GetSessionsForUser(ctx, ScopeAuthentication, alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 2 || sessions[0].UserAgent != "Safari" || sessions[1].UserAgent != "Firefox" {
+			t.Fatalf("got sessions %+v, want the phone and then the laptop", sessions)
+		}
+		if !sessions[1].IsToken(laptop.Plaintext) || sessions[1].IsToken(phone.Plaintext) || sessions[1].IP != "192.0.2.1" {
+			t.Errorf("got laptop session %+v", sessions[1])
+		}
+
+		// A use right after the last one isn't recorded, but a later one is, and moves
+		// the expiry back.
+		if err := models.Tokens.Touch(ctx, laptop.Plaintext, 2*time.Hour, "198.51.100.1"); err != nil {
+			t.Fatal(err)
+		}
+		if sessions, _ := models.Tokens.GetSessionsForUser(ctx, ScopeAuthentication, alice.ID); sessions[1].IP != "192.0.2.1" {
+			t.Fatalf("Touch() within a minute of the last use changed the session: %+v", sessions[1])
+		}
+		db := models.Tokens.(TokenModel).DB
+		if _, err := db.ExecContext(ctx, "UPDATE tokens SET last_used_at = ?", time.Now().Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Tokens.Touch(ctx, laptop.Plaintext, 2*time.Hour, "198.51.100.1"); err != nil {
+			t.Fatal(err)
+		}
+		sessions, err = models.Tokens.GetSessionsForUser(ctx, ScopeAuthentication, alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sessions[0]; got.UserAgent != "Firefox" || got.IP != "198.51.100.1" || got.Expiry.Before(time.Now().Add(time.Hour)) {
+			t.Fatalf("got session %+v, want the laptop to be used last and to expire in two hours", got)
+		}
+
+		// Users can only revoke their own sessions.
+		if err := models.Tokens.DeleteSession(ctx, ScopeAuthentication, bob.ID, sessions[0].ID); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("DeleteSession() of another user's session: got %v, want ErrRecordNotFound", err)
+		}
+		if err := models.Tokens.DeleteSession(ctx, ScopeAuthentication, alice.ID, sessions[0].ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.Users.GetForToken(ctx, ScopeAuthentication, laptop.Plaintext); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("GetForToken() of a revoked session: got %v, want ErrRecordNotFound", err)
+		}
+		if err := models.Tokens.Delete(ctx, ScopeAuthentication, phone.Plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if sessions, _ := models.Tokens.GetSessionsForUser(ctx, ScopeAuthentication, alice.ID); len(sessions) != 0 {
+			t.Fatalf("got sessions %+v after signing out of both", sessions)
+		}
+	})
+}
+
+func TestRefreshTokens(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, models Models) {
+		ctx := context.Background()
+		user := insertTestUser(t, models, "alice@example.com")
+		first, err := models.Tokens.NewSession(ctx, ScopeRefresh, user.ID, time.Hour, "Firefox", "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := models.Tokens.NewSession(ctx, ScopeRefresh, user.ID, time.Hour, "Safari", "192.0.2.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := models.Tokens.GetRefreshToken(ctx, first.Plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != first.ID || got.UserId != user.ID || got.Family != first.Family || got.Rotated {
+			t.Fatalf("got %+v, want the first refresh token", got)
+		}
+		if _, err := models.Users.GetForToken(ctx, ScopeAuthentication, first.Plaintext); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("a refresh token authenticated a request: %v", err)
+		}
+
+		// Rotating the token replaces it with a new one of the same family, which
+		// carries the session on.
+		var second *Token
+		err = models.WithTx(ctx, func(tx Models) error {
+			var err error
+			second, err = tx.Tokens.Rotate(ctx, got, 2*time.Hour, "198.51.100.1")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.Family != first.Family || second.ID == first.ID || second.UserAgent != "Firefox" {
+			t.Fatalf("got %+v, want a new token of the first token's family", second)
+		}
+		sessions, err := models.Tokens.GetSessionsForUser(ctx, ScopeRefresh, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 2 || !slices.ContainsFunc(sessions, func(s *Session) bool { return s.ID == second.ID && s.IP == "198.51.100.1" }) {
+			t.Fatalf("got sessions %+v, want the rotated one to be left out", sessions)
+		}
+
+		// The rotated token can still be looked up, so that its reuse is noticed, but
+		// can't be rotated again.
+		got, err = models.Tokens.GetRefreshToken(ctx, first.Plaintext)
+		if err != nil || !got.Rotated {
+			t.Fatalf("GetRefreshToken() of a rotated token = %+v, %v", got, err)
+		}
+		if _, err := models.Tokens.Rotate(ctx, got, time.Hour, ""); !errors.Is(err, ErrEditConflict) {
+			t.Fatalf("Rotate() of a rotated token: got %v, want ErrEditConflict", err)
+		}
+		// Revoking the session by the id of an old token deletes the whole family,
+		// and leaves the other session alone.
+		if err := models.Tokens.DeleteSession(ctx, ScopeRefresh, user.ID, first.ID); err != nil {
+			t.Fatal(err)
+		}
+		for _, token := range []*Token{first, second} {
+			if _, err := models.Tokens.GetRefreshToken(ctx, token.Plaintext); !errors.Is(err, ErrRecordNotFound) {
+				t.Fatalf("GetRefreshToken() of a revoked token: got %v, want ErrRecordNotFound", err)
+			}
+		}
+		if err := models.Tokens.DeleteFamily(ctx, other.Family); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.Tokens.GetRefreshToken(ctx, other.Plaintext); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("GetRefreshToken() after DeleteFamily(): got %v, want ErrRecordNotFound", err)
+		}
+	})
+}
+
+func TestPermissionAndRoleModels(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, models Models) {
+		ctx := context.Background()
+		user := insertTestUser(t, models, "alice@example.com")
+		if err := models.Permissions.AddForUser(ctx, user.ID, "movies:read", "movies:read"); err != nil {
+			t.Fatal(err)
+		}
+		// Granting a permission a second time is a no-op.
+		if err := models.Permissions.AddForUser(ctx, user.ID, "movies:read"); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Permissions.AddForUser(ctx, user.ID, "movies:write", "nope"); !errors.Is(err, ErrUnknownPermission) {
+			t.Fatalf("AddForUser() with an unknown code: got %v, want ErrUnknownPermission", err)
+		}
+		if err := models.Roles.AddForUser(ctx, user.ID, "editor"); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Roles.AddForUser(ctx, user.ID, "nope"); !errors.Is(err, ErrUnknownRole) {
+			t.Fatalf("AddForUser() with an unknown role: got %v, want ErrUnknownRole", err)
+		}
+
+		all, err := models.Permissions.GetAllForUser(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (Permissions{"movies:read", "movies:write"}); !slices.Equal(all, want) {
+			t.Fatalf("GetAllForUser() = %v, want %v", all, want)
+		}
+		direct, err := models.Permissions.GetDirectForUser(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (Permissions{"movies:read"}); !slices.Equal(direct, want) {
+			t.Fatalf("GetDirectForUser() = %v, want %v", direct, want)
+		}
+
+		roles, err := models.Roles.GetAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, role := range roles {
+			names = append(names, role.Name)
+		}
+		if want := []string{"admin", "editor", "viewer"}; !slices.Equal(names, want) {
+			t.Fatalf("Roles.GetAll() = %v, want %v", names, want)
+		}
+
+		if err := models.Roles.RemoveForUser(ctx, user.ID, "editor"); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Permissions.RemoveForUser(ctx, user.ID, "movies:read"); err != nil {
+			t.Fatal(err)
+		}
+		access, err := models.Permissions.GetAccessForUser(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(access.Roles) != 0 || len(access.Permissions) != 0 {
+			t.Fatalf("GetAccessForUser() after revoking everything = %+v", access)
+		}
+	})
+}
+
+func TestQueryContext(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, models Models) {
+		db := models.Movies.(MovieModel).DB
+		user := insertTestUser(t, models, "alice@example.com")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := models.Users.Get(ctx, user.ID); !errors.Is(err, ErrQueryCanceled) {
+			t.Errorf("Get() with a canceled context returned %v", err)
+		}
+		if _, _, err := models.Movies.GetAll(ctx, "", nil, "", Filters{Page: 1, PageSize: 5, Sort: "id", SortSafelist: []string{"id"}}); !errors.Is(err, ErrQueryCanceled) {
+			t.Errorf("GetAll() with a canceled context returned %v", err)
+		}
+		if err := models.Roles.AddForUser(ctx, user.ID, "viewer"); !errors.Is(err, ErrQueryCanceled) {
+			t.Errorf("AddForUser() with a canceled context returned %v", err)
+		}
+
+		var log strings.Builder
+		db.SetSlowQueryLog(time.Nanosecond, jsonlog.New(&log, jsonlog.LevelInfo))
+		db.SetQueryTimeout(time.Nanosecond)
+		if _, err := models.Users.GetByEmail(context.Background(), user.Email); !errors.Is(err, ErrQueryTimeout) {
+			t.Errorf("GetByEmail() past the query timeout returned %v", err)
+		}
+		db.SetQueryTimeout(DefaultQueryTimeout)
+		if _, err := models.Users.GetByEmail(context.Background(), user.Email); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(log.String(), `"message":"slow query"`) || !strings.Contains(log.String(), "WHERE email = ?") {
+			t.Errorf("got log %s", log.String())
+		}
+	})
+}
+
+func TestWithTx(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, models Models) {
+		ctx := context.Background()
+		newUser := func(email string) *User {
+			user := &User{Name: "Test User", Email: email}
+			if err := user.Password.Set("pa55word1234"); err != nil {
+				t.Fatal(err)
+			}
+			return user
+		}
+
+		// Everything done in a unit of work which fails is rolled back.
+		errBoom := errors.New("boom")
+		err := models.WithTx(ctx, func(tx Models) error {
+			if err := tx.Users.Insert(ctx, newUser("alice@example.com")); err != nil {
+				return err
+			}
+			return errBoom
+		})
+		if !errors.Is(err, errBoom) {
+			t.Fatalf("WithTx() returned %v, want the error from fn", err)
+		}
+		if _, err := models.Users.GetByEmail(ctx, "alice@example.com"); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("the user of a rolled back unit of work is still there: %v", err)
+		}
+
+		// A model which fails inside a unit of work only undoes its own changes, and the
+		// rest of the unit of work can still be committed.
+		bob := newUser("bob@example.com")
+		err = models.WithTx(ctx, func(tx Models) error {
+			movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "cooking"}}
+			if err := tx.Movies.Insert(ctx, movie); !errors.Is(err, ErrUnknownGenre) {
+				t.Errorf("Insert() of a movie with an unknown genre returned %v", err)
+			}
+			if err := tx.Users.Insert(ctx, bob); err != nil {
+				return err
+			}
+			return tx.WithTx(ctx, func(tx Models) error {
+				return tx.Roles.AddForUser(ctx, bob.ID, "editor")
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		roles, err := models.Roles.GetAllForUser(ctx, bob.ID)
+		if err != nil || !slices.Equal(roles, []string{"editor"}) {
+			t.Fatalf("got roles %v, %v; want [editor]", roles, err)
+		}
+		movies, _, err := models.Movies.GetAll(ctx, "", nil, "", Filters{Page: 1, PageSize: 5, Sort: "id", SortSafelist: []string{"id"}})
+		if err != nil || len(movies) != 0 {
+			t.Fatalf("got movies %v, %v; want none", movies, err)
+		}
+
+		// A unit of work which fails because the database is busy is tried again from
+		// the start.
+		attempts := 0
+		err = models.WithTx(ctx, func(tx Models) error {
+			attempts++
+			if err := tx.Users.Insert(ctx, newUser("carol@example.com")); err != nil {
+				return err
+			}
+			if attempts == 1 {
+				return &pq.Error{Code: "40001"}
+			}
+			return nil
+		})
+		if err != nil || attempts != 2 {
+			t.Fatalf("WithTx() returned %v after %d attempts, want success after 2", err, attempts)
+		}
+		if _, err := models.Users.GetByEmail(ctx, "carol@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestEmailModel(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, models Models) {
+		ctx := context.Background()
+		emailFilters := Filters{Page: 1, PageSize: 10, Sort: "id", SortSafelist: []string{"id"}}
+		welcome := &Email{Recipient: "alice@example.com", Template: "welcome", Locale: "fr", Data: json.RawMessage(`{"userID":1}`)}
+		if err := models.Emails.Enqueue(ctx, welcome); err != nil {
+			t.Fatal(err)
+		}
+		reset := &Email{Recipient: "bob@example.com", Template: "password-reset", Data: json.RawMessage(`{}`)}
+		if err := models.Emails.Enqueue(ctx, reset); err != nil {
+			t.Fatal(err)
+		}
+
+		// Emails are claimed oldest first, and a claimed email isn't due again until its
+		// lease runs out.
+		claimed, err := models.Emails.Claim(ctx, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed.ID != welcome.ID || claimed.Attempts != 1 || claimed.Locale != "fr" || string(claimed.Data) != `{"userID":1}` {
+			t.Fatalf("got %+v, want the first email on its first attempt", claimed)
+		}
+		if claimed, err := models.Emails.Claim(ctx, time.Minute); err != nil || claimed.ID != reset.ID {
+			t.Fatalf("got %+v, %v; want the second email", claimed, err)
+		}
+		if _, err := models.Emails.Claim(ctx, time.Minute); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("Claim() with nothing due returned %v", err)
+		}
+
+		if err := models.Emails.MarkSent(ctx, welcome.ID); err != nil {
+			t.Fatal(err)
+		}
+		// An email which is rescheduled into the past is due again straight away.
+		if err := models.Emails.Reschedule(ctx, reset.ID, "connection refused", time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		claimed, err = models.Emails.Claim(ctx, time.Minute)
+		if err != nil || claimed.ID != reset.ID || claimed.Attempts != 2 || claimed.LastError != "connection refused" {
+			t.Fatalf("got %+v, %v; want the second attempt at the second email", claimed, err)
+		}
+		if err := models.Emails.MarkFailed(ctx, reset.ID, "mailbox unavailable"); err != nil {
+			t.Fatal(err)
+		}
+
+		emails, metadata, err := models.Emails.GetAll(ctx, "", emailFilters)
+		if err != nil || len(emails) != 2 || metadata.TotalRecords != 2 {
+			t.Fatalf("got %v, %+v, %v; want both emails", emails, metadata, err)
+		}
+		if sent := emails[0]; sent.Status != EmailSent || sent.SentAt == nil || string(sent.Data) != "{}" {
+			t.Errorf("got sent email %+v", sent)
+		}
+		failed, _, err := models.Emails.GetAll(ctx, EmailFailed, emailFilters)
+		if err != nil || len(failed) != 1 || failed[0].ID != reset.ID || failed[0].LastError != "mailbox unavailable" {
+			t.Fatalf("got failed emails %v, %v", failed, err)
+		}
+
+		// Only failed emails can be retried, after which they are due again.
+		if _, err := models.Emails.Retry(ctx, welcome.ID); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Retry() of a sent email returned %v", err)
+		}
+		retried, err := models.Emails.Retry(ctx, reset.ID)
+		if err != nil || retried.Status != EmailPending || retried.Attempts != 0 {
+			t.Fatalf("got %+v, %v; want a pending email", retried, err)
+		}
+		if claimed, err := models.Emails.Claim(ctx, time.Minute); err != nil || claimed.ID != reset.ID || claimed.Attempts != 1 {
+			t.Fatalf("got %+v, %v; want the retried email", claimed, err)
+		}
+
+		// Failed emails are deleted once they were queued long enough ago, and the
+		// others are kept.
+		if err := models.Emails.MarkFailed(ctx, reset.ID, "mailbox unavailable"); err != nil {
+			t.Fatal(err)
+		}
+		if deleted, err := models.Emails.DeleteFailed(ctx, time.Now().Add(-time.Hour)); deleted != 0 || err != nil {
+			t.Fatalf("DeleteFailed() of a recent email = %d, %v", deleted, err)
+		}
+		if deleted, err := models.Emails.DeleteFailed(ctx, time.Now().Add(time.Hour)); deleted != 1 || err != nil {
+			t.Fatalf("DeleteFailed() = %d, %v; want the failed email to be deleted", deleted, err)
+		}
+		if emails, _, err := models.Emails.GetAll(ctx, "", emailFilters); err != nil || len(emails) != 1 || emails[0].ID != welcome.ID {
+			t.Fatalf("got %v, %v; want the sent email to be left", emails, err)
+		}
+	})
+}
+
+func TestEmailOptOutModel(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, models Models) {
+		ctx := context.Background()
+		alice := insertTestUser(t, models, "alice@example.com")
+		bob := insertTestUser(t, models, "bob@example.com")
+		if err := models.OptOuts.AddForUser(ctx, alice.ID, "tips", "announcements", "tips"); err != nil {
+			t.Fatal(err)
+		}
+		// Opting out twice is harmless.
+		if err := models.OptOuts.AddForUser(ctx, alice.ID, "announcements"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := models.OptOuts.GetAllForUser(ctx, alice.ID); err != nil || !slices.Equal(got, []string{"announcements", "tips"}) {
+			t.Fatalf("GetAllForUser() = %v, %v", got, err)
+		}
+		if got, err := models.OptOuts.GetAllForUser(ctx, bob.ID); err != nil || len(got) != 0 {
+			t.Fatalf("GetAllForUser() of another user = %v, %v", got, err)
+		}
+		if err := models.OptOuts.RemoveForUser(ctx, alice.ID, "tips"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := models.OptOuts.GetAllForUser(ctx, alice.ID); err != nil || !slices.Equal(got, []string{"announcements"}) {
+			t.Fatalf("GetAllForUser() after RemoveForUser() = %v, %v", got, err)
+		}
+	})
+}
@@ -0,0 +1,987 @@
+package data
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"html"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// memoryStore holds the data of the in-memory models. It follows the rules the
+// database schema enforces, like unique email addresses and the genre vocabulary, so
+// that handlers behave the same against it as against a real database.
+type memoryStore struct {
+	mu sync.Mutex
+	// txMu is held for the whole of a unit of work, so that only one runs at a time.
+	txMu sync.Mutex
+	memoryData
+}
+
+// memoryData is the content of a memoryStore, split out so that a unit of work can
+// take a copy of it to roll back to.
+type memoryData struct {
+	movies          map[int]Movie
+	nextMovieID     int
+	genres          []string
+	users           map[int]User
+	nextUserID      int
+	tokens          []memoryToken
+	nextTokenID     int
+	permissions     []string
+	roles           map[string]Permissions
+	userPermissions map[int][]string
+	userRoles       map[int][]string
+	emails          map[int]Email
+	nextEmailID     int
+	optOuts         map[int][]string
+}
+
+// NewMemoryModels returns Models which keep everything in memory rather than in a
+// database, for testing the handlers. It starts out with the same genres, permissions
+// and roles as a freshly migrated database.
+func NewMemoryModels() Models {
+	store := &memoryStore{memoryData: memoryData{
+		movies:      make(map[int]Movie),
+		nextMovieID: 1,
+		genres: []string{
+			"action", "adventure", "animation", "biography", "comedy", "crime",
+			"documentary", "drama", "family", "fantasy", "history", "horror",
+			"music", "musical", "mystery", "romance", "sci-fi", "sport",
+			"thriller", "war", "western",
+		},
+		users:       make(map[int]User),
+		nextUserID:  1,
+		nextTokenID: 1,
+		permissions: []string{"metrics:view", "movies:read", "movies:write"},
+		roles: map[string]Permissions{
+			"admin":  {"metrics:view", "movies:read", "movies:write"},
+			"editor": {"movies:read", "movies:write"},
+			"viewer": {"movies:read"},
+		},
+		userPermissions: make(map[int][]string),
+		userRoles:       make(map[int][]string),
+		emails:          make(map[int]Email),
+		nextEmailID:     1,
+		optOuts:         make(map[int][]string),
+	}}
+	return Models{
+		Movies:      memoryMovieModel{store},
+		Genres:      memoryGenreModel{store},
+		Users:       memoryUserModel{store},
+		Tokens:      memoryTokenModel{store},
+		Permissions: memoryPermissionModel{store},
+		Roles:       memoryRoleModel{store},
+		Emails:      memoryEmailModel{store},
+		OptOuts:     memoryOptOutModel{store},
+		unitOfWork:  store.withTx,
+	}
+}
+
+// withTx runs fn as a unit of work against the store. Rather than isolating fn from
+// everything else, it only undoes what fn changed when fn fails, by restoring a copy
+// taken beforehand, which is enough for tests that don't write concurrently. fn is
+// given m itself, so that repositories a test has wrapped stay in place.
+func (s *memoryStore) withTx(ctx context.Context, m Models, fn func(tx Models) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	s.mu.Lock()
+	saved := s.memoryData.clone()
+	s.mu.Unlock()
+	// A WithTx() inside fn becomes part of this unit of work.
+	m.unitOfWork = func(ctx context.Context, m Models, fn func(tx Models) error) error {
+		return fn(m)
+	}
+	err := fn(m)
+	if err != nil {
+		s.mu.Lock()
+		s.memoryData = saved
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// clone returns a copy of d which shares nothing that the models change in place.
+func (d memoryData) clone() memoryData {
+	d.movies = maps.Clone(d.movies)
+	d.genres = slices.Clone(d.genres)
+	d.users = maps.Clone(d.users)
+	d.tokens = slices.Clone(d.tokens)
+	d.permissions = slices.Clone(d.permissions)
+	d.roles = maps.Clone(d.roles)
+	d.userPermissions = cloneValues(d.userPermissions)
+	d.userRoles = cloneValues(d.userRoles)
+	d.emails = maps.Clone(d.emails)
+	d.optOuts = cloneValues(d.optOuts)
+	return d
+}
+
+func cloneValues(m map[int][]string) map[int][]string {
+	clone := make(map[int][]string, len(m))
+	for k, v := range m {
+		clone[k] = slices.Clone(v)
+	}
+	return clone
+}
+
+type memoryMovieModel struct {
+	store *memoryStore
+}
+
+func (m memoryMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.knownGenres(movie.Genres) {
+		return ErrUnknownGenre
+	}
+	movie.ID = s.nextMovieID
+	movie.CreatedAt = time.Now()
+	movie.Version = 1
+	s.nextMovieID++
+	s.movies[movie.ID] = copyMovie(*movie)
+	return nil
+}
+
+func (m memoryMovieModel) Get(ctx context.Context, id int) (*Movie, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	movie, ok := s.movies[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	movie = copyMovie(movie)
+	return &movie, nil
+}
+
+func (m memoryMovieModel) Update(ctx context.Context, movie *Movie) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.movies[movie.ID]
+	if !ok || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+	if !s.knownGenres(movie.Genres) {
+		return ErrUnknownGenre
+	}
+	movie.Version++
+	movie.CreatedAt = stored.CreatedAt
+	s.movies[movie.ID] = copyMovie(*movie)
+	return nil
+}
+
+func (m memoryMovieModel) Delete(ctx context.Context, id int64) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.movies[int(id)]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(s.movies, int(id))
+	return nil
+}
+
+func (m memoryMovieModel) GetAll(ctx context.Context, title string, genres []string, search string, filter Filters) ([]*Movie, Metadata, error) {
+	terms := parseSearch(search)
+	s := m.store
+	s.mu.Lock()
+	movies := []*Movie{}
+	for _, stored := range s.movies {
+		movie := copyMovie(stored)
+		if !strings.Contains(strings.ToLower(movie.Title), strings.ToLower(title)) {
+			continue
+		}
+		if !slices.ContainsFunc(genres, func(genre string) bool { return !slices.Contains(movie.Genres, genre) }) &&
+			matchSearch(&movie, terms) {
+			movies = append(movies, &movie)
+		}
+	}
+	s.mu.Unlock()
+
+	column, direction := filter.sortColumn(), filter.sortDirection()
+	compare := func(a, b *Movie) int {
+		var c int
+		switch column {
+		case "title":
+			c = strings.Compare(a.Title, b.Title)
+		case "year":
+			c = cmp.Compare(a.Year, b.Year)
+		case "runtime":
+			c = cmp.Compare(a.Runtime, b.Runtime)
+		case "relevance":
+			c = cmp.Compare(searchRank(b, terms), searchRank(a, terms))
+		}
+		if direction == "DESC" {
+			c = -c
+		}
+		// Just like the queries, use the id as a tie-breaker which is always ascending.
+		return cmp.Or(c, cmp.Compare(a.ID, b.ID))
+	}
+	slices.SortFunc(movies, compare)
+
+	if !filter.Keyset {
+		total := len(movies)
+		start := min(filter.offset(), total)
+		end := min(start+filter.limit(), total)
+		return movies[start:end], calculateMetadata(total, filter.Page, filter.PageSize), nil
+	}
+	cursor, backward := filter.After, false
+	if filter.Before != nil {
+		cursor, backward = filter.Before, true
+	}
+	if cursor == nil {
+		hasMore := len(movies) > filter.limit()
+		movies = movies[:min(filter.limit(), len(movies))]
+		return movies, keysetMetadata(filter, movies, hasMore, false, false), nil
+	}
+	position, err := cursorMovie(column, cursor)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	// Find where the cursor falls in the sorted movies, and take a page from there
+	// in the direction we're paging.
+	i, _ := slices.BinarySearchFunc(movies, position, compare)
+	var hasMore bool
+	if backward {
+		hasMore = i > filter.limit()
+		movies = movies[max(0, i-filter.limit()):i]
+	} else {
+		if i < len(movies) && compare(movies[i], position) == 0 {
+			i++
+		}
+		movies = movies[i:]
+		hasMore = len(movies) > filter.limit()
+		movies = movies[:min(filter.limit(), len(movies))]
+	}
+	return movies, keysetMetadata(filter, movies, hasMore, backward, true), nil
+}
+
+// cursorMovie returns a movie with the sort value and id held in a cursor, to compare
+// the movies of a listing against.
+func cursorMovie(column string, cursor *Cursor) (*Movie, error) {
+	key, err := movieSortArg(column, cursor.Key)
+	if err != nil {
+		return nil, err
+	}
+	movie := &Movie{ID: cursor.ID}
+	switch column {
+	case "title":
+		movie.Title = key.(string)
+	case "year":
+		movie.Year = int32(key.(int64))
+	case "runtime":
+		movie.Runtime = Runtime(key.(int64))
+	}
+	return movie, nil
+}
+
+// matchSearch reports whether the title of a movie matches every one of the search
+// terms, and if so highlights the words they matched. Matching ignores case but,
+// unlike the databases, doesn't stem the words.
+func matchSearch(movie *Movie, terms []searchTerm) bool {
+	if len(terms) == 0 {
+		return true
+	}
+	words := titleWords(movie.Title)
+	matched := make([]bool, len(words))
+	for _, term := range terms {
+		found := false
+		for i := 0; i+len(term.lexemes) <= len(words); i++ {
+			if matchTerm(words[i:i+len(term.lexemes)], term) {
+				found = true
+				for j := range term.lexemes {
+					matched[i+j] = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	var b strings.Builder
+	last := 0
+	for i, word := range words {
+		if matched[i] {
+			b.WriteString(html.EscapeString(movie.Title[last:word.start]) + "<mark>" + html.EscapeString(word.text) + "</mark>")
+			last = word.end
+		}
+	}
+	b.WriteString(html.EscapeString(movie.Title[last:]))
+	movie.TitleHighlight = b.String()
+	return true
+}
+
+func matchTerm(words []titleWord, term searchTerm) bool {
+	for i, lexeme := range term.lexemes {
+		word, lexeme := strings.ToLower(words[i].text), strings.ToLower(lexeme)
+		if term.prefix && i == len(term.lexemes)-1 {
+			if !strings.HasPrefix(word, lexeme) {
+				return false
+			}
+		} else if word != lexeme {
+			return false
+		}
+	}
+	return true
+}
+
+// searchRank scores a search result by the share of its title the search matched.
+func searchRank(movie *Movie, terms []searchTerm) float64 {
+	words := len(titleWords(movie.Title))
+	if len(terms) == 0 || words == 0 {
+		return 0
+	}
+	return float64(strings.Count(movie.TitleHighlight, "<mark>")) / float64(words)
+}
+
+// A titleWord is a run of letters and digits in a title, along with its byte offsets.
+type titleWord struct {
+	text       string
+	start, end int
+}
+
+func titleWords(title string) []titleWord {
+	var words []titleWord
+	start := -1
+	for i, r := range title + " " {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			words = append(words, titleWord{text: title[start:i], start: start, end: i})
+			start = -1
+		}
+	}
+	return words
+}
+
+// knownGenres reports whether every one of the genres is in the vocabulary.
+func (s *memoryStore) knownGenres(genres []string) bool {
+	for _, genre := range genres {
+		if !slices.Contains(s.genres, genre) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyMovie returns a copy of a movie which doesn't share its genres slice, so that
+// callers can't change the stored movies behind the store's back. The genres are kept
+// in alphabetical order, the order the SQL models return them in.
+func copyMovie(movie Movie) Movie {
+	movie.Genres = slices.Clone(movie.Genres)
+	slices.Sort(movie.Genres)
+	movie.TitleHighlight = ""
+	return movie
+}
+
+type memoryGenreModel struct {
+	store *memoryStore
+}
+
+func (m memoryGenreModel) GetAll(ctx context.Context) ([]*Genre, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	genres := []*Genre{}
+	for i, name := range s.genres {
+		genre := &Genre{ID: i + 1, Name: name}
+		for _, movie := range s.movies {
+			if slices.Contains(movie.Genres, name) {
+				genre.MovieCount++
+			}
+		}
+		genres = append(genres, genre)
+	}
+	slices.SortFunc(genres, func(a, b *Genre) int { return strings.Compare(a.Name, b.Name) })
+	return genres, nil
+}
+
+type memoryUserModel struct {
+	store *memoryStore
+}
+
+func (m memoryUserModel) Insert(ctx context.Context, user *User) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+	user.ID = s.nextUserID
+	user.CreatedAt = time.Now()
+	user.Version = 1
+	s.nextUserID++
+	s.users[user.ID] = *user
+	return nil
+}
+
+func (m memoryUserModel) Get(ctx context.Context, id int) (*User, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+func (m memoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryUserModel) Update(ctx context.Context, user *User) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+	if s.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+	user.Version++
+	s.users[user.ID] = *user
+	return nil
+}
+
+// Delete also removes everything which belongs to the user, like the foreign keys of
+// the database do.
+func (m memoryUserModel) Delete(ctx context.Context, user *User) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+	delete(s.users, user.ID)
+	s.tokens = slices.DeleteFunc(s.tokens, func(t memoryToken) bool { return t.UserId == user.ID })
+	delete(s.userPermissions, user.ID)
+	delete(s.userRoles, user.ID)
+	delete(s.optOuts, user.ID)
+	return nil
+}
+
+func (m memoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlainText string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if bytes.Equal(t.Hash, tokenHash[:]) && t.Scope == tokenScope && t.Expiry.After(time.Now()) {
+			if user, ok := s.users[t.UserId]; ok {
+				return &user, nil
+			}
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+// emailTaken reports whether a user other than the one with the given id has the
+// email address.
+func (s *memoryStore) emailTaken(email string, id int) bool {
+	for _, user := range s.users {
+		if user.Email == email && user.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+// memoryToken is a Token along with the columns of the tokens table that only
+// Sessions show.
+type memoryToken struct {
+	Token
+	lastUsedAt time.Time
+}
+
+type memoryTokenModel struct {
+	store *memoryStore
+}
+
+func (m memoryTokenModel) New(ctx context.Context, userID int, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (m memoryTokenModel) NewSession(ctx context.Context, scope string, userID int, ttl time.Duration, userAgent, ip string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	token.UserAgent = userAgent
+	token.IP = ip
+	err = m.Insert(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (m memoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[token.UserId]; !ok {
+		// The tokens table has a foreign key to the users table.
+		return ErrRecordNotFound
+	}
+	now := time.Now()
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = now
+	}
+	token.ID = s.nextTokenID
+	s.nextTokenID++
+	s.tokens = append(s.tokens, memoryToken{Token: *token, lastUsedAt: now})
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = slices.DeleteFunc(s.tokens, func(t memoryToken) bool {
+		return t.Scope == scope && t.UserId == userID
+	})
+	return nil
+}
+
+func (m memoryTokenModel) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = slices.DeleteFunc(s.tokens, func(t memoryToken) bool {
+		return t.Scope == scope && bytes.Equal(t.Hash, hash[:])
+	})
+	return nil
+}
+
+func (m memoryTokenModel) Touch(ctx context.Context, tokenPlaintext string, ttl time.Duration, ip string) error {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	now := time.Now()
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.tokens {
+		if t.Scope == ScopeAuthentication && bytes.Equal(t.Hash, hash[:]) && t.lastUsedAt.Before(now.Add(-sessionTouchInterval)) {
+			s.tokens[i].lastUsedAt = now
+			s.tokens[i].Expiry = now.Add(ttl)
+			s.tokens[i].IP = ip
+		}
+	}
+	return nil
+}
+
+func (m memoryTokenModel) GetSessionsForUser(ctx context.Context, scope string, userID int) ([]*Session, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := []*Session{}
+	for _, t := range s.tokens {
+		if t.UserId == userID && t.Scope == scope && t.Expiry.After(time.Now()) && !t.Rotated {
+			sessions = append(sessions, &Session{
+				ID:         t.ID,
+				CreatedAt:  t.CreatedAt,
+				LastUsedAt: t.lastUsedAt,
+				Expiry:     t.Expiry,
+				UserAgent:  t.UserAgent,
+				IP:         t.IP,
+				hash:       t.Hash,
+			})
+		}
+	}
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		return cmp.Or(b.LastUsedAt.Compare(a.LastUsedAt), cmp.Compare(b.ID, a.ID))
+	})
+	return sessions, nil
+}
+
+func (m memoryTokenModel) DeleteSession(ctx context.Context, scope string, userID, id int) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.tokens, func(t memoryToken) bool {
+		return t.ID == id && t.UserId == userID && t.Scope == scope
+	})
+	if i < 0 {
+		return ErrRecordNotFound
+	}
+	family := s.tokens[i].Family
+	s.tokens = slices.DeleteFunc(s.tokens, func(t memoryToken) bool {
+		return t.Family == family && t.UserId == userID && t.Scope == scope
+	})
+	return nil
+}
+
+func (m memoryTokenModel) GetRefreshToken(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if t.Scope == ScopeRefresh && bytes.Equal(t.Hash, hash[:]) && t.Expiry.After(time.Now()) {
+			token := t.Token
+			token.Plaintext = tokenPlaintext
+			return &token, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryTokenModel) Rotate(ctx context.Context, token *Token, ttl time.Duration, ip string) (*Token, error) {
+	s := m.store
+	s.mu.Lock()
+	i := slices.IndexFunc(s.tokens, func(t memoryToken) bool { return t.ID == token.ID && !t.Rotated })
+	if i >= 0 {
+		s.tokens[i].Rotated = true
+	}
+	s.mu.Unlock()
+	if i < 0 {
+		return nil, ErrEditConflict
+	}
+	next, err := generateToken(token.UserId, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	next.Family = token.Family
+	next.CreatedAt = token.CreatedAt
+	next.UserAgent = token.UserAgent
+	next.IP = ip
+	err = m.Insert(ctx, next)
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func (m memoryTokenModel) DeleteFamily(ctx context.Context, family string) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = slices.DeleteFunc(s.tokens, func(t memoryToken) bool { return t.Family == family })
+	return nil
+}
+
+func (m memoryTokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.tokens)
+	s.tokens = slices.DeleteFunc(s.tokens, func(t memoryToken) bool {
+		return !t.Expiry.After(time.Now())
+	})
+	return int64(n - len(s.tokens)), nil
+}
+
+type memoryPermissionModel struct {
+	store *memoryStore
+}
+
+func (m memoryPermissionModel) GetAllForUser(ctx context.Context, userID int) (Permissions, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	permissions := slices.Clone(s.userPermissions[userID])
+	for _, role := range s.userRoles[userID] {
+		permissions = append(permissions, s.roles[role]...)
+	}
+	slices.Sort(permissions)
+	return append(Permissions{}, slices.Compact(permissions)...), nil
+}
+
+func (m memoryPermissionModel) GetAccessForUser(ctx context.Context, user *User) (Access, error) {
+	roles, err := memoryRoleModel(m).GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return Access{}, err
+	}
+	permissions, err := m.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return Access{}, err
+	}
+	return Access{Roles: roles, Permissions: permissions}, nil
+}
+
+func (m memoryPermissionModel) GetDirectForUser(ctx context.Context, userID int) (Permissions, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	permissions := append(Permissions{}, s.userPermissions[userID]...)
+	slices.Sort(permissions)
+	return permissions, nil
+}
+
+func (m memoryPermissionModel) AddForUser(ctx context.Context, userID int, codes ...string) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.grant(s.userPermissions, userID, codes, s.permissions, ErrUnknownPermission)
+}
+
+func (m memoryPermissionModel) RemoveForUser(ctx context.Context, userID int, codes ...string) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userPermissions[userID] = slices.DeleteFunc(s.userPermissions[userID], func(code string) bool {
+		return slices.Contains(codes, code)
+	})
+	return nil
+}
+
+type memoryRoleModel struct {
+	store *memoryStore
+}
+
+func (m memoryRoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roles := []*Role{}
+	for i, name := range s.roleNames() {
+		roles = append(roles, &Role{ID: i + 1, Name: name, Permissions: slices.Clone(s.roles[name])})
+	}
+	return roles, nil
+}
+
+func (m memoryRoleModel) GetAllForUser(ctx context.Context, userID int) ([]string, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roles := append([]string{}, s.userRoles[userID]...)
+	slices.Sort(roles)
+	return roles, nil
+}
+
+func (m memoryRoleModel) AddForUser(ctx context.Context, userID int, roles ...string) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.grant(s.userRoles, userID, roles, s.roleNames(), ErrUnknownRole)
+}
+
+func (m memoryRoleModel) RemoveForUser(ctx context.Context, userID int, roles ...string) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userRoles[userID] = slices.DeleteFunc(s.userRoles[userID], func(role string) bool {
+		return slices.Contains(roles, role)
+	})
+	return nil
+}
+
+func (s *memoryStore) roleNames() []string {
+	names := make([]string, 0, len(s.roles))
+	for name := range s.roles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// grant adds the names to the grants of a user, like grantForUser() does: if any of
+// them isn't one of the known names nothing is granted, and existing grants are left
+// as they are.
+func (s *memoryStore) grant(grants map[int][]string, userID int, names, known []string, errUnknown error) error {
+	for _, name := range names {
+		if !slices.Contains(known, name) {
+			return errUnknown
+		}
+	}
+	for _, name := range names {
+		if !slices.Contains(grants[userID], name) {
+			grants[userID] = append(grants[userID], name)
+		}
+	}
+	return nil
+}
+
+type memoryEmailModel struct {
+	store *memoryStore
+}
+
+func (m memoryEmailModel) Enqueue(ctx context.Context, email *Email) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	email.ID = s.nextEmailID
+	email.CreatedAt = time.Now()
+	email.Status = EmailPending
+	email.NextAttemptAt = email.CreatedAt
+	s.nextEmailID++
+	s.emails[email.ID] = *email
+	return nil
+}
+
+func (m memoryEmailModel) Claim(ctx context.Context, lease time.Duration) (*Email, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var due *Email
+	for _, email := range s.emails {
+		if email.Status != EmailPending || email.NextAttemptAt.After(now) {
+			continue
+		}
+		if due == nil || email.NextAttemptAt.Before(due.NextAttemptAt) ||
+			email.NextAttemptAt.Equal(due.NextAttemptAt) && email.ID < due.ID {
+			due = &email
+		}
+	}
+	if due == nil {
+		return nil, ErrRecordNotFound
+	}
+	due.Attempts++
+	due.NextAttemptAt = now.Add(lease)
+	s.emails[due.ID] = *due
+	return due, nil
+}
+
+func (m memoryEmailModel) MarkSent(ctx context.Context, id int) error {
+	return m.update(id, func(email *Email) {
+		now := time.Now()
+		email.Status, email.Data, email.LastError, email.SentAt = EmailSent, json.RawMessage("{}"), "", &now
+	})
+}
+
+func (m memoryEmailModel) Reschedule(ctx context.Context, id int, lastError string, at time.Time) error {
+	return m.update(id, func(email *Email) {
+		email.LastError, email.NextAttemptAt = lastError, at
+	})
+}
+
+func (m memoryEmailModel) MarkFailed(ctx context.Context, id int, lastError string) error {
+	return m.update(id, func(email *Email) {
+		email.Status, email.LastError = EmailFailed, lastError
+	})
+}
+
+func (m memoryEmailModel) DeleteFailed(ctx context.Context, queuedBefore time.Time) (int64, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for id, email := range s.emails {
+		if email.Status == EmailFailed && email.CreatedAt.Before(queuedBefore) {
+			delete(s.emails, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m memoryEmailModel) Retry(ctx context.Context, id int) (*Email, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	email, ok := s.emails[id]
+	if !ok || email.Status != EmailFailed {
+		return nil, ErrRecordNotFound
+	}
+	email.Status, email.Attempts, email.NextAttemptAt = EmailPending, 0, time.Now()
+	s.emails[id] = email
+	return &email, nil
+}
+
+func (m memoryEmailModel) GetAll(ctx context.Context, status string, filter Filters) ([]*Email, Metadata, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	emails := []*Email{}
+	for _, email := range s.emails {
+		if status == "" || email.Status == status {
+			emails = append(emails, &email)
+		}
+	}
+	column, direction := filter.sortColumn(), filter.sortDirection()
+	slices.SortFunc(emails, func(a, b *Email) int {
+		c := cmp.Compare(a.ID, b.ID)
+		if column == "next_attempt_at" {
+			c = a.NextAttemptAt.Compare(b.NextAttemptAt)
+		}
+		if direction == "DESC" {
+			c = -c
+		}
+		return cmp.Or(c, cmp.Compare(a.ID, b.ID))
+	})
+	total := len(emails)
+	start := min(filter.offset(), total)
+	end := min(start+filter.limit(), total)
+	return emails[start:end], calculateMetadata(total, filter.Page, filter.PageSize), nil
+}
+
+// update applies a change to the email with the id, if there is one.
+func (m memoryEmailModel) update(id int, change func(email *Email)) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	email, ok := s.emails[id]
+	if !ok {
+		return nil
+	}
+	change(&email)
+	s.emails[id] = email
+	return nil
+}
+
+type memoryOptOutModel struct {
+	store *memoryStore
+}
+
+func (m memoryOptOutModel) GetAllForUser(ctx context.Context, userID int) ([]string, error) {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	categories := append([]string{}, s.optOuts[userID]...)
+	slices.Sort(categories)
+	return categories, nil
+}
+
+func (m memoryOptOutModel) AddForUser(ctx context.Context, userID int, categories ...string) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, category := range categories {
+		if !slices.Contains(s.optOuts[userID], category) {
+			s.optOuts[userID] = append(s.optOuts[userID], category)
+		}
+	}
+	return nil
+}
+
+func (m memoryOptOutModel) RemoveForUser(ctx context.Context, userID int, categories ...string) error {
+	s := m.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.optOuts[userID] = slices.DeleteFunc(s.optOuts[userID], func(category string) bool {
+		return slices.Contains(categories, category)
+	})
+	return nil
+}
@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
@@ -12,22 +14,156 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// The errors returned by the models when the context of a query is done: either it was
+// canceled, because the client went away or the server is shutting down, or the query
+// ran past its deadline.
+var (
+	ErrQueryCanceled = errors.New("query canceled")
+	ErrQueryTimeout  = errors.New("query timed out")
+)
+
+// dbtx is the subset of methods shared by *DB and *Tx, for helpers which are used both
+// inside and outside of a transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *Row
+}
+
+// The repositories below describe what the handlers need from each model. MovieModel
+// and the other SQL models implement them against a database, and the in-memory
+// versions returned by NewMemoryModels() implement them for the handler tests.
+type MovieRepository interface {
+	Insert(ctx context.Context, movie *Movie) error
+	Get(ctx context.Context, id int) (*Movie, error)
+	Update(ctx context.Context, movie *Movie) error
+	Delete(ctx context.Context, id int64) error
+	GetAll(ctx context.Context, title string, genres []string, search string, filter Filters) ([]*Movie, Metadata, error)
+}
+
+type GenreRepository interface {
+	GetAll(ctx context.Context) ([]*Genre, error)
+}
+
+type UserRepository interface {
+	Insert(ctx context.Context, user *User) error
+	Get(ctx context.Context, id int) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	Delete(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlainText string) (*User, error)
+}
+
+type TokenRepository interface {
+	New(ctx context.Context, userID int, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int) error
+	NewSession(ctx context.Context, scope string, userID int, ttl time.Duration, userAgent, ip string) (*Token, error)
+	Delete(ctx context.Context, scope, tokenPlaintext string) error
+	Touch(ctx context.Context, tokenPlaintext string, ttl time.Duration, ip string) error
+	GetSessionsForUser(ctx context.Context, scope string, userID int) ([]*Session, error)
+	DeleteSession(ctx context.Context, scope string, userID, id int) error
+	GetRefreshToken(ctx context.Context, tokenPlaintext string) (*Token, error)
+	Rotate(ctx context.Context, token *Token, ttl time.Duration, ip string) (*Token, error)
+	DeleteFamily(ctx context.Context, family string) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type PermissionRepository interface {
+	GetAllForUser(ctx context.Context, userID int) (Permissions, error)
+	GetAccessForUser(ctx context.Context, user *User) (Access, error)
+	GetDirectForUser(ctx context.Context, userID int) (Permissions, error)
+	AddForUser(ctx context.Context, userID int, codes ...string) error
+	RemoveForUser(ctx context.Context, userID int, codes ...string) error
+}
+
+type RoleRepository interface {
+	GetAll(ctx context.Context) ([]*Role, error)
+	GetAllForUser(ctx context.Context, userID int) ([]string, error)
+	AddForUser(ctx context.Context, userID int, roles ...string) error
+	RemoveForUser(ctx context.Context, userID int, roles ...string) error
+}
+
+type EmailRepository interface {
+	Enqueue(ctx context.Context, email *Email) error
+	Claim(ctx context.Context, lease time.Duration) (*Email, error)
+	MarkSent(ctx context.Context, id int) error
+	Reschedule(ctx context.Context, id int, lastError string, at time.Time) error
+	MarkFailed(ctx context.Context, id int, lastError string) error
+	Retry(ctx context.Context, id int) (*Email, error)
+	DeleteFailed(ctx context.Context, queuedBefore time.Time) (int64, error)
+	GetAll(ctx context.Context, status string, filter Filters) ([]*Email, Metadata, error)
+}
+
+type EmailOptOutRepository interface {
+	GetAllForUser(ctx context.Context, userID int) ([]string, error)
+	AddForUser(ctx context.Context, userID int, categories ...string) error
+	RemoveForUser(ctx context.Context, userID int, categories ...string) error
+}
+
+// Make sure at compile time that the SQL models implement the repositories.
+var (
+	_ MovieRepository       = MovieModel{}
+	_ GenreRepository       = GenreModel{}
+	_ UserRepository        = UserModel{}
+	_ TokenRepository       = TokenModel{}
+	_ PermissionRepository  = PermissionModel{}
+	_ RoleRepository        = RoleModel{}
+	_ EmailRepository       = EmailModel{}
+	_ EmailOptOutRepository = EmailOptOutModel{}
+)
+
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and PermissionModel, as our build progresses.
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies      MovieRepository
+	Genres      GenreRepository
+	Users       UserRepository
+	Tokens      TokenRepository
+	Permissions PermissionRepository
+	Roles       RoleRepository
+	Emails      EmailRepository
+	OptOuts     EmailOptOutRepository
+	AccessCache *AccessCache
+	// unitOfWork runs fn as one unit of work, see WithTx(). It is given the Models
+	// WithTx() was called on, as the in-memory models hand those to fn unchanged.
+	unitOfWork func(ctx context.Context, m Models, fn func(tx Models) error) error
+}
+
+// WithTx runs fn as a single unit of work: the Models handed to fn do everything in one
+// database transaction, which is committed if fn returns nil and rolled back if it
+// returns an error. A transaction which fails because the database is busy is tried
+// again, so fn may run more than once and should leave things like sending emails
+// until WithTx has returned. Calling WithTx on the Models given to fn runs the inner
+// fn as part of the same transaction.
+func (m Models) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	return m.unitOfWork(ctx, m, fn)
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
-// the initialized MovieModel.
-func NewModels(db *sql.DB) Models {
+// the initialized MovieModel. The roles and permissions of users are cached for
+// accessCacheTTL, or not at all if it is zero.
+func NewModels(db *DB, accessCacheTTL time.Duration) Models {
+	return newModels(db, NewAccessCache(accessCacheTTL))
+}
+
+// newModels returns the SQL models working against db, which may be bound to a
+// transaction.
+func newModels(db *DB, cache *AccessCache) Models {
 	return Models{
 		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
+		Genres:      GenreModel{DB: db},
+		Users:       UserModel{DB: db, Cache: cache},
 		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Permissions: PermissionModel{DB: db, Cache: cache},
+		Roles:       RoleModel{DB: db, Cache: cache},
+		Emails:      EmailModel{DB: db},
+		OptOuts:     EmailOptOutModel{DB: db},
+		AccessCache: cache,
+		unitOfWork: func(ctx context.Context, _ Models, fn func(tx Models) error) error {
+			return db.WithTx(ctx, func(tx *DB) error {
+				return fn(newModels(tx, cache))
+			})
+		},
 	}
 }
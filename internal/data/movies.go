@@ -4,7 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"forum/internal/validator"
 )
@@ -15,11 +20,14 @@ type Movie struct {
 	Title     string    `json:"title"`
 	Year      int32     `json:"year,omitempty"`
 	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    string    `json:"genres,omitempty"`
+	Genres    []string  `json:"genres,omitempty"`
 	Version   int32     `json:"version"`
+	// TitleHighlight holds the title as HTML, escaped, with the terms matched by a
+	// full-text search wrapped in <mark> tags. It is only set in search results.
+	TitleHighlight string `json:"title_highlight,omitempty"`
 }
 type MovieModel struct {
-	DB *sql.DB
+	DB *DB
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -30,56 +38,69 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
 	v.Check(movie.Runtime != 0, "runtime", "must be provided")
 	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
-	// v.Check(movie.Genres != nil, "genres", "must be provided")
-	// v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	// v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
-	// // Note that we're using the Unique helper in the line below to check that all
-	// // values in the movie.Genres slice are unique.
-	// v.Check(Unique(movie.Genres), "genres", "must not contain duplicate values")
+	v.Check(movie.Genres != nil, "genres", "must be provided")
+	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
+	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	// Note that we're using the Unique helper in the line below to check that all
+	// values in the movie.Genres slice are unique. Whether the genres are part of the
+	// managed vocabulary is checked by the database when the movie is saved.
+	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 	// Use the Valid() method to see if any of the checks failed. If they did, then use
 	// the failedValidationResponse() helper to send a response to the client, passing
 	// in the v.Errors map.
 }
 
-// Define a MovieModel struct type which wraps a sql.DB connection pool.
-func (m MovieModel) Insert(movie *Movie) error {
+// Define a MovieModel struct type which wraps a DB connection pool.
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	// Define the SQL query for inserting a new record in the movies table and returning
 	// the system generated data
-	stmt := `INSERT INTO movies (title, year,runtime,genres)
-	VALUES(?,?,?,?)
+	stmt := `INSERT INTO movies (title, year,runtime)
+	VALUES(?,?,?)
 	RETURNING id,version`
 	// Create an args slice containing the values for the placeholder parameters from
 	// the movie struct. Declaring this slice immediately next to our SQL query helps to
 	// make it nice and clear *what values are being used where* in the query.
-	args := []any{movie.Title, movie.Year, movie.Runtime, movie.Genres}
-
-	// _, err := m.DB.Exec(stmt, movie.Title, movie.Year, movie.Runtime, movie.Genres)
-	// if err != nil {
-	// 	return err
-	// }
-	// return nil
-	return m.DB.QueryRow(stmt, args...).Scan(&movie.ID, &movie.Version)
+	args := []any{movie.Title, movie.Year, movie.Runtime}
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	// The movie and its genres are written in one transaction, so a movie with an
+	// unknown genre is never saved.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, stmt, args...).Scan(&movie.ID, &movie.Version)
+	if err != nil {
+		return err
+	}
+	err = setMovieGenres(ctx, tx, movie.ID, movie.Genres)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Add a placeholder method for fetching a specific record from the movies table.
-func (m MovieModel) Get(id int) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	// Define the sql query for retrieving the movie data
 	query := `
-	Select id,created_at,title,year,runtime,genres,version
+	Select id,created_at,title,year,runtime,version
 	FROM movies
 	WHERE id = ?`
 	// Declare a Movie struct to hold the data returned by the query
 	var movie Movie
-	err := m.DB.QueryRow(query, id).Scan(
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
-		&movie.Genres,
 		&movie.Version,
 	)
 	// Handle any errors. If there was no matching movie found, Scan() will return
@@ -93,30 +114,41 @@ func (m MovieModel) Get(id int) (*Movie, error) {
 			return nil, err
 		}
 	}
+	genres, err := movieGenres(ctx, m.DB, []*Movie{&movie})
+	if err != nil {
+		return nil, err
+	}
+	movie.Genres = genres[movie.ID]
 	// OtherWise, return a pointer to the Movie struct
 	return &movie, nil
 }
 
 // Add a placeholder method for updating a specific record in the movies table.
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	// Add the 'AND version = $6' clause to the SQL query.
 	query := `
 	UPDATE movies
-	SET title = ?, year = ?, runtime = ?, genres = ?, version = version + 1
+	SET title = ?, year = ?, runtime = ?, version = version + 1
 	WHERE id = ? AND version = ?
 	RETURNING version`
 	args := []any{
 		movie.Title,
 		movie.Year,
 		movie.Runtime,
-		movie.Genres,
 		movie.ID,
 		movie.Version, // Add the expected movie version.
 	}
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 	// Execute the SQL query. If no matching row could be found, we know the movie
 	// version has changed (or the record has been deleted) and we return our custom
 	// ErrEditConflict error.
-	err := m.DB.QueryRow(query, args...).Scan(&movie.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -125,11 +157,15 @@ func (m MovieModel) Update(movie *Movie) error {
 			return err
 		}
 	}
-	return nil
+	err = setMovieGenres(ctx, tx, movie.ID, movie.Genres)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Add a placeholder method for deleting a specific record from the movies table.
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -139,7 +175,9 @@ func (m MovieModel) Delete(id int64) error {
 	WHERE id = ?`
 	// Execute the SQL query using the Exec() mehtod, passing i9n the id variable as
 	// tge value for the placeholder parametr. The ExeC() method returns a sql.Result
-	result, err := m.DB.Exec(query, id)
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -158,42 +196,431 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
-func (m MovieModel) GetAll(title, genres string, filter Filters) ([]*Movie, error) {
-	// Update the sql query to include the filter conditions
-	query := `SELECT id, created_at, title, year, runtime, genres, version
-	FROM movies
-	WHERE (title LIKE '%' || ?1 || '%' OR ?1 = '')
-	  AND (genres LIKE '%' || ?2 || '%' OR ?2 = '')
-	ORDER BY id ASC `
+// The GetAll() method returns a page of movies matching the title filter, having all
+// of the given genres and, when search is non-empty, matching the full-text search
+// query.
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, search string, filter Filters) ([]*Movie, Metadata, error) {
+	// Convert the search into a full-text query for the database up front. Input
+	// without any searchable words is treated as no search at all.
+	search = searchQuery(m.DB.Dialect, search)
+	if filter.Keyset {
+		return m.getAllKeyset(ctx, title, genres, search, filter)
+	}
+	// Use a window function to count the total (filtered) records alongside each row,
+	// and order by the safelisted sort column with the primary key as a secondary sort
+	// so that rows with equal sort values always come back in the same order. The sort
+	// column and direction can't be placeholders, so they are interpolated here; this is
+	// safe because sortColumn() only ever returns a value from the safelist.
+	// The FTS5 highlight() and rank functions can't be combined with a window function
+	// in the same query, so the filtering happens in a subquery.
+	d := m.DB.Dialect
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), id, created_at, title, year, runtime, version, title_highlight
+	FROM (
+		SELECT %s, %s AS sort_rank
+		%s
+	) AS page
+	ORDER BY %s %s, id ASC
+	LIMIT ?4 OFFSET ?5`, movieListColumns(d, search), movieRank(d, search), movieListFilter(d, search, len(genres)), movieOrderColumn(filter.sortColumn()), filter.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withTimeout(ctx)
 	defer cancel()
-	// Pass  the title and genres as the placeholder parametr values
-	rows, err := m.DB.QueryContext(ctx, query, title, genres)
+	// Pass the filters and the pagination values as the placeholder parametr values.
+	args := []any{title, len(genres), search, filter.limit(), filter.offset(), nil}
+	args = append(args, stringsToAny(genres)...)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, Metadata{}, err
 	}
-	// WHERE (LOWER(title)=LOWER(?) OR ? ='') AND genres = ? OR ?=''
 	defer rows.Close()
+	totalRecords := 0
 	movies := []*Movie{}
 	for rows.Next() {
 		var movie Movie
 		err := rows.Scan(
+			&totalRecords,
 			&movie.ID,
 			&movie.CreatedAt,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
-			&movie.Genres,
 			&movie.Version,
+			&movie.TitleHighlight,
 		)
 		if err != nil {
-			return nil, err
+			return nil, Metadata{}, err
 		}
+		movie.TitleHighlight = highlightHTML(movie.TitleHighlight)
 		movies = append(movies, &movie)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, Metadata{}, err
+	}
+	if err = m.attachGenres(ctx, movies); err != nil {
+		return nil, Metadata{}, err
+	}
+	// Generate a Metadata struct, passing in the total record count and pagination
+	// parameters from the client.
+	metadata := calculateMetadata(totalRecords, filter.Page, filter.PageSize)
+	return movies, metadata, nil
+}
+
+// The databases mark the start and the end of the matched terms with these control
+// characters rather than with the <mark> tags themselves, so that highlightHTML() can
+// tell the marks apart from anything the title contains when it escapes it.
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// movieListColumns returns the select list shared by the movie listings. When there is
+// a search query the matched terms in the title are highlighted.
+func movieListColumns(d Dialect, search string) string {
+	highlight := "''"
+	switch {
+	case search == "":
+	case d == Postgres:
+		highlight = "ts_headline('english', movies.title, to_tsquery('english', ?3), 'StartSel=" + highlightStart + ", StopSel=" + highlightStop + ", HighlightAll=true')"
+	default:
+		highlight = "highlight(movies_fts, 0, '" + highlightStart + "', '" + highlightStop + "')"
+	}
+	return `movies.id, movies.created_at, movies.title, movies.year, movies.runtime,
+	movies.version, ` + highlight + ` AS title_highlight`
+}
+
+// highlightHTML turns a title highlighted by the database into HTML: the title is
+// escaped, as it is whatever the user who added the movie typed, and the marks around
+// the matched terms become <mark> tags.
+func highlightHTML(highlighted string) string {
+	if highlighted == "" {
+		return ""
+	}
+	escaped := html.EscapeString(highlighted)
+	return strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>").Replace(escaped)
+}
+
+// movieListFilter returns the FROM and WHERE clauses shared by the movie listings. The
+// title filter is bound to ?1, the number of required genres to ?2 and the full-text
+// query to ?3. The genre names themselves are bound from ?7 onwards. A movie matches
+// the genre filter only if it has every one of the requested genres.
+//
+// SQLite searches the FTS5 index in the movies_fts table. PostgreSQL matches the title
+// against a tsquery, which uses the GIN index on the same to_tsvector() expression.
+// LIKE ignores case in SQLite, so PostgreSQL uses ILIKE to filter titles the same way.
+func movieListFilter(d Dialect, search string, genreCount int) string {
+	from, match, like := "movies", "", "LIKE"
+	switch {
+	case d == Postgres:
+		like = "ILIKE"
+		if search != "" {
+			match = "AND to_tsvector('english', movies.title) @@ to_tsquery('english', ?3)"
+		}
+	case search != "":
+		from = "movies INNER JOIN movies_fts ON movies_fts.rowid = movies.id"
+		match = "AND movies_fts MATCH ?3"
+	}
+	genres := ""
+	if genreCount > 0 {
+		genres = fmt.Sprintf(`AND movies.id IN (
+		SELECT movies_genres.movie_id
+		FROM movies_genres
+		INNER JOIN genres ON genres.id = movies_genres.genre_id
+		WHERE genres.name IN (%s)
+		GROUP BY movies_genres.movie_id
+		HAVING count(*) = ?2)`, placeholders(7, genreCount))
+	}
+	return fmt.Sprintf(`FROM %s
+	WHERE (movies.title %s '%%' || ?1 || '%%' OR ?1 = '')
+	  %s
+	  %s`, from, like, genres, match)
+}
+
+// movieOrderColumn maps a sort column of the offset listing to the column to order by.
+// Sorting by relevance uses the bm25 rank of the full-text match, where lower is
+// better.
+func movieOrderColumn(column string) string {
+	if column == "relevance" {
+		return "sort_rank"
+	}
+	return column
+}
+
+// movieRank returns the expression for the relevance of a row, falling back to a
+// constant when there is nothing to rank so that the id tie-breaker decides. The
+// PostgreSQL ts_rank() is higher for better matches, so it is negated to sort like the
+// FTS5 rank.
+func movieRank(d Dialect, search string) string {
+	switch {
+	case search == "":
+		return "0"
+	case d == Postgres:
+		return "-ts_rank(to_tsvector('english', movies.title), to_tsquery('english', ?3))"
+	default:
+		return "movies_fts.rank"
+	}
+}
+
+// searchQuery turns free-form user input into a full-text query for the dialect.
+func searchQuery(d Dialect, search string) string {
+	if d == Postgres {
+		return tsQuery(search)
+	}
+	return ftsQuery(search)
+}
+
+// ftsQuery turns free-form user input into an FTS5 query. Double-quoted parts are kept
+// as phrases and a trailing * on a word makes it a prefix query; everything else is
+// split into words which must all match. Each word or phrase is quoted, so characters
+// with a special meaning in the FTS5 query syntax can't cause a syntax error.
+func ftsQuery(search string) string {
+	var terms []string
+	for i, part := range strings.Split(search, `"`) {
+		// Every odd part was enclosed in double quotes.
+		if i%2 == 1 {
+			if words := strings.Fields(part); len(words) > 0 {
+				terms = append(terms, `"`+strings.Join(words, " ")+`"`)
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			prefix := strings.HasSuffix(word, "*")
+			word = strings.Trim(word, "*")
+			if word == "" {
+				continue
+			}
+			term := `"` + word + `"`
+			if prefix {
+				term += "*"
+			}
+			terms = append(terms, term)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// A searchTerm is a word or a double-quoted phrase of a search, split into runs of
+// letters and digits. A word with a trailing * is a prefix match on its last lexeme.
+type searchTerm struct {
+	lexemes []string
+	prefix  bool
+}
+
+// parseSearch splits free-form user input into search terms, following the same rules
+// as ftsQuery(). Only the letters and digits of the input are kept, so a word like
+// "sci-fi" becomes a phrase of two lexemes, just as the full-text parsers split it when
+// indexing the title.
+func parseSearch(search string) []searchTerm {
+	var terms []searchTerm
+	for i, part := range strings.Split(search, `"`) {
+		// Every odd part was enclosed in double quotes.
+		if i%2 == 1 {
+			if lexemes := tsLexemes(part); len(lexemes) > 0 {
+				terms = append(terms, searchTerm{lexemes: lexemes})
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			if lexemes := tsLexemes(word); len(lexemes) > 0 {
+				terms = append(terms, searchTerm{lexemes: lexemes, prefix: strings.HasSuffix(word, "*")})
+			}
+		}
+	}
+	return terms
+}
+
+// tsQuery turns free-form user input into a PostgreSQL tsquery. Terms must all match, a
+// phrase becomes a chain of <-> (followed by) operators and a prefix match ends in :*.
+// Leaving out everything but letters and digits also keeps out the characters which
+// have a meaning in the tsquery syntax.
+func tsQuery(search string) string {
+	var terms []string
+	for _, term := range parseSearch(search) {
+		lexemes := term.lexemes
+		if term.prefix {
+			lexemes[len(lexemes)-1] += ":*"
+		}
+		terms = append(terms, "("+strings.Join(lexemes, " <-> ")+")")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// tsLexemes splits text into runs of letters and digits.
+func tsLexemes(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// getAllKeyset returns a page of movies positioned by a cursor rather than an offset.
+// The cursor holds the sort value and id of the row the page starts after (or ends
+// before), so the query only ever has to seek to that position in the index, and rows
+// inserted or deleted on earlier pages don't shift the results.
+func (m MovieModel) getAllKeyset(ctx context.Context, title string, genres []string, search string, filter Filters) ([]*Movie, Metadata, error) {
+	column, direction := filter.sortColumn(), filter.sortDirection()
+	cursor, backward := filter.After, false
+	if filter.Before != nil {
+		cursor, backward = filter.Before, true
+	}
+	// When paging backwards we walk the index in the opposite order and reverse the
+	// rows afterwards. The id tie-breaker is always ascending in the page order, so it
+	// flips along with the sort column.
+	order, idOrder := direction, "ASC"
+	if backward {
+		order, idOrder = reverseDirection(direction), "DESC"
+	}
+	args := []any{title, len(genres), search, filter.limit() + 1, nil, nil}
+	seek := ""
+	if cursor != nil {
+		key, err := movieSortArg(column, cursor.Key)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		cmp, idCmp := ">", ">"
+		if order == "DESC" {
+			cmp = "<"
+		}
+		if idOrder == "DESC" {
+			idCmp = "<"
+		}
+		seek = fmt.Sprintf("AND (movies.%[1]s %[2]s ?5 OR (movies.%[1]s = ?5 AND movies.id %[3]s ?6))", column, cmp, idCmp)
+		args[4], args[5] = key, cursor.ID
+	}
+	args = append(args, stringsToAny(genres)...)
+	// We fetch one row more than the page size to find out whether there is another
+	// page after this one without running a separate count query.
+	query := fmt.Sprintf(`
+	SELECT %s
+	%s
+	  %s
+	ORDER BY movies.%s %s, movies.id %s
+	LIMIT ?4`, movieListColumns(m.DB.Dialect, search), movieListFilter(m.DB.Dialect, search, len(genres)), seek, column, order, idOrder)
+
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	movies := []*Movie{}
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.Version,
+			&movie.TitleHighlight,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		movie.TitleHighlight = highlightHTML(movie.TitleHighlight)
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	hasMore := len(movies) > filter.limit()
+	if hasMore {
+		movies = movies[:filter.limit()]
+	}
+	if err = m.attachGenres(ctx, movies); err != nil {
+		return nil, Metadata{}, err
+	}
+	if backward {
+		for i, j := 0, len(movies)-1; i < j; i, j = i+1, j-1 {
+			movies[i], movies[j] = movies[j], movies[i]
+		}
+	}
+	return movies, keysetMetadata(filter, movies, hasMore, backward, cursor != nil), nil
+}
+
+// keysetMetadata returns the metadata for a page of a keyset listing, with cursors
+// pointing past either end of it where there are more rows. hasMore reports whether
+// there were rows beyond the page in the direction it was read, and fromCursor whether
+// the listing was positioned with a cursor.
+func keysetMetadata(filter Filters, movies []*Movie, hasMore, backward, fromCursor bool) Metadata {
+	metadata := Metadata{PageSize: filter.PageSize}
+	if len(movies) == 0 {
+		return metadata
+	}
+	column := filter.sortColumn()
+	first, last := movies[0], movies[len(movies)-1]
+	// Going forwards there is a previous page whenever we started from a cursor, and a
+	// next page if the extra row came back. Going backwards it's the other way round.
+	if (!backward && hasMore) || (backward && fromCursor) {
+		metadata.Next = &Cursor{Sort: filter.Sort, Key: movieSortKey(column, last), ID: last.ID}
+	}
+	if (!backward && fromCursor) || (backward && hasMore) {
+		metadata.Prev = &Cursor{Sort: filter.Sort, Key: movieSortKey(column, first), ID: first.ID}
+	}
+	return metadata
+}
+
+func reverseDirection(direction string) string {
+	if direction == "DESC" {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+// movieSortKey returns the value of a sort column for a movie, formatted for storing
+// in a cursor.
+func movieSortKey(column string, movie *Movie) string {
+	switch column {
+	case "title":
+		return movie.Title
+	case "year":
+		return strconv.Itoa(int(movie.Year))
+	case "runtime":
+		return strconv.Itoa(int(movie.Runtime))
+	default:
+		return strconv.Itoa(movie.ID)
+	}
+}
+
+// movieSortArg converts a cursor key back into a query argument of the right type for
+// the sort column.
+func movieSortArg(column, key string) (any, error) {
+	if column == "title" {
+		return key, nil
+	}
+	n, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return n, nil
+}
+
+// attachGenres loads the genres of a page of movies with a single query.
+func (m MovieModel) attachGenres(ctx context.Context, movies []*Movie) error {
+	genres, err := movieGenres(ctx, m.DB, movies)
+	if err != nil {
+		return err
+	}
+	for _, movie := range movies {
+		movie.Genres = genres[movie.ID]
+	}
+	return nil
+}
+
+// placeholders returns a comma-separated list of n numbered placeholders, starting at
+// ?start.
+func placeholders(start, n int) string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = "?" + strconv.Itoa(start+i)
+	}
+	return strings.Join(list, ", ")
+}
+
+func stringsToAny(values []string) []any {
+	args := make([]any, len(values))
+	for i, value := range values {
+		args[i] = value
 	}
-	return movies, nil
+	return args
 }
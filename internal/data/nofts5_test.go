@@ -0,0 +1,23 @@
+//go:build !sqlite_fts5
+
+package data
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// Without the sqlite_fts5 tag only the dialect tests run, as SQLite can't be migrated.
+// Check that this is reported clearly, rather than by the migrations failing halfway.
+func TestCheckFTS5(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CheckFTS5(context.Background()); !errors.Is(err, ErrNoFTS5) {
+		t.Errorf("got %v, want ErrNoFTS5", err)
+	}
+}
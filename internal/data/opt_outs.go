@@ -0,0 +1,78 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// EmailOptOutModel records the categories of non-transactional email which users don't
+// want to receive. The categories themselves belong to the mailer, so it is up to the
+// callers to check them.
+type EmailOptOutModel struct {
+	DB *DB
+}
+
+// GetAllForUser returns the categories a user has opted out of, sorted.
+func (m EmailOptOutModel) GetAllForUser(ctx context.Context, userID int) ([]string, error) {
+	query := `
+	SELECT category
+	FROM email_opt_outs
+	WHERE user_id = ?
+	ORDER BY category`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	categories := []string{}
+	for rows.Next() {
+		var category string
+		if err := rows.Scan(&category); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+// AddForUser opts a user out of the categories. Categories the user has already opted
+// out of are left as they are.
+func (m EmailOptOutModel) AddForUser(ctx context.Context, userID int, categories ...string) error {
+	categories = uniqueStrings(categories)
+	if len(categories) == 0 {
+		return nil
+	}
+	values := make([]string, len(categories))
+	for i := range categories {
+		values[i] = fmt.Sprintf("(?1, ?%d)", i+2)
+	}
+	query := fmt.Sprintf(`
+	INSERT INTO email_opt_outs (user_id, category)
+	VALUES %s
+	ON CONFLICT DO NOTHING`, strings.Join(values, ", "))
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, append([]any{userID}, stringsToAny(categories)...)...)
+	return err
+}
+
+// RemoveForUser opts a user back in to the categories.
+func (m EmailOptOutModel) RemoveForUser(ctx context.Context, userID int, categories ...string) error {
+	if len(categories) == 0 {
+		return nil
+	}
+	query := fmt.Sprintf(`
+	DELETE FROM email_opt_outs
+	WHERE user_id = ?1
+	AND category IN (%s)`, placeholders(2, len(categories)))
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, append([]any{userID}, stringsToAny(categories)...)...)
+	return err
+}
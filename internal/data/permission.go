@@ -2,11 +2,13 @@ package data
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
-	"time"
 )
 
+// Define an error for permission codes which don't exist in the permissions table.
+var ErrUnknownPermission = errors.New("unknown permission")
+
 // Define a Permissions slice, which we will use to hold the permission codes (like
 // "movies:read" and "movies:write") for a single user.
 type Permissions []string
@@ -22,32 +24,93 @@ func (p Permissions) Include(code string) bool {
 	return false
 }
 
+// IncludeAll reports whether the slice contains every one of the given codes.
+func (p Permissions) IncludeAll(codes ...string) bool {
+	for _, code := range codes {
+		if !p.Include(code) {
+			return false
+		}
+	}
+	return true
+}
+
+// IncludeAny reports whether the slice contains at least one of the given codes.
+func (p Permissions) IncludeAny(codes ...string) bool {
+	for _, code := range codes {
+		if p.Include(code) {
+			return true
+		}
+	}
+	return false
+}
+
 // Define the PermissionModel type
 
 type PermissionModel struct {
-	DB *sql.DB
+	DB    *DB
+	Cache *AccessCache
 }
 
 // The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice. The code in this method should feel very familiar --- it uses the
-// standard pattern that we've already seen before for retrieving multiple data rows in
-// an SQL query
-func (m PermissionModel) GetAllForUser(userId int) (Permissions, error) {
+// Permissions slice. A user holds the permissions granted to them directly as well as
+// those of each of their roles, so the query combines both with a UNION, which also
+// removes the duplicates.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userId int) (Permissions, error) {
 	query := `
 	SELECT permissions.code
 	FROM permissions
 	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-	INNER JOIN users ON users_permissions.user_id = users.id
-	WHERE users.id = ?`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	WHERE users_permissions.user_id = ?1
+	UNION
+	SELECT permissions.code
+	FROM permissions
+	INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+	INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+	WHERE users_roles.user_id = ?1
+	ORDER BY 1`
+	return m.queryCodes(ctx, query, userId)
+}
+
+// The GetAccessForUser() method returns the roles and permissions of a user, from the
+// cache when possible.
+func (m PermissionModel) GetAccessForUser(ctx context.Context, user *User) (Access, error) {
+	if access, ok := m.Cache.get(user.ID, user.Version); ok {
+		return access, nil
+	}
+	roles, err := RoleModel{DB: m.DB}.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return Access{}, err
+	}
+	permissions, err := m.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return Access{}, err
+	}
+	access := Access{Roles: roles, Permissions: permissions}
+	m.Cache.set(user.ID, user.Version, access)
+	return access, nil
+}
+
+// The GetDirectForUser() method returns only the permission codes granted to the user
+// directly, leaving out those they hold through a role.
+func (m PermissionModel) GetDirectForUser(ctx context.Context, userID int) (Permissions, error) {
+	query := `
+	SELECT permissions.code
+	FROM permissions
+	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+	WHERE users_permissions.user_id = ?
+	ORDER BY permissions.code`
+	return m.queryCodes(ctx, query, userID)
+}
+
+func (m PermissionModel) queryCodes(ctx context.Context, query string, args ...any) (Permissions, error) {
+	ctx, cancel := m.DB.withTimeout(ctx)
 	defer cancel()
-	rows, err := m.DB.QueryContext(ctx, query, userId)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		fmt.Println("shfvsdhkfbskdjf")
 		return nil, err
 	}
 	defer rows.Close()
-	var permissions Permissions
+	permissions := Permissions{}
 	for rows.Next() {
 		permission := ""
 		err := rows.Scan(&permission)
@@ -64,13 +127,82 @@ func (m PermissionModel) GetAllForUser(userId int) (Permissions, error) {
 
 // Add the provided permission codes for a specific user. Notice that we're using a
 // variadic parameter for the codes so that we can assign multiple permissions in a
-// single call.
-func (m PermissionModel) AddForUser(userID int, codes string) error {
-	query := `
-	INSERT INTO users_permissions
-	SELECT ?1, permissions.id FROM permissions WHERE permissions.code IN (?2);`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// single call. If any of the codes doesn't exist, nothing is granted and
+// ErrUnknownPermission is returned. Codes the user already holds are left as they are.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int, codes ...string) error {
+	defer m.DB.afterCommit(func() { m.Cache.Invalidate(userID) })
+	return grantForUser(ctx, m.DB, userID, uniqueStrings(codes), grantQueries{
+		count:  `SELECT count(*) FROM permissions WHERE code IN (%s)`,
+		insert: `INSERT INTO users_permissions (user_id, permission_id) SELECT CAST(?1 AS BIGINT), id FROM permissions WHERE code IN (%s) ON CONFLICT DO NOTHING`,
+	}, ErrUnknownPermission)
+}
+
+// Remove the provided permission codes from the ones granted directly to a user.
+// Permissions held through a role are not affected.
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int, codes ...string) error {
+	if len(codes) == 0 {
+		return nil
+	}
+	query := fmt.Sprintf(`
+	DELETE FROM users_permissions
+	WHERE user_id = ?1
+	AND permission_id IN (SELECT id FROM permissions WHERE code IN (%s))`, placeholders(2, len(codes)))
+	ctx, cancel := m.DB.withTimeout(ctx)
 	defer cancel()
-	_, err := m.DB.ExecContext(ctx, query, userID, codes)
+	_, err := m.DB.ExecContext(ctx, query, append([]any{userID}, stringsToAny(codes)...)...)
+	m.DB.afterCommit(func() { m.Cache.Invalidate(userID) })
 	return err
 }
+
+// grantQueries holds the two statements grantForUser() runs: one counting how many of
+// the given names exist, and one inserting the grants. Both take the names from ?2
+// onwards, with %s standing in for their placeholders.
+type grantQueries struct {
+	count  string
+	insert string
+}
+
+// grantForUser grants a set of named permissions or roles to a user inside a
+// transaction, so that a request with an unknown name doesn't grant the others. The
+// insert statement should skip the grants which already exist with ON CONFLICT DO
+// NOTHING, which both SQLite and PostgreSQL understand.
+func grantForUser(ctx context.Context, db *DB, userID int, names []string, queries grantQueries, errUnknown error) error {
+	if len(names) == 0 {
+		return nil
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	args := stringsToAny(names)
+	var count int
+	// The count query only uses the names, which in it start at ?1.
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(queries.count, placeholders(1, len(names))), args...).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != len(names) {
+		return errUnknown
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(queries.insert, placeholders(2, len(names))), append([]any{userID}, args...)...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// uniqueStrings returns the values with duplicates removed, keeping their order.
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Define an error for role names which don't exist in the roles table.
+var ErrUnknownRole = errors.New("unknown role")
+
+// A Role groups a set of permission codes under a name, like "editor", so that they can
+// be granted to and revoked from a user together.
+type Role struct {
+	ID          int         `json:"-"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// Define the RoleModel type which wraps the connection pool.
+type RoleModel struct {
+	DB    *DB
+	Cache *AccessCache
+}
+
+// GetAll returns every role along with the permission codes it grants.
+func (m RoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	query := `
+	SELECT roles.id, roles.name, permissions.code
+	FROM roles
+	LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+	LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+	ORDER BY roles.name, permissions.code`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	// The query returns a row per role and permission, ordered by role, so start a new
+	// Role each time the id changes.
+	roles := []*Role{}
+	for rows.Next() {
+		var (
+			role Role
+			code sql.NullString
+		)
+		err := rows.Scan(&role.ID, &role.Name, &code)
+		if err != nil {
+			return nil, err
+		}
+		if len(roles) == 0 || roles[len(roles)-1].ID != role.ID {
+			role.Permissions = Permissions{}
+			roles = append(roles, &role)
+		}
+		if code.Valid {
+			last := roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, code.String)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetAllForUser returns the names of the roles granted to a specific user.
+func (m RoleModel) GetAllForUser(ctx context.Context, userID int) ([]string, error) {
+	query := `
+	SELECT roles.name
+	FROM roles
+	INNER JOIN users_roles ON users_roles.role_id = roles.id
+	WHERE users_roles.user_id = ?
+	ORDER BY roles.name`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// AddForUser grants the named roles to a user. Just like PermissionModel.AddForUser(),
+// it grants nothing and returns ErrUnknownRole if any of the names doesn't exist.
+func (m RoleModel) AddForUser(ctx context.Context, userID int, roles ...string) error {
+	defer m.DB.afterCommit(func() { m.Cache.Invalidate(userID) })
+	return grantForUser(ctx, m.DB, userID, uniqueStrings(roles), grantQueries{
+		count:  `SELECT count(*) FROM roles WHERE name IN (%s)`,
+		insert: `INSERT INTO users_roles (user_id, role_id) SELECT CAST(?1 AS BIGINT), id FROM roles WHERE name IN (%s) ON CONFLICT DO NOTHING`,
+	}, ErrUnknownRole)
+}
+
+// RemoveForUser revokes the named roles from a user.
+func (m RoleModel) RemoveForUser(ctx context.Context, userID int, roles ...string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	query := fmt.Sprintf(`
+	DELETE FROM users_roles
+	WHERE user_id = ?1
+	AND role_id IN (SELECT id FROM roles WHERE name IN (%s))`, placeholders(2, len(roles)))
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, append([]any{userID}, stringsToAny(roles)...)...)
+	m.DB.afterCommit(func() { m.Cache.Invalidate(userID) })
+	return err
+}
@@ -1,11 +1,14 @@
 package data
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"time"
 
 	"forum/internal/validator"
@@ -15,20 +18,58 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
 )
 
+// sessionTouchInterval is how long after its last recorded use an authentication token
+// has to be used again for the use to be recorded, so that a client sending a burst of
+// requests doesn't cause a write for every one of them.
+const sessionTouchInterval = time.Minute
+
 // Define a Token struct to hold the data for an individual token. This includes the
 // plaintext and hashed versions of the token, associated user ID, expiry time and
-// scope.
+// scope. Authentication and refresh tokens also record the user agent and IP address
+// of the client they were issued to. The tokens which stem from the same sign-in share
+// a family: a refresh token hands its family on to the token which replaces it, and is
+// kept as rotated so that its reuse can be spotted.
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
+	ID        int       `json:"-"`
 	UserId    int       `json:"-"`
+	CreatedAt time.Time `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+	Family    string    `json:"-"`
+	Rotated   bool      `json:"-"`
+}
+
+// A Session is an authentication or refresh token as its user sees it when managing
+// the devices they are signed in on. It leaves out the token itself, which is only ever
+// shown to the client it was issued to. The IP address is the one the token was last
+// used from.
+type Session struct {
+	ID         int       `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Expiry     time.Time `json:"expiry"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+	hash       []byte
 }
+
+// IsToken reports whether the session is the one of the given plaintext token.
+func (s *Session) IsToken(tokenPlaintext string) bool {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return bytes.Equal(s.hash, hash[:])
+}
+
 type TokenModel struct {
-	DB *sql.DB
+	DB *DB
 }
 
 func ValidateTokenPlainText(v *validator.Validator, tokenPlainText string) {
@@ -67,38 +108,254 @@ func generateToken(userId int, ttl time.Duration, scope string) (*Token, error)
 	// work with we convert it to a slice using the [:] operator before storing it
 	hash := sha256.Sum256([]byte(token.Plaintext))
 	token.Hash = hash[:]
+	// A new token starts a family of its own.
+	token.Family = hex.EncodeToString(token.Hash)
 	return token, nil
 }
 
-func (t TokenModel) New(userId int, ttl time.Duration, scope string) (*Token, error) {
+func (t TokenModel) New(ctx context.Context, userId int, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userId, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
-	err = t.Insert(token)
+	err = t.Insert(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// NewSession creates an authentication or refresh token, depending on the scope, for a
+// client signing in with the given user agent from the given IP address.
+func (m TokenModel) NewSession(ctx context.Context, scope string, userID int, ttl time.Duration, userAgent, ip string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	token.UserAgent = userAgent
+	token.IP = ip
+	err = m.Insert(ctx, token)
 	if err != nil {
 		return nil, err
 	}
 	return token, nil
 }
 
-func (m TokenModel) Insert(token *Token) error {
+// Insert stores the token, and sets its ID. The creation time is now, unless the token
+// already has one.
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
-	INSERT INTO tokens (hash,user_id,expiry,scope)
-	VALUES (?,?,?,?)`
-	args := []any{token.Hash, token.UserId, token.Expiry, token.Scope}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	INSERT INTO tokens (hash,user_id,expiry,scope,created_at,last_used_at,user_agent,ip,family)
+	VALUES (?,?,?,?,?,?,?,?,?)
+	RETURNING id`
+	now := time.Now()
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = now
+	}
+	args := []any{token.Hash, token.UserId, token.Expiry, token.Scope, token.CreatedAt, now, token.UserAgent, token.IP, token.Family}
+	ctx, cancel := m.DB.withTimeout(ctx)
 	defer cancel()
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&token.ID)
 }
 
-func (m TokenModel) DeleteAllForUser(scope string, userID int) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int) error {
 	query := `
 	DELETE FROM tokens
 	WHERE scope = ? AND user_id = ?`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withTimeout(ctx)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// Delete deletes the token with the given plaintext and scope. It is not an error if
+// there is no such token.
+func (m TokenModel) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	query := `
+	DELETE FROM tokens
+	WHERE hash = ? AND scope = ?`
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, hash[:], scope)
+	return err
+}
+
+// Touch records that the authentication token with the given plaintext was just used
+// from the IP address, and slides its expiry to ttl from now. To save writes, a use
+// within a minute of the last recorded one is left out.
+func (m TokenModel) Touch(ctx context.Context, tokenPlaintext string, ttl time.Duration, ip string) error {
+	query := `
+	UPDATE tokens
+	SET last_used_at = ?, expiry = ?, ip = ?
+	WHERE hash = ? AND scope = ? AND last_used_at < ?`
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	now := time.Now()
+	args := []any{now, now.Add(ttl), ip, hash[:], ScopeAuthentication, now.Add(-sessionTouchInterval)}
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetSessionsForUser returns the tokens of the scope, authentication or refresh, which a
+// user has signed in with and which haven't expired or been rotated, most recently used
+// first.
+func (m TokenModel) GetSessionsForUser(ctx context.Context, scope string, userID int) ([]*Session, error) {
+	query := `
+	SELECT id, created_at, last_used_at, expiry, user_agent, ip, hash
+	FROM tokens
+	WHERE user_id = ? AND scope = ? AND expiry > ? AND rotated_at IS NULL
+	ORDER BY last_used_at DESC, id DESC`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, scope, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+			&session.hash,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteSession deletes the token of the scope with the given id, as long as it belongs
+// to the user, along with the rest of its family. It returns ErrRecordNotFound if there
+// is no such token.
+func (m TokenModel) DeleteSession(ctx context.Context, scope string, userID, id int) error {
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = ?1 AND scope = ?2 AND family IN (
+		SELECT family FROM tokens WHERE id = ?3 AND user_id = ?1 AND scope = ?2
+	)`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, scope, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetRefreshToken returns the refresh token with the given plaintext, if it hasn't
+// expired. A token which has already been rotated is returned too, with Rotated set,
+// as using it again is a sign that it was stolen. It returns ErrRecordNotFound if
+// there is no such token.
+func (m TokenModel) GetRefreshToken(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	query := `
+	SELECT id, user_id, created_at, expiry, user_agent, ip, family, rotated_at IS NOT NULL
+	FROM tokens
+	WHERE hash = ? AND scope = ? AND expiry > ?`
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	token := Token{Plaintext: tokenPlaintext, Hash: hash[:], Scope: ScopeRefresh}
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash[:], ScopeRefresh, time.Now()).Scan(
+		&token.ID,
+		&token.UserId,
+		&token.CreatedAt,
+		&token.Expiry,
+		&token.UserAgent,
+		&token.IP,
+		&token.Family,
+		&token.Rotated,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+// Rotate marks the refresh token as rotated and returns the new refresh token of its
+// family which replaces it, used from the given IP address and valid for ttl. It
+// returns ErrEditConflict if the token has already been rotated, which happens when
+// it is used twice at the same time. Run it in a unit of work, so that a failure to
+// store the new token doesn't leave the family without one.
+func (m TokenModel) Rotate(ctx context.Context, token *Token, ttl time.Duration, ip string) (*Token, error) {
+	query := `
+	UPDATE tokens
+	SET rotated_at = ?
+	WHERE id = ? AND rotated_at IS NULL`
+	queryCtx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	result, err := m.DB.ExecContext(queryCtx, query, time.Now(), token.ID)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrEditConflict
+	}
+	next, err := generateToken(token.UserId, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	next.Family = token.Family
+	next.CreatedAt = token.CreatedAt
+	next.UserAgent = token.UserAgent
+	next.IP = ip
+	err = m.Insert(ctx, next)
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// DeleteFamily deletes every token of a family.
+func (m TokenModel) DeleteFamily(ctx context.Context, family string) error {
+	query := `
+	DELETE FROM tokens
+	WHERE family = ?`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// DeleteExpired deletes the tokens of every scope which have expired, and returns how
+// many there were.
+func (m TokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+	DELETE FROM tokens
+	WHERE expiry <= ?`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 
 	"forum/internal/validator"
@@ -18,15 +19,18 @@ var AnonymousUser = &User{}
 // Define a User struct to represent an individual user. Importantly, notice how we are
 // using the json:"-" struct tag to prevent the Password and Version fields appearing in
 // any output when we encode it to JSON. Also notice that the Password field uses the
-// custom password type defined below.
+// custom password type defined below. PendingEmail is the address the user asked to
+// change their email to, until they confirm it.
 type User struct {
-	ID        int       `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID           int       `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	PendingEmail string    `json:"pending_email,omitempty"`
+	Password     password  `json:"-"`
+	Activated    bool      `json:"activated"`
+	Locale       string    `json:"locale"`
+	Version      int       `json:"-"`
 }
 
 // Check if a user instance is the AnonymousUser
@@ -50,7 +54,8 @@ var (
 
 // Create a UserModel struct which wraps the connection pool
 type UserModel struct {
-	DB *sql.DB
+	DB    *DB
+	Cache *AccessCache
 }
 
 // The Set() method calculates the bcrypt hash of a plaintext password, and stores both
@@ -92,6 +97,12 @@ func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
 }
 
+// ValidateLocale checks the locale a user chose for their emails, which must be one of
+// the supported locales, or empty to leave the choice to the Accept-Language header.
+func ValidateLocale(v *validator.Validator, locale string, supported []string) {
+	v.Check(locale == "" || validator.PermittedValue(locale, supported...), "locale", "must be one of "+strings.Join(supported, ", "))
+}
+
 func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
@@ -112,22 +123,22 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
-	INSERT INTO users (name, email, password_hash, activated)
-	VALUES (?, ?, ?, ?)
+	INSERT INTO users (name, email, password_hash, activated, locale)
+	VALUES (?, ?, ?, ?, ?)
 	RETURNING id,created_at,version`
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.Locale}
+	ctx, cancel := m.DB.withTimeout(ctx)
 	defer cancel()
 	// If the table already contains a record with this email address, then when we try
-	// to perform the insert there will be a violation of the UNIQUE "users_email_key"
-	// constraint that we set up in the previous chapter. We check for this error
+	// to perform the insert there will be a violation of the UNIQUE constraint on the
+	// email column that we set up in the previous chapter. We check for this error
 	// specifically, and return custom ErrDuplicateEmail error instead.
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `UNIQUE constraint failed`:
+		case isUniqueViolation(err):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -136,24 +147,57 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Retrieve the User details from the database based on the user's id.
+func (m UserModel) Get(ctx context.Context, id int) (*User, error) {
+	query := `
+	SELECT id, created_at, name, email, pending_email, password_hash, activated, locale, version
+	FROM users
+	WHERE id = ?`
+	var user User
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
-	SELECT id, created_at, name, email, password_hash, activated, version
+	SELECT id, created_at, name, email, pending_email, password_hash, activated, locale, version
 	FROM users
 	WHERE email = ?`
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withTimeout(ctx)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locale,
 		&user.Version,
 	)
 	if err != nil {
@@ -169,29 +213,34 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 // Update the details for a specific user. Notice that we check against the version
 // field to help prevent any race conditions during the request cycle, just like we did
-// when updating a movie. And we also check for a violation of the "users_email_key"
-// constraint when performing the update, just like we did when inserting the user
-// record originally.
-func (m UserModel) Update(user *User) error {
+// when updating a movie. And we also check for a violation of the UNIQUE constraint on
+// the email column when performing the update, just like we did when inserting the
+// user record originally.
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 	UPDATE users
-	SET name = ?, email = ?, password_hash = ?, activated = ?, version = version + 1
+	SET name = ?, email = ?, pending_email = ?, password_hash = ?, activated = ?, locale = ?, version = version + 1
 	WHERE id = ? AND version = ?
 	RETURNING version`
 	args := []any{
 		user.Name,
 		user.Email,
+		user.PendingEmail,
 		user.Password.hash,
 		user.Activated,
+		user.Locale,
 		user.ID,
 		user.Version,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withTimeout(ctx)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	// The version has changed, so a cached entry would miss anyway. Drop it as soon as
+	// the change is committed rather than leaving it to expire.
+	m.DB.afterCommit(func() { m.Cache.Invalidate(user.ID) })
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isUniqueViolation(err):
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
@@ -202,26 +251,50 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlainText string) (*User, error) {
+// Delete removes a user, along with their tokens, roles and everything else which
+// belongs to them. Like Update(), it returns ErrEditConflict if the user has changed
+// since the version in the struct was read, or no longer exists.
+func (m UserModel) Delete(ctx context.Context, user *User) error {
+	query := `
+	DELETE FROM users
+	WHERE id = ? AND version = ?`
+	ctx, cancel := m.DB.withTimeout(ctx)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, user.ID, user.Version)
+	if err != nil {
+		return err
+	}
+	m.DB.afterCommit(func() { m.Cache.Invalidate(user.ID) })
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlainText string) (*User, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	// Remember that this returns a byte *array* with length 32, not a slice
 	tokenHash := sha256.Sum256([]byte(tokenPlainText))
 	// Set up the SQL query
 	query := `
-	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+	SELECT users.id, users.created_at, users.name, users.email, users.pending_email, users.password_hash, users.activated, users.locale, users.version
 	FROM users
 	INNER JOIN tokens
 	ON users.id = tokens.user_id
 	WHERE tokens.hash = ?
 	AND tokens.scope = ?
-	AND tokens.expiry > datetime(?);`
+	AND tokens.expiry > ?`
 	// Create a slice containing the query arguments. Notice how we use the [:] operator
 	// to get a slice containing the token hash, rather than passing in the array (which
 	// is not supported by the pq driver), and that we pass the current time as the
 	// value to check against the token expiry
 	args := []any{tokenHash[:], tokenScope, time.Now()}
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withTimeout(ctx)
 	defer cancel()
 	// Execute the query, scanning the return values into a User struct. If no matching
 	// record is found we return an ErrRecordNotFound error.
@@ -230,8 +303,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlainText string) (*User, error)
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locale,
 		&user.Version,
 	)
 	if err != nil {
@@ -2,10 +2,13 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,89 +18,192 @@ type Level int8
 // Initialize constants which represent a specific severity level. We use the iota
 // keyword as a shortcut to assign successive integer values to the constants.
 const (
-	LevelInfo Level = iota // Has the value 0.
-	LevelError
-	// Has the value 1.
-	LevelFatal
-	LevelOff
-
-// Has the value 2.
-// Has the value 3.
+	LevelDebug Level = iota // Has the value 0.
+	LevelInfo               // Has the value 1.
+	LevelWarn               // Has the value 2.
+	LevelError              // Has the value 3.
+	LevelFatal              // Has the value 4.
+	LevelOff                // Has the value 5.
 )
 
 // Return a human-friendly string for the severity level.
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
-// Define a custom Logger type. This holds the output destination that the log entries
-// will be written to, the minimum severity level that log entries will be written for,
-// plus a mutex for coordinating the writes.
+// MarshalText encodes the level as its lowercase name, so that it reads the same in
+// JSON as in the -log-level flag.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(strings.ToLower(l.String())), nil
+}
+
+// UnmarshalText decodes a level name, using ParseLevel().
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// ParseLevel returns the level with the given name, ignoring case.
+func ParseLevel(name string) (Level, error) {
+	for level := LevelDebug; level <= LevelOff; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Fields holds the properties of a log entry. The values can be of any type which
+// encoding/json can marshal, including nested maps and structs. A time.Duration is
+// written as a string like "1.5s" and an error as its message, rather than as the
+// unhelpful values encoding/json would produce for them.
+type Fields map[string]any
+
+// Define a custom Logger type. A Logger writes log entries at or above a minimum
+// severity level to an output destination. Child loggers created with With() add
+// their own fields to every entry, but share everything else with their parent, so
+// changing the level of one changes it for all of them.
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	core   *core
+	fields Fields
+}
+
+// core is the state shared by a logger and all of its children: the output
+// destination plus a mutex for coordinating the writes, the minimum level, and the
+// settings for stack traces and sampling.
+type core struct {
+	out         io.Writer
+	mu          sync.Mutex
+	minLevel    atomic.Int32
+	stackTraces atomic.Bool
+	sampler     *sampler
 }
 
 // Return a new Logger instance which writes log entries at or above a minimum severity
 // level to a specific output destination.
 func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+	c := &core{out: out}
+	c.minLevel.Store(int32(minLevel))
+	return &Logger{core: c}
+}
+
+// With returns a child logger which adds the given fields to every entry it writes.
+// Fields passed to the Print methods take precedence over these.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{core: l.core, fields: merged}
+}
+
+// Level returns the current minimum severity level.
+func (l *Logger) Level() Level {
+	return Level(l.core.minLevel.Load())
+}
+
+// SetLevel changes the minimum severity level. It is safe to call while other
+// goroutines are logging.
+func (l *Logger) SetLevel(level Level) {
+	l.core.minLevel.Store(int32(level))
+}
+
+// SetStackTraces controls whether entries at the ERROR and FATAL levels include a
+// stack trace. They don't by default.
+func (l *Logger) SetStackTraces(enabled bool) {
+	l.core.stackTraces.Store(enabled)
+}
+
+// SetSampling limits how often the same message is written at the same level. Within
+// each tick, the first `first` entries are written, and after that only every
+// `thereafter`th one. A first of 0 switches sampling off. FATAL entries are never
+// sampled. SetSampling should be called before the logger is in use.
+func (l *Logger) SetSampling(tick time.Duration, first, thereafter int) {
+	if first <= 0 {
+		l.core.sampler = nil
+		return
+	}
+	l.core.sampler = &sampler{
+		tick:       tick,
+		first:      first,
+		thereafter: thereafter,
+		counts:     make(map[string]*sampleCount),
 	}
 }
 
 // Declare some helper methods for writing log entries at the different levels. Notice
-// that these all accept a map as the second parameter which can contain any arbitrary
-// 'properties' that you want to appear in the log entry.
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
-	l.print(LevelInfo, message, properties)
+// that these all accept a Fields map as the second parameter which can contain any
+// arbitrary 'properties' that you want to appear in the log entry.
+func (l *Logger) PrintDebug(message string, fields Fields) {
+	l.print(LevelDebug, message, fields)
+}
+
+func (l *Logger) PrintInfo(message string, fields Fields) {
+	l.print(LevelInfo, message, fields)
+}
+
+func (l *Logger) PrintWarn(message string, fields Fields) {
+	l.print(LevelWarn, message, fields)
 }
 
-func (l *Logger) PrintError(err error, properties map[string]string) {
-	l.print(LevelError, err.Error(), properties)
+func (l *Logger) PrintError(err error, fields Fields) {
+	l.print(LevelError, err.Error(), fields)
 }
 
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
-	l.print(LevelFatal, err.Error(), properties)
+func (l *Logger) PrintFatal(err error, fields Fields) {
+	l.print(LevelFatal, err.Error(), fields)
 	os.Exit(1) // For entries at the FATAL level, we also terminate the application.
 }
 
 // Print is an internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
+func (l *Logger) print(level Level, message string, fields Fields) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the
 	// logger, then return with no further action.
-	if level < l.minLevel {
+	if level < l.Level() {
+		return 0, nil
+	}
+	if level < LevelFatal && !l.core.sampler.allow(level, message) {
 		return 0, nil
 	}
 	// Declare an anonymous struct holding the data for the log entry.
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string         `json:"level"`
+		Time       string         `json:"time"`
+		Message    string         `json:"message"`
+		Properties map[string]any `json:"properties,omitempty"`
+		Trace      string         `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
-		Properties: properties,
+		Properties: l.properties(fields),
 	}
-	// Include a stack trace for entries at the ERROR and FATAL levels.
-	if level >= LevelError {
+	// Include a stack trace for entries at the ERROR and FATAL levels, if enabled.
+	if level >= LevelError && l.core.stackTraces.Load() {
 		aux.Trace = string(debug.Stack())
 	}
-	// Declare a line variable for holding the actual log entry text.
 	// Marshal the anonymous struct to JSON and store it in the line variable. If there
 	// was a problem creating the JSON, set the contents of the log entry to be that
 	// plain-text error message instead.
@@ -108,10 +214,32 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	// Lock the mutex so that no two writes to the output destination can happen
 	// concurrently. If we don't do this, it's possible that the text for two or more
 	// log entries will be intermingled in the output.
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
 	// Write the log entry followed by a newline.
-	return l.out.Write(append(line, '\n'))
+	return l.core.out.Write(append(line, '\n'))
+}
+
+// properties merges the fields of the logger with those of the entry, converting the
+// values which encoding/json doesn't handle well.
+func (l *Logger) properties(fields Fields) map[string]any {
+	if len(l.fields) == 0 && len(fields) == 0 {
+		return nil
+	}
+	properties := make(map[string]any, len(l.fields)+len(fields))
+	for _, source := range []Fields{l.fields, fields} {
+		for k, v := range source {
+			switch v := v.(type) {
+			case time.Duration:
+				properties[k] = v.String()
+			case error:
+				properties[k] = v.Error()
+			default:
+				properties[k] = v
+			}
+		}
+	}
+	return properties
 }
 
 // We also implement a Write() method on our Logger type so that it satisfies the
@@ -120,3 +248,51 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 func (l *Logger) Write(message []byte) (n int, err error) {
 	return l.print(LevelError, string(message), nil)
 }
+
+// A sampler counts the entries written for each level and message within the current
+// tick, to decide which of them to drop.
+type sampler struct {
+	tick       time.Duration
+	first      int
+	thereafter int
+	mu         sync.Mutex
+	counts     map[string]*sampleCount
+	swept      time.Time
+}
+
+type sampleCount struct {
+	start time.Time
+	n     int
+}
+
+// allow reports whether an entry should be written. A nil sampler allows everything.
+func (s *sampler) allow(level Level, message string) bool {
+	if s == nil {
+		return true
+	}
+	now := time.Now()
+	key := level.String() + "\x00" + message
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count, ok := s.counts[key]
+	if !ok || now.Sub(count.start) >= s.tick {
+		count = &sampleCount{start: now}
+		s.counts[key] = count
+	}
+	// Once per tick, drop the counts of messages which haven't been seen in the last
+	// one, so that messages with ids or other changing details in them don't make the
+	// map grow forever.
+	if now.Sub(s.swept) >= s.tick {
+		for k, c := range s.counts {
+			if now.Sub(c.start) >= s.tick {
+				delete(s.counts, k)
+			}
+		}
+		s.swept = now
+	}
+	count.n++
+	if count.n <= s.first {
+		return true
+	}
+	return s.thereafter > 0 && (count.n-s.first)%s.thereafter == 0
+}
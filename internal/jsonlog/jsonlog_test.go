@@ -0,0 +1,241 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type entry struct {
+	Level      string         `json:"level"`
+	Time       string         `json:"time"`
+	Message    string         `json:"message"`
+	Properties map[string]any `json:"properties"`
+	Trace      string         `json:"trace"`
+}
+
+// entries decodes the log entries written to buf, one JSON object per line.
+func entries(t *testing.T, buf *bytes.Buffer) []entry {
+	t.Helper()
+	var decoded []entry
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var e entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("decoding %q: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339, e.Time); err != nil {
+			t.Errorf("got time %q", e.Time)
+		}
+		decoded = append(decoded, e)
+	}
+	return decoded
+}
+
+func messages(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+	var got []string
+	for _, e := range entries(t, buf) {
+		got = append(got, e.Level+" "+e.Message)
+	}
+	return got
+}
+
+func TestLevels(t *testing.T) {
+	for _, tt := range []struct {
+		level Level
+		want  []string
+	}{
+		{LevelDebug, []string{"DEBUG d", "INFO i", "WARN w", "ERROR e"}},
+		{LevelInfo, []string{"INFO i", "WARN w", "ERROR e"}},
+		{LevelWarn, []string{"WARN w", "ERROR e"}},
+		{LevelError, []string{"ERROR e"}},
+		{LevelOff, nil},
+	} {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			// The level is changed after New, so this checks SetLevel too, and
+			// that a child logger follows the level of its parent.
+			logger := New(&buf, LevelFatal)
+			child := logger.With(Fields{"child": true})
+			logger.SetLevel(tt.level)
+			if got := child.Level(); got != tt.level {
+				t.Errorf("got child level %s", got)
+			}
+			child.PrintDebug("d", nil)
+			child.PrintInfo("i", nil)
+			child.PrintWarn("w", nil)
+			child.PrintError(errors.New("e"), nil)
+			if got := messages(t, &buf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]Level{"debug": LevelDebug, "WARN": LevelWarn, "Off": LevelOff} {
+		if got, err := ParseLevel(name); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %s, %v", name, got, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("got no error for an unknown level")
+	}
+	// Levels are written in JSON by name.
+	js, err := json.Marshal(map[string]Level{"level": LevelWarn})
+	if err != nil || string(js) != `{"level":"warn"}` {
+		t.Errorf("got %s, %v", js, err)
+	}
+}
+
+func TestFields(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		with   []Fields
+		fields Fields
+		want   map[string]any
+	}{
+		{"none", nil, nil, nil},
+		{"entry", nil, Fields{"id": 1}, map[string]any{"id": 1.0}},
+		{"with", []Fields{{"request_id": "a"}}, nil, map[string]any{"request_id": "a"}},
+		{
+			"nested with",
+			[]Fields{{"request_id": "a", "user": 1}, {"user": 2, "route": "/v1/movies"}},
+			nil,
+			map[string]any{"request_id": "a", "user": 2.0, "route": "/v1/movies"},
+		},
+		{
+			"entry overrides with",
+			[]Fields{{"request_id": "a", "user": 1}},
+			Fields{"user": 3},
+			map[string]any{"request_id": "a", "user": 3.0},
+		},
+		{
+			"typed values",
+			nil,
+			Fields{"took": 1500 * time.Millisecond, "err": errors.New("boom"), "tags": []string{"x"}},
+			map[string]any{"took": "1.5s", "err": "boom", "tags": []any{"x"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := New(&buf, LevelInfo)
+			for _, fields := range tt.with {
+				logger = logger.With(fields)
+			}
+			logger.PrintInfo("message", tt.fields)
+			got := entries(t, &buf)
+			if len(got) != 1 {
+				t.Fatalf("got %d entries", len(got))
+			}
+			if !reflect.DeepEqual(got[0].Properties, tt.want) {
+				t.Errorf("got properties %v, want %v", got[0].Properties, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithDoesNotChangeParent(t *testing.T) {
+	var buf bytes.Buffer
+	parent := New(&buf, LevelInfo).With(Fields{"a": 1})
+	parent.With(Fields{"a": 2, "b": 2})
+	parent.PrintInfo("message", nil)
+	if got := entries(t, &buf)[0].Properties; !reflect.DeepEqual(got, map[string]any{"a": 1.0}) {
+		t.Errorf("got properties %v", got)
+	}
+}
+
+func TestStackTraces(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+	logger.PrintError(errors.New("before"), nil)
+	logger.SetStackTraces(true)
+	logger.PrintWarn("warning", nil)
+	logger.PrintError(errors.New("after"), nil)
+	// Write() logs at the ERROR level too.
+	logger.Write([]byte("written"))
+
+	got := entries(t, &buf)
+	for i, want := range []bool{false, false, true, true} {
+		if hasTrace := strings.Contains(got[i].Trace, "TestStackTraces"); hasTrace != want {
+			t.Errorf("%s %q: got trace %q", got[i].Level, got[i].Message, got[i].Trace)
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	for _, tt := range []struct {
+		name              string
+		first, thereafter int
+		want              []int
+	}{
+		{"first and every third", 2, 3, []int{1, 2, 5, 8}},
+		{"first only", 3, 0, []int{1, 2, 3}},
+		{"every one", 1, 1, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := New(&buf, LevelInfo)
+			logger.SetSampling(time.Hour, tt.first, tt.thereafter)
+			for i := 1; i <= 9; i++ {
+				logger.PrintInfo("repeated", Fields{"i": i})
+			}
+			var got []int
+			for _, e := range entries(t, &buf) {
+				got = append(got, int(e.Properties["i"].(float64)))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got entries %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSamplingKeys(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+	logger.SetSampling(time.Hour, 1, 0)
+	// Each message and level is counted on its own.
+	logger.PrintInfo("a", nil)
+	logger.PrintInfo("a", nil)
+	logger.PrintInfo("b", nil)
+	logger.PrintWarn("a", nil)
+	want := []string{"INFO a", "INFO b", "WARN a"}
+	if got := messages(t, &buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSamplingTick(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+	const tick = 50 * time.Millisecond
+	logger.SetSampling(tick, 2, 0)
+	// The counts start again with every tick.
+	for range 2 {
+		for range 4 {
+			logger.PrintInfo("repeated", nil)
+		}
+		time.Sleep(tick + 10*time.Millisecond)
+	}
+	if got := len(entries(t, &buf)); got != 4 {
+		t.Errorf("got %d entries, want 4", got)
+	}
+
+	// Sampling can be switched off again.
+	buf.Reset()
+	logger.SetSampling(0, 0, 0)
+	for range 4 {
+		logger.PrintInfo("repeated", nil)
+	}
+	if got := len(entries(t, &buf)); got != 4 {
+		t.Errorf("got %d entries with sampling off, want 4", got)
+	}
+}
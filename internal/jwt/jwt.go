@@ -0,0 +1,214 @@
+// Package jwt signs and verifies the short-lived access tokens of the API, which are
+// JSON Web Tokens (RFC 7519) signed with HMAC-SHA256 (HS256) or Ed25519 (EdDSA).
+//
+// A KeySet holds the signing keys by their id, which goes in the "kid" header of every
+// token. The first key of the set signs new tokens and every key verifies them, which
+// is how keys are rotated: a new key is put first, and the old one stays in the set,
+// to verify the tokens it signed, until they have all expired.
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The signing algorithms, as they appear in the "alg" header of a token.
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+// Issuer is the "iss" claim of the tokens, which Verify() insists on.
+const Issuer = "greenlight"
+
+var (
+	// ErrInvalidToken is returned by Verify() for a token which is malformed, was
+	// signed by a key the set doesn't have, or whose signature doesn't match.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpiredToken is returned by Verify() for a valid token which has expired.
+	ErrExpiredToken = errors.New("expired token")
+)
+
+// minSecretLength is the shortest HMAC secret we accept, the size of the hash.
+const minSecretLength = sha256.Size
+
+var keyIDRX = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Claims are the claims of an access token. Besides the registered claims, the token
+// carries what the API needs to authorize a request without looking the user up: the
+// session the token was issued for, whether the user was activated, and the version of
+// the user record, which keys the cache of their roles and permissions.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	SessionID int    `json:"sid"`
+	Activated bool   `json:"act"`
+	Version   int    `json:"ver"`
+}
+
+// header is the JOSE header of a token.
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// A Key is a signing key along with its id and algorithm.
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+}
+
+// ParseKey parses a key written as <id>:<algorithm>:<base64 key>. An HS256 key is a
+// secret of at least 32 bytes, and an EdDSA key is an Ed25519 seed of 32 bytes or a
+// private key of 64 bytes.
+func ParseKey(s string) (Key, error) {
+	id, rest, _ := strings.Cut(s, ":")
+	algorithm, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return Key{}, fmt.Errorf("key %q must be written as id:algorithm:base64-key", id)
+	}
+	if !keyIDRX.MatchString(id) {
+		return Key{}, fmt.Errorf("key id %q may only contain letters, digits, '.', '_' and '-'", id)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return Key{}, fmt.Errorf("key %q is not valid base64", id)
+	}
+	key := Key{ID: id, Algorithm: algorithm}
+	switch algorithm {
+	case HS256:
+		if len(raw) < minSecretLength {
+			return Key{}, fmt.Errorf("key %q must be at least %d bytes long", id, minSecretLength)
+		}
+		key.secret = raw
+	case EdDSA:
+		switch len(raw) {
+		case ed25519.SeedSize:
+			key.private = ed25519.NewKeyFromSeed(raw)
+		case ed25519.PrivateKeySize:
+			key.private = ed25519.PrivateKey(raw)
+		default:
+			return Key{}, fmt.Errorf("key %q must be an Ed25519 seed or private key", id)
+		}
+		key.public = key.private.Public().(ed25519.PublicKey)
+	default:
+		return Key{}, fmt.Errorf("key %q has unknown algorithm %q, want %s or %s", id, algorithm, HS256, EdDSA)
+	}
+	return key, nil
+}
+
+func (k Key) sign(message []byte) []byte {
+	if k.Algorithm == HS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(message)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.private, message)
+}
+
+func (k Key) verify(message, signature []byte) bool {
+	if k.Algorithm == HS256 {
+		return hmac.Equal(k.sign(message), signature)
+	}
+	return ed25519.Verify(k.public, message, signature)
+}
+
+// A KeySet signs tokens with its first key and verifies them with any of its keys.
+type KeySet struct {
+	keys []Key
+	byID map[string]Key
+}
+
+// ParseKeySet parses a whitespace-separated list of keys, in the format of ParseKey(),
+// the signing key first.
+func ParseKeySet(s string) (*KeySet, error) {
+	ks := &KeySet{byID: make(map[string]Key)}
+	for _, field := range strings.Fields(s) {
+		key, err := ParseKey(field)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ks.byID[key.ID]; ok {
+			return nil, fmt.Errorf("key id %q is used more than once", key.ID)
+		}
+		ks.keys = append(ks.keys, key)
+		ks.byID[key.ID] = key
+	}
+	if len(ks.keys) == 0 {
+		return nil, errors.New("at least one key must be provided")
+	}
+	return ks, nil
+}
+
+// Sign returns the token for the claims, signed with the first key of the set. The
+// issuer claim is filled in.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	key := ks.keys[0]
+	claims.Issuer = Issuer
+	h, err := json.Marshal(header{Algorithm: key.Algorithm, Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encode(h) + "." + encode(c)
+	return signingInput + "." + encode(key.sign([]byte(signingInput))), nil
+}
+
+// Verify checks the signature, issuer and expiry of a token, and returns its claims.
+// The algorithm in the header of the token has to be that of the key it names, so
+// that a token can't pick a weaker way of being checked.
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	if err := decode(parts[0], &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, ok := ks.byID[h.KeyID]
+	if !ok || h.Algorithm != key.Algorithm {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := decode(parts[1], &claims); err != nil || claims.Issuer != Issuer {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
@@ -0,0 +1,124 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	hmacKey    = "hmac-1:HS256:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	newHMACKey = "hmac-2:HS256:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("n", 32)))
+	edKey      = "ed-1:EdDSA:" + base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize))
+)
+
+func mustParseKeySet(t *testing.T, s string) *KeySet {
+	t.Helper()
+	ks, err := ParseKeySet(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Now()
+	claims := Claims{Subject: "42", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(), SessionID: 7, Activated: true, Version: 3}
+	for _, spec := range []string{hmacKey, edKey} {
+		ks := mustParseKeySet(t, spec)
+		token, err := ks.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ks.Verify(token, now)
+		if err != nil {
+			t.Fatalf("Verify() of a %s token: %v", ks.keys[0].Algorithm, err)
+		}
+		want := claims
+		want.Issuer = Issuer
+		if *got != want {
+			t.Errorf("got claims %+v, want %+v", *got, want)
+		}
+		if _, err := ks.Verify(token, now.Add(time.Minute)); !errors.Is(err, ErrExpiredToken) {
+			t.Errorf("Verify() of an expired token: got %v, want ErrExpiredToken", err)
+		}
+	}
+}
+
+func TestVerifyRejectsForgeries(t *testing.T) {
+	now := time.Now()
+	ks := mustParseKeySet(t, hmacKey)
+	token, err := ks.Sign(Claims{Subject: "42", ExpiresAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	admin := encode([]byte(`{"iss":"greenlight","sub":"1","exp":9999999999}`))
+	tests := map[string]string{
+		"empty":            "",
+		"opaque token":     "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"changed claims":   parts[0] + "." + admin + "." + parts[2],
+		"no signature":     parts[0] + "." + parts[1] + ".",
+		"alg none":         encode([]byte(`{"alg":"none","kid":"hmac-1"}`)) + "." + parts[1] + ".",
+		"wrong alg":        encode([]byte(`{"alg":"EdDSA","kid":"hmac-1"}`)) + "." + parts[1] + "." + parts[2],
+		"unknown key":      encode([]byte(`{"alg":"HS256","kid":"other"}`)) + "." + parts[1] + "." + parts[2],
+		"other key's sign": mustSign(t, mustParseKeySet(t, newHMACKey), Claims{Subject: "42", ExpiresAt: now.Add(time.Minute).Unix()}),
+	}
+	for name, token := range tests {
+		if _, err := ks.Verify(token, now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: got %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func mustSign(t *testing.T, ks *KeySet, claims Claims) string {
+	t.Helper()
+	token, err := ks.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+	claims := Claims{Subject: "42", ExpiresAt: now.Add(time.Minute).Unix()}
+	old := mustSign(t, mustParseKeySet(t, hmacKey), claims)
+
+	// Once the new key is put first, it signs the new tokens, and the old key still
+	// verifies the tokens it signed.
+	rotated := mustParseKeySet(t, newHMACKey+" "+hmacKey+" "+edKey)
+	if _, err := rotated.Verify(old, now); err != nil {
+		t.Fatalf("Verify() of a token signed by the old key: %v", err)
+	}
+	token := mustSign(t, rotated, claims)
+	if _, err := mustParseKeySet(t, newHMACKey).Verify(token, now); err != nil {
+		t.Fatalf("Verify() of a token signed by the new key: %v", err)
+	}
+	// After the old key is dropped, its tokens stop working.
+	if _, err := mustParseKeySet(t, newHMACKey).Verify(old, now); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Verify() of a token signed by a dropped key: got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestParseKeySet(t *testing.T) {
+	short := base64.StdEncoding.EncodeToString([]byte("short"))
+	for _, spec := range []string{
+		"",
+		"hmac-1",
+		"hmac-1:HS256",
+		"hmac-1:HS256:" + short,
+		"hmac-1:HS256:not base64!",
+		"hmac 1:HS256:" + short,
+		"ed-1:EdDSA:" + short,
+		"rsa-1:RS256:" + short,
+		hmacKey + " " + hmacKey,
+	} {
+		if _, err := ParseKeySet(spec); err == nil {
+			t.Errorf("ParseKeySet(%q) succeeded", spec)
+		}
+	}
+}
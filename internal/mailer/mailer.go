@@ -3,48 +3,54 @@ package mailer
 import (
 	"bytes"
 	"embed"
-	"html/template"
-	"time"
-
-	"github.com/go-mail/mail/v2"
+	"errors"
+	"fmt"
 )
 
 // Below we declare a new variable with the type embed.FS (embedded file system) to hold
 // our email templates. This has a comment directive in the format `//go:embed <path>`
 // IMMEDIATELY ABOVE it, which indicates to Go that we want to store the contents of the
-// ./templates directory in the templateFS embedded file system variable.
+// ./templates directory in the templateFS embedded file system variable. The all:
+// prefix embeds the partials of the locales too, as their names start with an
+// underscore, which Go leaves out of an embedded directory otherwise.
 // ↓↓↓
 //
-//go:embed "templates"
+//go:embed all:templates
 var templateFS embed.FS
 
-// Define a Mailer struct which contains a mail.Dialer instance (used to connect to a
-// SMTP server) and the sender information for your emails (the name and address you
-// want the email to be from, such as "Alice Smith <alice@example.com>").
+// ErrTemplate wraps the errors from parsing and executing the email templates. Unlike
+// a problem with the SMTP server, sending the same email again won't fix these.
+var ErrTemplate = errors.New("email template error")
+
+// Define a Mailer struct which contains the Transport that delivers the emails, the
+// sender information for your emails (the name and address you want the email to be
+// from, such as "Alice Smith <alice@example.com>") and the templates of the emails.
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	transport Transport
+	sender    string
+	templates *Templates
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
-	// also configure this to use a 5-second timeout whenever we send an email.
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
-	// Return a Mailer instance containing the dialer and sender information.
+func New(transport Transport, sender string, templates *Templates) Mailer {
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		transport: transport,
+		sender:    sender,
+		templates: templates,
 	}
 }
 
+// Templates returns the templates the mailer renders its emails with.
+func (m Mailer) Templates() *Templates {
+	return m.templates
+}
+
 // Define a Send() method on the Mailer type. This takes the recipient email address
-// as the first parameter, the name of the file containing the templates, and any
+// as the first parameter, the name of the template, the locale to send it in, and any
 // dynamic data for the templates as an any parameter.
-func (m Mailer) Send(recipient, templateFile string, data any) error {
-	// Use the ParseFS() method to parse the required template file from the embedded
-	// file system.
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+func (m Mailer) Send(recipient, templateName, locale string, data any) error {
+	// Look up the template in the locale. The templates were parsed at startup, so
+	// this only fails for a template which doesn't exist at all.
+	tmpl, err := m.templates.lookup(templateName, locale)
 	if err != nil {
 		return err
 	}
@@ -53,39 +59,28 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrTemplate, err)
 	}
 	// Follow the same pattern to execute the "plainBody" template and store the result
 	// in the plainBody variable
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrTemplate, err)
 	}
 	// And likewise with the "htmlBody" template.
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
-	}
-	// Use the mail.NewMessage() function to initialize a new mail.Message instance.
-	// Then we use the SetHeader() method to set the email recipient, sender and subject
-	// headers, the SetBody() method to set the plain-text body, and the AddAlternative()
-	// method to set the HTML body. It's important to note that AddAlternative() should
-	// always be called *after* SetBody().
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-	// Call the DialAndSend() method on the dialer, passing in the message to send. This
-	// opens a connection to the SMTP server, sends the message, then closes the
-	// connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
-	// error.
-	err = m.dialer.DialAndSend(msg)
-	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrTemplate, err)
 	}
-	return nil
+	// Hand the rendered message over to the transport, which sends it or, during
+	// development and in tests, keeps it somewhere it can be looked at.
+	return m.transport.Send(Message{
+		To:        recipient,
+		From:      m.sender,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	})
 }
@@ -0,0 +1,270 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The email templates are laid out as templates/<locale>/<name>.tmpl, with one
+// directory per locale. The partials they share are parsed along with every template,
+// so that they can call the blocks defined there: those in templates/layouts are shared
+// by every locale, and the files of a locale directory whose name starts with an
+// underscore, like the sign-off of the emails, by the templates of that locale. A
+// template which has no variant in the locale of an email falls back to the
+// DefaultLocale, which must have every template.
+
+// DefaultLocale is the locale of the emails to users whose language isn't known, or
+// isn't one we have templates for.
+const DefaultLocale = "en"
+
+// layoutsDir is the directory of the shared partials, next to the locale directories.
+const layoutsDir = "layouts"
+
+// The categories of email. Transactional emails are about the account of the user, like
+// the activation and password reset emails, and are always sent. Users can opt out of
+// the other categories.
+const (
+	CategoryTransactional = "transactional"
+	CategoryAnnouncements = "announcements"
+)
+
+// Categories lists the categories a template can belong to.
+var Categories = []string{CategoryTransactional, CategoryAnnouncements}
+
+// requiredBlocks are the blocks every email template must define.
+var requiredBlocks = []string{"subject", "plainBody", "htmlBody"}
+
+// legacyNames maps the template files which emails used to be queued with to the
+// templates which replaced them, so that such emails still in the outbox are sent.
+var legacyNames = map[string]string{
+	"user_welcome.tmpl": "welcome",
+}
+
+// templateFuncs are the functions available to every template.
+var templateFuncs = template.FuncMap{
+	"timestamp": timestamp,
+}
+
+// timestamp formats a time, or a time which has gone through JSON on its way through
+// the outbox, in a way which reads the same in every language.
+func timestamp(t any) (string, error) {
+	switch t := t.(type) {
+	case time.Time:
+		return t.UTC().Format("2006-01-02 15:04 UTC"), nil
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return "", err
+		}
+		return timestamp(parsed)
+	default:
+		return "", fmt.Errorf("timestamp: unsupported value %v", t)
+	}
+}
+
+// Templates is the registry of the email templates, parsed and checked once at startup.
+type Templates struct {
+	// byLocale holds the parsed templates of every locale, by name.
+	byLocale map[string]map[string]*template.Template
+	// categories holds the category of every template, by name.
+	categories map[string]string
+}
+
+// LoadTemplates parses and checks the templates embedded in the binary.
+func LoadTemplates() (*Templates, error) {
+	fsys, err := fs.Sub(templateFS, "templates")
+	if err != nil {
+		return nil, err
+	}
+	return ParseTemplates(fsys)
+}
+
+// ParseTemplates parses the templates in fsys, laid out like the embedded ones. Rather
+// than leaving a broken template to fail when an email is sent, it returns an error if
+// any template doesn't parse or is missing one of the subject, plainBody and htmlBody
+// blocks, if a template doesn't exist in the DefaultLocale, or if a template belongs to
+// an unknown category. It is the lint step of the templates, run at startup.
+func ParseTemplates(fsys fs.FS) (*Templates, error) {
+	layouts, err := fs.Glob(fsys, layoutsDir+"/*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	files, err := fs.Glob(fsys, "*/*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	t := &Templates{
+		byLocale:   make(map[string]map[string]*template.Template),
+		categories: make(map[string]string),
+	}
+	var problems []string
+	for _, file := range files {
+		locale, name := path.Dir(file), strings.TrimSuffix(path.Base(file), ".tmpl")
+		if locale == layoutsDir || strings.HasPrefix(name, "_") {
+			continue
+		}
+		partials, err := fs.Glob(fsys, locale+"/_*.tmpl")
+		if err != nil {
+			return nil, err
+		}
+		// The partials are parsed first, so that a template can redefine one of their
+		// blocks.
+		patterns := append(slices.Concat(layouts, partials), file)
+		tmpl, err := template.New(name).Funcs(templateFuncs).ParseFS(fsys, patterns...)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		for _, block := range requiredBlocks {
+			if tmpl.Lookup(block) == nil {
+				problems = append(problems, fmt.Sprintf("%s: no %q block", file, block))
+			}
+		}
+		category, err := templateCategory(tmpl)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file, err))
+		}
+		if known, ok := t.categories[name]; ok && known != category {
+			problems = append(problems, fmt.Sprintf("%s: category %q, but %q in other locales", file, category, known))
+		}
+		t.categories[name] = category
+		if t.byLocale[locale] == nil {
+			t.byLocale[locale] = make(map[string]*template.Template)
+		}
+		t.byLocale[locale][name] = tmpl
+	}
+	for _, name := range t.Names() {
+		if t.byLocale[DefaultLocale][name] == nil {
+			problems = append(problems, fmt.Sprintf("%s: no %s variant to fall back on", name, DefaultLocale))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("%w: %s", ErrTemplate, strings.Join(problems, "; "))
+	}
+	return t, nil
+}
+
+// templateCategory returns the category a template declares in its optional "category"
+// block, which is CategoryTransactional when it has none.
+func templateCategory(tmpl *template.Template) (string, error) {
+	if tmpl.Lookup("category") == nil {
+		return CategoryTransactional, nil
+	}
+	category := new(bytes.Buffer)
+	err := tmpl.ExecuteTemplate(category, "category", nil)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(category.String())
+	if !slices.Contains(Categories, name) {
+		return "", fmt.Errorf("unknown category %q", name)
+	}
+	return name, nil
+}
+
+// Names returns the names of the templates, sorted.
+func (t *Templates) Names() []string {
+	names := make([]string, 0, len(t.categories))
+	for name := range t.categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Locales returns the locales which have templates, sorted.
+func (t *Templates) Locales() []string {
+	locales := make([]string, 0, len(t.byLocale))
+	for locale := range t.byLocale {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Category returns the category of the named template, and false if there is no such
+// template.
+func (t *Templates) Category(name string) (string, bool) {
+	if legacy, ok := legacyNames[name]; ok {
+		name = legacy
+	}
+	category, ok := t.categories[name]
+	return category, ok
+}
+
+// lookup returns the named template in the locale, falling back to the DefaultLocale.
+func (t *Templates) lookup(name, locale string) (*template.Template, error) {
+	if legacy, ok := legacyNames[name]; ok {
+		name = legacy
+	}
+	if tmpl, ok := t.byLocale[locale][name]; ok {
+		return tmpl, nil
+	}
+	if tmpl, ok := t.byLocale[DefaultLocale][name]; ok {
+		return tmpl, nil
+	}
+	return nil, fmt.Errorf("%w: no template named %q", ErrTemplate, name)
+}
+
+// MatchLocale returns the first of the preferred locales which has templates, in order
+// of preference. A preference such as "fr-CA" matches the "fr" templates when there are
+// no templates for the region. It returns the DefaultLocale if none match.
+func (t *Templates) MatchLocale(preferences ...string) string {
+	for _, preference := range preferences {
+		preference = strings.ToLower(strings.ReplaceAll(preference, "_", "-"))
+		if _, ok := t.byLocale[preference]; ok {
+			return preference
+		}
+		language, _, _ := strings.Cut(preference, "-")
+		if _, ok := t.byLocale[language]; ok {
+			return language
+		}
+	}
+	return DefaultLocale
+}
+
+// ParseAcceptLanguage returns the language tags of an Accept-Language header, most
+// preferred first. Tags with a quality of zero, which the client doesn't want, and the
+// "*" wildcard are left out.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag     string
+		quality float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if quality > 0 {
+			tags = append(tags, weighted{tag, quality})
+		}
+	}
+	// A stable sort keeps the tags of the same quality in the order the client sent
+	// them in.
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].quality > tags[j].quality })
+	result := make([]string, len(tags))
+	for i, tag := range tags {
+		result[i] = tag.tag
+	}
+	return result
+}
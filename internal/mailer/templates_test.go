@@ -0,0 +1,179 @@
+package mailer
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func loadTemplates(t *testing.T) *Templates {
+	t.Helper()
+	templates, err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return templates
+}
+
+// templateData has everything any of the templates uses.
+var templateData = map[string]any{
+	"name":               "Alice",
+	"userID":             7,
+	"activationToken":    "ACTIVATIONTOKENAAAAAAAAAAA",
+	"passwordResetToken": "PASSWORDRESETTOKENAAAAAAAA",
+	"emailChangeToken":   "EMAILCHANGETOKENAAAAAAAAAA",
+	"newEmail":           "alice@example.org",
+	"expiry":             time.Date(2026, 1, 2, 15, 4, 0, 0, time.UTC),
+	"changedAt":          "2026-01-02T15:04:00Z",
+}
+
+func TestTemplates(t *testing.T) {
+	templates := loadTemplates(t)
+	wantNames := []string{"activation-resend", "email-change-confirmation", "password-changed", "password-reset", "welcome"}
+	if got := templates.Names(); !slices.Equal(got, wantNames) {
+		t.Fatalf("got templates %v, want %v", got, wantNames)
+	}
+	// Every template should render in every locale, with the shared layout and the
+	// sign-off of the locale.
+	signatures := map[string]string{"en": "The Greenlight Team", "fr": "L'équipe Greenlight"}
+	for _, locale := range templates.Locales() {
+		for _, name := range templates.Names() {
+			recorder := NewRecorder()
+			err := New(recorder, "Greenlight <no-reply@greenlight.test>", templates).Send("alice@example.com", name, locale, templateData)
+			if err != nil {
+				t.Errorf("%s/%s: %v", locale, name, err)
+				continue
+			}
+			msg := recorder.Messages()[0]
+			if msg.Subject == "" || !strings.Contains(msg.PlainBody, "Alice") || !strings.Contains(msg.HTMLBody, "<!doctype html>") {
+				t.Errorf("%s/%s: got %+v", locale, name, msg)
+			}
+			if !strings.Contains(msg.PlainBody, signatures[locale]) {
+				t.Errorf("%s/%s: the plain body isn't signed %q:\n%s", locale, name, signatures[locale], msg.PlainBody)
+			}
+			if strings.Contains(msg.PlainBody, "2026-01-02") != strings.Contains(msg.PlainBody, "15:04 UTC") {
+				t.Errorf("%s/%s: badly formatted time:\n%s", locale, name, msg.PlainBody)
+			}
+		}
+	}
+}
+
+func TestSendLocale(t *testing.T) {
+	templates := loadTemplates(t)
+	tests := []struct {
+		name, locale, wantSubject string
+	}{
+		{"welcome", "fr", "Bienvenue sur Greenlight !"},
+		{"welcome", "en", "Welcome to Greenlight!"},
+		// There are no German templates, so the English ones are used.
+		{"welcome", "de", "Welcome to Greenlight!"},
+		{"user_welcome.tmpl", "fr", "Bienvenue sur Greenlight !"},
+	}
+	for _, tt := range tests {
+		recorder := NewRecorder()
+		err := New(recorder, "Greenlight <no-reply@greenlight.test>", templates).Send("alice@example.com", tt.name, tt.locale, templateData)
+		if err != nil {
+			t.Fatalf("Send(%q, %q): %v", tt.name, tt.locale, err)
+		}
+		if got := recorder.Messages()[0].Subject; got != tt.wantSubject {
+			t.Errorf("Send(%q, %q) subject = %q, want %q", tt.name, tt.locale, got, tt.wantSubject)
+		}
+	}
+}
+
+func TestParseTemplatesLint(t *testing.T) {
+	valid := `{{define "subject"}}Hi{{end}}{{define "plainBody"}}Hi{{end}}{{define "htmlBody"}}<p>Hi</p>{{end}}`
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+		want  string
+	}{
+		{
+			name: "missing block",
+			files: fstest.MapFS{
+				"en/welcome.tmpl": {Data: []byte(`{{define "subject"}}Hi{{end}}{{define "plainBody"}}Hi{{end}}`)},
+			},
+			want: `en/welcome.tmpl: no "htmlBody" block`,
+		},
+		{
+			name: "no default locale",
+			files: fstest.MapFS{
+				"en/welcome.tmpl": {Data: []byte(valid)},
+				"fr/news.tmpl":    {Data: []byte(valid)},
+			},
+			want: "news: no en variant",
+		},
+		{
+			name: "unknown category",
+			files: fstest.MapFS{
+				"en/news.tmpl": {Data: []byte(valid + `{{define "category"}}spam{{end}}`)},
+			},
+			want: `unknown category "spam"`,
+		},
+		{
+			name: "syntax error",
+			files: fstest.MapFS{
+				"en/welcome.tmpl": {Data: []byte(`{{define "subject"}}Hi{{end`)},
+			},
+			want: "welcome.tmpl",
+		},
+	}
+	for _, tt := range tests {
+		_, err := ParseTemplates(tt.files)
+		if !errors.Is(err, ErrTemplate) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one about %q", tt.name, err, tt.want)
+		}
+	}
+
+	// A template with a category, in a layout shared with the other templates.
+	templates, err := ParseTemplates(fstest.MapFS{
+		"layouts/base.tmpl": {Data: []byte(`{{define "plainBody"}}{{template "content" .}}{{end}}`)},
+		"en/news.tmpl":      {Data: []byte(`{{define "subject"}}News{{end}}{{define "content"}}News{{end}}{{define "htmlBody"}}News{{end}}{{define "category"}}announcements{{end}}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if category, ok := templates.Category("news"); !ok || category != CategoryAnnouncements {
+		t.Errorf("Category(news) = %q, %v", category, ok)
+	}
+}
+
+func TestMatchLocale(t *testing.T) {
+	templates := loadTemplates(t)
+	tests := []struct {
+		preferences []string
+		want        string
+	}{
+		{nil, "en"},
+		{[]string{"fr"}, "fr"},
+		{[]string{"fr-CA"}, "fr"},
+		{[]string{"FR_ca"}, "fr"},
+		{[]string{"de", "fr"}, "fr"},
+		{[]string{"de"}, "en"},
+	}
+	for _, tt := range tests {
+		if got := templates.MatchLocale(tt.preferences...); got != tt.want {
+			t.Errorf("MatchLocale(%q) = %q, want %q", tt.preferences, got, tt.want)
+		}
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", []string{"fr-CH", "fr", "en", "de"}},
+		{"en;q=0.5, fr", []string{"fr", "en"}},
+		{"de;q=0, fr;q=bad, en", []string{"en"}},
+	}
+	for _, tt := range tests {
+		if got := ParseAcceptLanguage(tt.header); !slices.Equal(got, tt.want) {
+			t.Errorf("ParseAcceptLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"forum/internal/jsonlog"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// A Message is a rendered email, ready to be handed to a Transport.
+type Message struct {
+	To        string
+	From      string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+}
+
+// mail converts the message to a mail.Message. The plain-text body comes first, as
+// AddAlternative() should always be called *after* SetBody().
+func (msg Message) mail() *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", msg.From)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+	return m
+}
+
+// A Transport delivers the messages of a Mailer: over SMTP, into a directory of .eml
+// files for local development, or into memory for tests.
+type Transport interface {
+	Send(msg Message) error
+}
+
+// The ways of securing the connection to the SMTP server.
+const (
+	// TLSOpportunistic upgrades the connection with STARTTLS if the server offers it.
+	TLSOpportunistic = "opportunistic"
+	// TLSStartTLS requires the server to support STARTTLS, and fails otherwise.
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects over TLS from the start, usually to port 465.
+	TLSImplicit = "tls"
+	// TLSNone never encrypts the connection. Only use it for a local server.
+	TLSNone = "none"
+)
+
+// TLSModes lists the valid TLS modes of an SMTP transport.
+var TLSModes = []string{TLSOpportunistic, TLSStartTLS, TLSImplicit, TLSNone}
+
+// SMTP sends messages through an SMTP server, opening a new connection for each one.
+type SMTP struct {
+	dialer *mail.Dialer
+}
+
+// NewSMTP returns a transport for the SMTP server at host and port, which secures the
+// connection according to tlsMode, one of the TLSModes.
+func NewSMTP(host string, port int, username, password, tlsMode string) (*SMTP, error) {
+	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
+	// also configure this to use a 5-second timeout whenever we send an email.
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+	dialer.SSL = false
+	switch tlsMode {
+	case TLSOpportunistic:
+		dialer.StartTLSPolicy = mail.OpportunisticStartTLS
+	case TLSStartTLS:
+		dialer.StartTLSPolicy = mail.MandatoryStartTLS
+	case TLSImplicit:
+		dialer.SSL = true
+	case TLSNone:
+		dialer.StartTLSPolicy = mail.NoStartTLS
+	default:
+		return nil, fmt.Errorf("unknown SMTP TLS mode %q", tlsMode)
+	}
+	dialer.TLSConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	return &SMTP{dialer: dialer}, nil
+}
+
+// Send opens a connection to the SMTP server, sends the message, then closes the
+// connection. If there is a timeout, it will return a "dial tcp: i/o timeout" error.
+func (t *SMTP) Send(msg Message) error {
+	return t.dialer.DialAndSend(msg.mail())
+}
+
+// FileSink writes every message to a .eml file in a directory instead of sending it,
+// and logs where to find it. Most mail clients open .eml files, so this is a simple way
+// of seeing the emails during development.
+type FileSink struct {
+	dir    string
+	logger *jsonlog.Logger
+}
+
+// NewFileSink returns a FileSink writing to dir, which it creates if it doesn't exist.
+func NewFileSink(dir string, logger *jsonlog.Logger) (*FileSink, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{dir: dir, logger: logger}, nil
+}
+
+// unsafeFileChars matches the characters of a recipient address which are left out of
+// the file name.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9@._+-]`)
+
+func (t *FileSink) Send(msg Message) error {
+	// The time stamp keeps the files in the order they were written, and the recipient
+	// makes it easy to find the email of a user.
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + unsafeFileChars.ReplaceAllString(msg.To, "_") + ".eml"
+	path := filepath.Join(t.dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = msg.mail().WriteTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if t.logger != nil {
+		t.logger.PrintInfo("email written", jsonlog.Fields{
+			"to":          msg.To,
+			"subject":     msg.Subject,
+			"preview_url": "file://" + filepath.ToSlash(path),
+		})
+	}
+	return nil
+}
+
+// Recorder keeps the messages sent through it in memory, so that tests can look at
+// what would have been sent. A recorder with a limit only keeps that many of the most
+// recent messages, so that it can stand in for a real transport in a server which runs
+// for a long time.
+type Recorder struct {
+	mu       sync.Mutex
+	limit    int
+	messages []Message
+}
+
+// NewRecorder returns a Recorder which keeps every message.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// NewLimitedRecorder returns a Recorder which keeps the given number of messages, and
+// drops the oldest one to make room for each message after that.
+func NewLimitedRecorder(limit int) *Recorder {
+	return &Recorder{limit: limit}
+}
+
+func (t *Recorder) Send(msg Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limit > 0 && len(t.messages) >= t.limit {
+		// Copy the messages which are kept to the front, rather than reslicing, so
+		// that the backing array doesn't grow forever.
+		n := copy(t.messages, t.messages[len(t.messages)-t.limit+1:])
+		t.messages = t.messages[:n]
+	}
+	t.messages = append(t.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first.
+func (t *Recorder) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Message{}, t.messages...)
+}
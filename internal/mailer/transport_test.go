@@ -0,0 +1,69 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	sink, err := NewFileSink(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(sink, "Greenlight <no-reply@greenlight.test>", loadTemplates(t))
+	err = m.Send("alice@example.com", "welcome", DefaultLocale, map[string]any{"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "userID": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*-alice@example.com.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got files %v, %v; want one .eml file for alice", files, err)
+	}
+	eml, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: alice@example.com", "Subject: Welcome to Greenlight!", "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "text/html"} {
+		if !strings.Contains(string(eml), want) {
+			t.Errorf("the .eml file doesn't contain %q:\n%s", want, eml)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	recorder := NewRecorder()
+	m := New(recorder, "Greenlight <no-reply@greenlight.test>", loadTemplates(t))
+	if err := m.Send("bob@example.com", "missing", DefaultLocale, nil); err == nil {
+		t.Fatal("Send() with a missing template succeeded")
+	}
+	if got := recorder.Messages(); len(got) != 0 {
+		t.Fatalf("got %d messages after a template error", len(got))
+	}
+}
+
+func TestLimitedRecorder(t *testing.T) {
+	recorder := NewLimitedRecorder(2)
+	for _, to := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		if err := recorder.Send(Message{To: to}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := recorder.Messages()
+	if len(got) != 2 || got[0].To != "bob@example.com" || got[1].To != "carol@example.com" {
+		t.Fatalf("got messages %+v, want the last two", got)
+	}
+}
+
+func TestNewSMTP(t *testing.T) {
+	for _, mode := range TLSModes {
+		if _, err := NewSMTP("smtp.example.com", 587, "", "", mode); err != nil {
+			t.Errorf("NewSMTP() with TLS mode %q: %v", mode, err)
+		}
+	}
+	if _, err := NewSMTP("smtp.example.com", 587, "", "", "ssl"); err == nil {
+		t.Error("NewSMTP() accepted an unknown TLS mode")
+	}
+}
@@ -0,0 +1,311 @@
+// Package metrics implements the handful of Prometheus metric types the API needs,
+// and writes them in the Prometheus text exposition format. It doesn't try to be a
+// complete client library: there are counters, histograms and gauges whose values are
+// read from a function when the metrics are scraped.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets for request durations,
+// in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A Registry holds a set of metrics and writes them out in the order they were
+// registered.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metric is implemented by each metric type. write appends the samples of the metric,
+// without the HELP and TYPE lines, which the Registry writes itself.
+type metric interface {
+	desc() *desc
+	write(w io.Writer)
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.metrics {
+		if existing.desc().name == m.desc().name {
+			panic("metrics: duplicate metric " + m.desc().name)
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes all the metrics in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		d := m.desc()
+		fmt.Fprintf(cw, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+		fmt.Fprintf(cw, "# TYPE %s %s\n", d.name, d.kind)
+		m.write(cw)
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// Handler returns a http.Handler which serves the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// A CounterVec is a set of counters, one for each combination of label values.
+type CounterVec struct {
+	d      desc
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+// NewCounterVec registers a new counter with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		d:      desc{name: name, help: help, kind: "counter", labels: labels},
+		values: make(map[string]*counterValue),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds 1 to the counter with the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter with the given label values.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	checkLabels(&c.d, labelValues)
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	if !ok {
+		value = &counterValue{labels: labelValues}
+		c.values[key] = value
+	}
+	value.value += v
+}
+
+func (c *CounterVec) desc() *desc { return &c.d }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		value := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.d.name, formatLabels(c.d.labels, value.labels, "", ""), formatFloat(value.value))
+	}
+}
+
+// A HistogramVec is a set of histograms, one for each combination of label values.
+type HistogramVec struct {
+	d       desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // Non-cumulative counts per bucket, plus one for +Inf.
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec registers a new histogram with the given bucket upper bounds, which
+// must be sorted, and label names.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		d:       desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds a single observation to the histogram with the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	checkLabels(&h.d, labelValues)
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{labels: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = value
+	}
+	value.counts[sort.SearchFloat64s(h.buckets, v)]++
+	value.sum += v
+	value.count++
+}
+
+func (h *HistogramVec) desc() *desc { return &h.d }
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		value := h.values[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += value.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.d.name, formatLabels(h.d.labels, value.labels, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.d.name, formatLabels(h.d.labels, value.labels, "le", "+Inf"), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.d.name, formatLabels(h.d.labels, value.labels, "", ""), formatFloat(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.d.name, formatLabels(h.d.labels, value.labels, "", ""), value.count)
+	}
+}
+
+// A GaugeFunc is a gauge whose value is read by calling a function at scrape time.
+type GaugeFunc struct {
+	d  desc
+	fn func() float64
+}
+
+// NewGaugeFunc registers a new gauge which reports the value returned by fn.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{d: desc{name: name, help: help, kind: "gauge"}, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) desc() *desc { return &g.d }
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "%s %s\n", g.d.name, formatFloat(g.fn()))
+}
+
+// CounterFunc is like GaugeFunc, for values which only ever go up, like the totals
+// kept by database/sql.
+type CounterFunc struct {
+	GaugeFunc
+}
+
+// NewCounterFunc registers a new counter which reports the value returned by fn.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) *CounterFunc {
+	c := &CounterFunc{GaugeFunc{d: desc{name: name, help: help, kind: "counter"}, fn: fn}}
+	r.register(c)
+	return c
+}
+
+func checkLabels(d *desc, values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+}
+
+// formatLabels returns the {name="value",...} part of a sample line, with an extra
+// label appended if extraName isn't empty.
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(values[i]))
+		b.WriteByte('"')
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraName)
+		b.WriteString(`="`)
+		b.WriteString(extraValue)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string       { return helpEscaper.Replace(s) }
+func escapeLabelValue(s string) string { return labelEscaper.Replace(s) }
+
+// sortedKeys returns the keys of m in order, so that the output is stable between
+// scrapes.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func exposition(t *testing.T, r *Registry) string {
+	t.Helper()
+	var b strings.Builder
+	n, err := r.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo() = %d, wrote %d bytes", n, b.Len())
+	}
+	return b.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("http_requests_total", "Requests by route.\nCounted once.", "route", "status")
+	c.Inc("/v1/movies", "200")
+	c.Add(2, "/v1/movies", "200")
+	c.Inc(`/v1/"quoted"\path`+"\n", "404")
+
+	want := `# HELP http_requests_total Requests by route.\nCounted once.
+# TYPE http_requests_total counter
+http_requests_total{route="/v1/\"quoted\"\\path\n",status="404"} 1
+http_requests_total{route="/v1/movies",status="200"} 3
+`
+	if got := exposition(t, r); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("request_duration_seconds", "Request durations.", []float64{0.1, 1}, "route")
+	// An observation equal to an upper bound falls in that bucket.
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(v, "/v1/movies")
+	}
+
+	want := `# HELP request_duration_seconds Request durations.
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{route="/v1/movies",le="0.1"} 2
+request_duration_seconds_bucket{route="/v1/movies",le="1"} 3
+request_duration_seconds_bucket{route="/v1/movies",le="+Inf"} 4
+request_duration_seconds_sum{route="/v1/movies"} 3.65
+request_duration_seconds_count{route="/v1/movies"} 4
+`
+	if got := exposition(t, r); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeFunc("db_open_connections", "Open connections.", func() float64 { return 3 })
+	r.NewCounterFunc("db_wait_total", "Waits.", func() float64 { return math.Inf(1) })
+
+	want := `# HELP db_open_connections Open connections.
+# TYPE db_open_connections gauge
+db_open_connections 3
+# HELP db_wait_total Waits.
+# TYPE db_wait_total counter
+db_wait_total +Inf
+`
+	if got := exposition(t, r); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestConcurrentInc(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("events_total", "Events.", "kind")
+	h := r.NewHistogramVec("sizes", "Sizes.", []float64{1}, "kind")
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			kind := []string{"a", "b"}[i%2]
+			for range 1000 {
+				c.Inc(kind)
+				h.Observe(0.5, kind)
+			}
+			// Scraping while the values change must be safe too.
+			r.WriteTo(&strings.Builder{})
+		}()
+	}
+	wg.Wait()
+
+	got := exposition(t, r)
+	for _, line := range []string{
+		`events_total{kind="a"} 4000`,
+		`events_total{kind="b"} 4000`,
+		`sizes_count{kind="a"} 4000`,
+		`sizes_bucket{kind="b",le="+Inf"} 4000`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, got)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("events_total", "Events.").Inc()
+	rr := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got := rr.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %q", got)
+	}
+	if !strings.Contains(rr.Body.String(), "events_total 1\n") {
+		t.Errorf("got body:\n%s", rr.Body.String())
+	}
+}
+
+func TestRegistryPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("events_total", "Events.", "kind")
+	for name, fn := range map[string]func(){
+		"duplicate metric":   func() { r.NewGaugeFunc("events_total", "Events.", func() float64 { return 0 }) },
+		"wrong label values": func() { c.Inc("a", "b") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: want a panic", name)
+				}
+			}()
+			fn()
+		}()
+	}
+}
@@ -0,0 +1,206 @@
+// Package settings fills in a flag.FlagSet from several layers of configuration. The
+// flags remain the single definition of every setting and its default value; a
+// configuration file and environment variables only provide other ways of setting
+// them. From lowest to highest precedence the layers are:
+//
+//  1. the default values of the flags,
+//  2. an optional YAML, TOML or JSON file,
+//  3. environment variables,
+//  4. the command-line flags.
+//
+// The keys of the file are the flag names. Nested tables are joined with a "-", so
+// that the YAML
+//
+//	db:
+//	  dsn: ./greenlight.db
+//
+// sets the -db-dsn flag, and lists are joined with spaces. The environment variable
+// for a flag is its name in upper case with dashes replaced by underscores, after a
+// prefix: GREENLIGHT_DB_DSN sets -db-dsn.
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Options controls how Load finds the configuration file and environment variables.
+type Options struct {
+	// The name of the flag holding the path of the configuration file. The file is
+	// only read if that flag is set, on the command line or in the environment.
+	FileFlag string
+	// The prefix of the environment variables, like "GREENLIGHT_".
+	EnvPrefix string
+}
+
+// Load parses the command-line arguments into fs and then sets each flag which wasn't
+// given on the command line from the environment or the configuration file.
+func Load(fs *flag.FlagSet, args []string, opts Options) error {
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	env := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(EnvName(opts.EnvPrefix, f.Name)); ok {
+			env[f.Name] = value
+		}
+	})
+
+	// The path of the file can itself come from the environment.
+	path := env[opts.FileFlag]
+	if explicit[opts.FileFlag] {
+		path = fs.Lookup(opts.FileFlag).Value.String()
+	}
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range sortedKeys(values) {
+			if fs.Lookup(name) == nil {
+				return fmt.Errorf("config file %s: unknown setting %q", path, name)
+			}
+			if explicit[name] || name == opts.FileFlag {
+				continue
+			}
+			if err := fs.Set(name, values[name]); err != nil {
+				return fmt.Errorf("config file %s: invalid value %q for %s: %w", path, values[name], name, err)
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(env) {
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, env[name]); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", env[name], EnvName(opts.EnvPrefix, name), err)
+		}
+	}
+	return nil
+}
+
+// EnvName returns the name of the environment variable for a flag.
+func EnvName(prefix, flagName string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readFile reads a configuration file and flattens it into flag names and values. The
+// format is picked by the file extension.
+func readFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &tree)
+	case ".toml":
+		err = toml.Unmarshal(content, &tree)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(content))
+		// Keep numbers as they were written, rather than turning them into float64s
+		// which would print 1000000 as 1e+06.
+		dec.UseNumber()
+		err = dec.Decode(&tree)
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported format %q, use .yaml, .toml or .json", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	values := make(map[string]string)
+	err = flatten("", tree, values)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return values, nil
+}
+
+func flatten(prefix string, tree map[string]any, values map[string]string) error {
+	for key, value := range tree {
+		name := key
+		if prefix != "" {
+			name = prefix + "-" + key
+		}
+		switch value := value.(type) {
+		case map[string]any:
+			if err := flatten(name, value, values); err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, len(value))
+			for i, item := range value {
+				s, err := scalar(name, item)
+				if err != nil {
+					return err
+				}
+				items[i] = s
+			}
+			values[name] = strings.Join(items, " ")
+		default:
+			s, err := scalar(name, value)
+			if err != nil {
+				return err
+			}
+			values[name] = s
+		}
+	}
+	return nil
+}
+
+func scalar(name string, value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case nil:
+		return "", nil
+	case bool, int, int64, uint64, float64, json.Number:
+		return fmt.Sprint(value), nil
+	default:
+		return "", errors.New("unsupported value for " + name)
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Values returns the current value of every flag, with the values of the secret flags
+// replaced by "[REDACTED]" unless they are empty. It is meant for printing the
+// effective configuration.
+func Values(fs *flag.FlagSet, secrets ...string) map[string]string {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		for _, secret := range secrets {
+			if f.Name == secret && value != "" {
+				value = "[REDACTED]"
+			}
+		}
+		values[f.Name] = value
+	})
+	return values
+}
@@ -51,12 +51,12 @@ func Matches(value string, rx *regexp.Regexp) bool {
 }
 
 // Generic function which returns true if all values in a slice are unique.
-// func Unique[T comparable](values T) bool {
-// 	uniqueValues := make(map[T]bool)
-// 	for _, value := range values {
-// 		uniqueValues[value] = true
-// 	}
-// 	return len(values) == len(uniqueValues)
-// }
+func Unique[T comparable](values []T) bool {
+	uniqueValues := make(map[T]bool)
+	for _, value := range values {
+		uniqueValues[value] = true
+	}
+	return len(values) == len(uniqueValues)
+}
 
 // Validate input movies
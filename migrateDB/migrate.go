@@ -1,37 +1,455 @@
 package migratedb
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
 )
 
+// The migration files are embedded into the binary, so the api and the migrate
+// command always carry exactly the schema they were built against. Each migration is a
+// pair of files named <version>_<name>.up.sql and <version>_<name>.down.sql. Every
+// supported database has its own directory of migrations, named after its dialect,
+// which should be kept at the same versions so that both end up with the same schema.
+//
+//go:embed "migrations"
+var migrationFS embed.FS
+
 const (
-	path = "./migrateDB/migrations"
+	// Dir is the on-disk location of the migration directories, relative to the
+	// repository root. It is only used when creating new migration files.
+	Dir = "./migrateDB/migrations"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("migration checksum mismatch")
+	ErrUnknownVersion   = errors.New("unknown migration version")
+	ErrNoChange         = errors.New("no change")
+)
+
+var (
+	fileRX = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+	nameRX = regexp.MustCompile(`^\w+$`)
 )
 
-func CreateTable(db *sql.DB) error {
-	dir, err := os.ReadDir(path)
+// Migration holds a single numbered schema change. The checksum is the SHA-256 of the
+// up script and is recorded in the schema_migrations table when the migration is
+// applied, so that later edits to an already applied file can be detected.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationStatus describes the state of a single migration in the database.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Modified  bool
+}
+
+// Migrator applies the embedded migrations to a database and records them in the
+// schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New returns a Migrator for the embedded migration set of the given dialect, which is
+// "sqlite" or "postgres".
+func New(db *sql.DB, dialect string) (*Migrator, error) {
+	if !slices.Contains(Dialects(), dialect) {
+		return nil, fmt.Errorf("no migrations for database dialect %q", dialect)
+	}
+	migrations, err := load(migrationFS, "migrations/"+dialect)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Dialects returns the names of the dialects which have a migration directory.
+func Dialects() []string {
+	entries, _ := fs.ReadDir(migrationFS, "migrations")
+	var dialects []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dialects = append(dialects, entry.Name())
+		}
+	}
+	return dialects
+}
+
+// load reads every migration file in dir, pairs the up and down scripts by version and
+// returns them sorted in ascending version order.
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
 	}
-	for _, file := range dir {
-		info, err := file.Info()
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		parts := fileRX.FindStringSubmatch(entry.Name())
+		if parts == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, err := strconv.Atoi(parts[1])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("invalid migration version in %q", entry.Name())
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
 		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, parts[2])
+		}
+		switch parts[3] {
+		case "up":
+			m.Up = string(content)
+			sum := sha256.Sum256(content)
+			m.Checksum = hex.EncodeToString(sum[:])
+		case "down":
+			m.Down = string(content)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Checksum == "" {
+			return nil, fmt.Errorf("migration %d is missing an up script", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrations returns the embedded migration set in ascending version order.
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Latest returns the highest embedded migration version, or 0 if there are none.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// init creates the schema_migrations bookkeeping table if it doesn't exist yet.
+func (m *Migrator) init(ctx context.Context) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`
+	_, err := m.db.ExecContext(ctx, query)
+	return err
+}
+
+type appliedMigration struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// applied returns the recorded migrations keyed by version.
+func (m *Migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := m.db.QueryContext(ctx, `SELECT version, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var (
+			version int
+			a       appliedMigration
+		)
+		if err := rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = a
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// Version returns the highest applied migration version, or 0 for an empty database.
+func (m *Migrator) Version() (int, error) {
+	return m.VersionContext(context.Background())
+}
+
+// VersionContext is like Version, with a context for the queries.
+func (m *Migrator) VersionContext(ctx context.Context) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Verify checks that every applied migration still exists in the embedded set and
+// that its up script hasn't been edited since it was applied.
+func (m *Migrator) Verify() error {
+	return m.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify, with a context for the queries.
+func (m *Migrator) VerifyContext(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	return m.verify(applied)
+}
+
+func (m *Migrator) verify(applied map[int]appliedMigration) error {
+	known := make(map[int]Migration, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+	for version, a := range applied {
+		migration, ok := known[version]
+		if !ok {
+			return fmt.Errorf("%w: version %d is applied but not embedded in this binary", ErrUnknownVersion, version)
+		}
+		if migration.Checksum != a.checksum {
+			return fmt.Errorf("%w: version %d (%s)", ErrChecksumMismatch, version, migration.Name)
+		}
+	}
+	return nil
+}
+
+// Status reports every embedded migration along with whether it has been applied.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		s := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if a, ok := applied[migration.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = a.appliedAt
+			s.Modified = a.checksum != migration.Checksum
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// Up applies every pending migration in ascending order.
+func (m *Migrator) Up() error {
+	return m.Goto(m.Latest())
+}
+
+// Down rolls back the n most recently applied migrations.
+func (m *Migrator) Down(n int) error {
+	if n < 1 {
+		return fmt.Errorf("invalid number of migrations to roll back: %d", n)
+	}
+	applied, err := m.applied(context.Background())
+	if err != nil {
+		return err
+	}
+	versions := make([]int, 0, len(applied))
+	for v := range applied {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	target := 0
+	if n < len(versions) {
+		target = versions[len(versions)-n-1]
+	}
+	return m.Goto(target)
+}
+
+// Goto migrates the database up or down until exactly the migrations with a version
+// less than or equal to the target are applied. A target of 0 rolls back everything.
+// Each migration runs in its own transaction together with its bookkeeping row, so a
+// failing script leaves the database at the previous version.
+func (m *Migrator) Goto(target int) error {
+	if target != 0 && !m.known(target) {
+		return fmt.Errorf("%w: %d", ErrUnknownVersion, target)
+	}
+	ctx := context.Background()
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	// Refuse to touch a database whose history doesn't match the embedded files.
+	if err := m.verify(applied); err != nil {
+		return err
+	}
+	changed := false
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok || migration.Version > target {
+			continue
+		}
+		if err := m.apply(ctx, migration, true); err != nil {
 			return err
 		}
-		data, err := os.ReadFile(fmt.Sprintf("%s/%s", path, info.Name()))
+		changed = true
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok || migration.Version <= target {
+			continue
+		}
+		if err := m.apply(ctx, migration, false); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		return ErrNoChange
+	}
+	return nil
+}
+
+// The bookkeeping queries use $N placeholders, which PostgreSQL requires. SQLite
+// accepts them too, as parameters named "$1", "$2" and so on, which are bound in order.
+func (m *Migrator) apply(ctx context.Context, migration Migration, up bool) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	script, direction := migration.Up, "up"
+	if !up {
+		script, direction = migration.Down, "down"
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d (%s) %s: %w", migration.Version, migration.Name, direction, err)
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+			migration.Version, migration.Name, migration.Checksum)
+	} else {
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Force rewrites the schema_migrations table so that exactly the migrations up to and
+// including version are recorded as applied, with their current checksums. No
+// migration scripts are run. This is the escape hatch for repairing a database after
+// a manual fix or an intentional edit of an applied migration.
+func (m *Migrator) Force(version int) error {
+	if version != 0 && !m.known(version) {
+		return fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+	ctx := context.Background()
+	if err := m.init(ctx); err != nil {
+		return err
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations`); err != nil {
+		return err
+	}
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			break
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+			migration.Version, migration.Name, migration.Checksum)
 		if err != nil {
 			return err
 		}
-		if _, err := db.Exec(string(data)); err != nil {
-			log.Println("error razaq", err)
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) known(version int) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
 		}
 	}
-	return nil
+	return false
+}
+
+// Create writes an empty up/down pair for a new migration into the directory of every
+// dialect under dir, numbered one after the highest existing version, and returns the
+// paths of the new files.
+func Create(dir, name string) ([]string, error) {
+	if !nameRX.MatchString(name) {
+		return nil, fmt.Errorf("invalid migration name %q", name)
+	}
+	dialects := Dialects()
+	version := 1
+	for _, dialect := range dialects {
+		existing, err := load(os.DirFS(filepath.Join(dir, dialect)), ".")
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) > 0 {
+			version = max(version, existing[len(existing)-1].Version+1)
+		}
+	}
+	var paths []string
+	for _, dialect := range dialects {
+		for _, direction := range []string{"up", "down"} {
+			path := filepath.Join(dir, dialect, fmt.Sprintf("%06d_%s.%s.sql", version, name, direction))
+			if err := os.WriteFile(path, nil, 0o644); err != nil {
+				return nil, err
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
 }
 
+// DropAllDB drops every table of a SQLite database.
 func DropAllDB(db *sql.DB) error {
 	records := `DROP TABLE IF EXISTS`
 
@@ -0,0 +1,242 @@
+package migratedb
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testMigrations() fstest.MapFS {
+	return fstest.MapFS{
+		"m/000001_create_a.up.sql":   {Data: []byte("CREATE TABLE a (id INTEGER)")},
+		"m/000001_create_a.down.sql": {Data: []byte("DROP TABLE a")},
+		"m/000002_create_b.up.sql":   {Data: []byte("CREATE TABLE b (id INTEGER)")},
+		"m/000002_create_b.down.sql": {Data: []byte("DROP TABLE b")},
+		"m/000003_create_c.up.sql":   {Data: []byte("CREATE TABLE c (id INTEGER)")},
+		"m/000003_create_c.down.sql": {Data: []byte("DROP TABLE c")},
+	}
+}
+
+// newTestMigrator returns a Migrator for the migrations in the m directory of fsys,
+// working against db.
+func newTestMigrator(t *testing.T, db *sql.DB, fsys fstest.MapFS) *Migrator {
+	t.Helper()
+	migrations, err := load(fsys, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Migrator{db: db, migrations: migrations}
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func wantVersion(t *testing.T, m *Migrator, want int, tables ...string) {
+	t.Helper()
+	version, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != want {
+		t.Errorf("got version %d, want %d", version, want)
+	}
+	got, err := SelectAllTable(m.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = slices.DeleteFunc(got, func(table string) bool { return table == "schema_migrations" })
+	slices.Sort(got)
+	if !slices.Equal(got, tables) {
+		t.Errorf("got tables %v, want %v", got, tables)
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	m := newTestMigrator(t, openTestDB(t), testMigrations())
+	wantVersion(t, m, 0)
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	wantVersion(t, m, 3, "a", "b", "c")
+	if err := m.Up(); !errors.Is(err, ErrNoChange) {
+		t.Errorf("got %v for a second Up, want ErrNoChange", err)
+	}
+
+	if err := m.Down(2); err != nil {
+		t.Fatal(err)
+	}
+	wantVersion(t, m, 1, "a")
+	if err := m.Down(5); err != nil {
+		t.Fatal(err)
+	}
+	wantVersion(t, m, 0)
+	if err := m.Down(0); err == nil {
+		t.Error("got no error for rolling back 0 migrations")
+	}
+
+	// The up migrations apply again after the down ones.
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	wantVersion(t, m, 3, "a", "b", "c")
+}
+
+func TestGoto(t *testing.T) {
+	m := newTestMigrator(t, openTestDB(t), testMigrations())
+	for _, tt := range []struct {
+		target int
+		tables []string
+	}{
+		{2, []string{"a", "b"}},
+		{3, []string{"a", "b", "c"}},
+		{1, []string{"a"}},
+		{0, nil},
+	} {
+		if err := m.Goto(tt.target); err != nil {
+			t.Fatalf("Goto(%d): %v", tt.target, err)
+		}
+		wantVersion(t, m, tt.target, tt.tables...)
+	}
+	if err := m.Goto(4); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("got %v for an unknown version, want ErrUnknownVersion", err)
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	db := openTestDB(t)
+	fsys := testMigrations()
+	fsys["m/000003_create_c.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE c (id INTEGER); NOT SQL")}
+	m := newTestMigrator(t, db, fsys)
+
+	// The failing migration is rolled back together with its bookkeeping row.
+	if err := m.Up(); err == nil {
+		t.Fatal("got no error for a failing migration")
+	}
+	wantVersion(t, m, 2, "a", "b")
+
+	// After fixing the database by hand, Force records the migration as applied.
+	if _, err := db.Exec("CREATE TABLE c (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Force(3); err != nil {
+		t.Fatal(err)
+	}
+	wantVersion(t, m, 3, "a", "b", "c")
+	if err := m.Verify(); err != nil {
+		t.Error(err)
+	}
+	if err := m.Force(4); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("got %v for an unknown version, want ErrUnknownVersion", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	db := openTestDB(t)
+	if err := newTestMigrator(t, db, testMigrations()).Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Editing an applied migration is reported, and stops any further migrations.
+	fsys := testMigrations()
+	fsys["m/000002_create_b.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE b (id INTEGER, name TEXT)")}
+	m := newTestMigrator(t, db, fsys)
+	if err := m.Verify(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("got %v for an edited migration, want ErrChecksumMismatch", err)
+	}
+	if err := m.Goto(1); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Goto(1) got %v for an edited migration, want ErrChecksumMismatch", err)
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.Applied || s.Modified != (s.Version == 2) {
+			t.Errorf("got status %+v", s)
+		}
+	}
+	// Forcing the current version records the new checksums.
+	if err := m.Force(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	// A migration which was applied but is no longer in the set is reported too.
+	delete(fsys, "m/000003_create_c.up.sql")
+	delete(fsys, "m/000003_create_c.down.sql")
+	if err := newTestMigrator(t, db, fsys).Verify(); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("got %v for a missing migration, want ErrUnknownVersion", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	for name, file := range map[string]string{
+		"bad name":        "m/create_d.up.sql",
+		"version 0":       "m/000000_create_d.up.sql",
+		"name conflict":   "m/000003_create_d.down.sql",
+		"no up script":    "m/000004_create_d.down.sql",
+		"bad direction":   "m/000004_create_d.sideways.sql",
+		"hyphenated name": "m/000004_create-d.up.sql",
+	} {
+		fsys := testMigrations()
+		fsys[file] = &fstest.MapFile{}
+		if _, err := load(fsys, "m"); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	for _, dialect := range Dialects() {
+		if err := os.Mkdir(filepath.Join(dir, dialect), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The new version follows the highest one of any dialect.
+	sqlite := filepath.Join(dir, "sqlite")
+	for _, name := range []string{"000002_create_b.up.sql", "000002_create_b.down.sql"} {
+		if err := os.WriteFile(filepath.Join(sqlite, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := Create(dir, "create_c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "postgres", "000003_create_c.up.sql"),
+		filepath.Join(dir, "postgres", "000003_create_c.down.sql"),
+		filepath.Join(dir, "sqlite", "000003_create_c.up.sql"),
+		filepath.Join(dir, "sqlite", "000003_create_c.down.sql"),
+	}
+	if !slices.Equal(paths, want) {
+		t.Errorf("got paths %v, want %v", paths, want)
+	}
+	for _, path := range want {
+		if _, err := os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := Create(dir, "create c"); err == nil {
+		t.Error("got no error for an invalid name")
+	}
+}
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS movies_title_idx;
+DROP TABLE IF EXISTS movies;
@@ -0,0 +1,12 @@
+-- Unlike the SQLite schema, the movies table never had a genres column here: the
+-- genres live in the movies_genres table created by migration 000006.
+CREATE TABLE IF NOT EXISTS movies (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    title text NOT NULL,
+    year integer NOT NULL CHECK (year BETWEEN 1888 AND date_part('year', now())),
+    runtime integer NOT NULL CHECK (runtime >= 0),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS movies_title_idx ON movies (title);
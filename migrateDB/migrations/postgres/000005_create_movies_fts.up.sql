@@ -0,0 +1,3 @@
+-- Full-text index over movie titles. The movie search matches against exactly this
+-- to_tsvector() expression, so that it can use the index.
+CREATE INDEX IF NOT EXISTS movies_title_fts_idx ON movies USING GIN (to_tsvector('english', title));
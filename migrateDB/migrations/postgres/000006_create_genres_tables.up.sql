@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS genres (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS movies_genres (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    genre_id bigint NOT NULL REFERENCES genres ON DELETE CASCADE,
+    PRIMARY KEY (movie_id, genre_id)
+);
+
+CREATE INDEX IF NOT EXISTS movies_genres_genre_id_idx ON movies_genres (genre_id);
+
+-- The managed genre vocabulary.
+INSERT INTO genres (name) VALUES
+    ('action'), ('adventure'), ('animation'), ('biography'), ('comedy'), ('crime'),
+    ('documentary'), ('drama'), ('family'), ('fantasy'), ('history'), ('horror'),
+    ('music'), ('musical'), ('mystery'), ('romance'), ('sci-fi'), ('sport'),
+    ('thriller'), ('war'), ('western')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,17 @@
+-- Emails are queued here in the same transaction as the change they are about, and
+-- delivered by the outbox workers. An email stays pending until it is sent or has
+-- failed too many times; next_attempt_at is when a worker may next pick it up.
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    recipient text NOT NULL,
+    template text NOT NULL,
+    data text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp with time zone NOT NULL,
+    last_error text NOT NULL DEFAULT '',
+    sent_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS email_outbox_due_idx ON email_outbox (status, next_attempt_at);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS email_opt_outs;
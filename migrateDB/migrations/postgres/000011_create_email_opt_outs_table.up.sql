@@ -0,0 +1,7 @@
+-- The categories of non-transactional email each user doesn't want to receive.
+CREATE TABLE IF NOT EXISTS email_opt_outs (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    category text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, category)
+);
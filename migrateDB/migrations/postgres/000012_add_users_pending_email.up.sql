@@ -0,0 +1,3 @@
+-- The address a user asked to change their email to, which replaces email once they
+-- confirm it with the token sent there. Empty when no change is pending.
+ALTER TABLE users ADD COLUMN pending_email text NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS tokens_expiry_idx;
+DROP INDEX IF EXISTS tokens_user_id_idx;
+ALTER TABLE tokens DROP COLUMN ip;
+ALTER TABLE tokens DROP COLUMN user_agent;
+ALTER TABLE tokens DROP COLUMN last_used_at;
+ALTER TABLE tokens DROP COLUMN created_at;
+ALTER TABLE tokens DROP COLUMN id;
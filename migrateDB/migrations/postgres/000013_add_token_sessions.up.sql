@@ -0,0 +1,14 @@
+-- Authentication tokens are the sessions of a user, which they can list and revoke
+-- one by one, so tokens get an id to refer to them by, and remember when they were
+-- created and last used, and the user agent and address they were used from. The
+-- tokens issued before this migration count as created and last used when it ran.
+ALTER TABLE tokens ADD COLUMN id bigserial UNIQUE;
+ALTER TABLE tokens ADD COLUMN created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN last_used_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN user_agent text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN ip text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_idx ON tokens (user_id);
+
+-- The token janitor deletes the expired tokens.
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
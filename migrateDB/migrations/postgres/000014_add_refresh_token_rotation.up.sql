@@ -0,0 +1,11 @@
+-- Every sign-in starts a family of tokens. An authentication token is a family of its
+-- own, while a refresh token is replaced by a new one of the same family every time it
+-- is used, and kept, marked with rotated_at, so that using it again can be recognized
+-- as the reuse of a stolen token. The tokens issued before this migration each get a
+-- family of their own.
+ALTER TABLE tokens ADD COLUMN family text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN rotated_at timestamp(0) with time zone;
+
+UPDATE tokens SET family = encode(hash, 'hex');
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
@@ -0,0 +1,26 @@
+-- Full-text index over movie titles. This is an external content table, so it only
+-- stores the index and reads the titles back from the movies table. It requires a
+-- SQLite build with FTS5 enabled (build with -tags sqlite_fts5).
+CREATE VIRTUAL TABLE IF NOT EXISTS movies_fts USING fts5(
+    title,
+    content='movies',
+    content_rowid='id',
+    tokenize='porter unicode61 remove_diacritics 2'
+);
+
+-- Keep the index in sync with the movies table.
+CREATE TRIGGER IF NOT EXISTS movies_fts_insert AFTER INSERT ON movies BEGIN
+    INSERT INTO movies_fts(rowid, title) VALUES (new.id, new.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS movies_fts_delete AFTER DELETE ON movies BEGIN
+    INSERT INTO movies_fts(movies_fts, rowid, title) VALUES ('delete', old.id, old.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS movies_fts_update AFTER UPDATE OF title ON movies BEGIN
+    INSERT INTO movies_fts(movies_fts, rowid, title) VALUES ('delete', old.id, old.title);
+    INSERT INTO movies_fts(rowid, title) VALUES (new.id, new.title);
+END;
+
+-- Index the rows that existed before this migration.
+INSERT INTO movies_fts(movies_fts) VALUES ('rebuild');
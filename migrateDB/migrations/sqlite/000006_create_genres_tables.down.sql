@@ -0,0 +1,13 @@
+ALTER TABLE movies ADD COLUMN genres TEXT NOT NULL DEFAULT '';
+
+UPDATE movies SET genres = COALESCE((
+    SELECT group_concat(genres.name, ',')
+    FROM movies_genres
+    INNER JOIN genres ON genres.id = movies_genres.genre_id
+    WHERE movies_genres.movie_id = movies.id
+), '');
+
+CREATE INDEX IF NOT EXISTS movies_genres_idx ON movies(genres);
+
+DROP TABLE IF EXISTS movies_genres;
+DROP TABLE IF EXISTS genres;
@@ -0,0 +1,45 @@
+CREATE TABLE IF NOT EXISTS genres (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS movies_genres (
+    movie_id INTEGER NOT NULL REFERENCES movies(id) ON DELETE CASCADE,
+    genre_id INTEGER NOT NULL REFERENCES genres(id) ON DELETE CASCADE,
+    PRIMARY KEY (movie_id, genre_id)
+);
+
+CREATE INDEX IF NOT EXISTS movies_genres_genre_id_idx ON movies_genres(genre_id);
+
+-- The managed genre vocabulary.
+INSERT OR IGNORE INTO genres (name) VALUES
+    ('action'), ('adventure'), ('animation'), ('biography'), ('comedy'), ('crime'),
+    ('documentary'), ('drama'), ('family'), ('fantasy'), ('history'), ('horror'),
+    ('music'), ('musical'), ('mystery'), ('romance'), ('sci-fi'), ('sport'),
+    ('thriller'), ('war'), ('western');
+
+-- Split the existing comma-separated genre strings into one row per genre, adding any
+-- genre that isn't in the vocabulary yet so that no data is lost.
+CREATE TEMP TABLE movie_genre_names AS
+WITH RECURSIVE split(movie_id, name, rest) AS (
+    SELECT id, '', genres || ',' FROM movies
+    UNION ALL
+    SELECT movie_id,
+           lower(trim(substr(rest, 1, instr(rest, ',') - 1))),
+           substr(rest, instr(rest, ',') + 1)
+    FROM split
+    WHERE rest <> ''
+)
+SELECT DISTINCT movie_id, name FROM split WHERE name <> '';
+
+INSERT OR IGNORE INTO genres (name) SELECT DISTINCT name FROM movie_genre_names;
+
+INSERT OR IGNORE INTO movies_genres (movie_id, genre_id)
+SELECT movie_genre_names.movie_id, genres.id
+FROM movie_genre_names
+INNER JOIN genres ON genres.name = movie_genre_names.name;
+
+DROP TABLE movie_genre_names;
+
+DROP INDEX IF EXISTS movies_genres_idx;
+ALTER TABLE movies DROP COLUMN genres;
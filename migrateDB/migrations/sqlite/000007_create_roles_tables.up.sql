@@ -0,0 +1,40 @@
+-- Permission codes were never unique, so drop any duplicate before enforcing it. The
+-- grants of a duplicate are moved over to the code's first row.
+INSERT OR IGNORE INTO users_permissions (user_id, permission_id)
+SELECT users_permissions.user_id, firsts.id
+FROM users_permissions
+INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+INNER JOIN (SELECT code, min(id) AS id FROM permissions GROUP BY code) AS firsts
+    ON firsts.code = permissions.code;
+
+DELETE FROM permissions WHERE id NOT IN (SELECT min(id) FROM permissions GROUP BY code);
+
+CREATE UNIQUE INDEX IF NOT EXISTS permissions_code_idx ON permissions(code);
+
+INSERT OR IGNORE INTO permissions (code) VALUES ('movies:read'), ('movies:write');
+
+CREATE TABLE IF NOT EXISTS roles (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    permission_id INTEGER NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT OR IGNORE INTO roles (name) VALUES ('admin'), ('editor'), ('viewer');
+
+INSERT OR IGNORE INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'viewer' AND permissions.code = 'movies:read')
+   OR (roles.name = 'editor' AND permissions.code IN ('movies:read', 'movies:write'))
+   OR (roles.name = 'admin' AND permissions.code IN ('movies:read', 'movies:write'));
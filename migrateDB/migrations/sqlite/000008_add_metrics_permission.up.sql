@@ -0,0 +1,6 @@
+INSERT OR IGNORE INTO permissions (code) VALUES ('metrics:view');
+
+INSERT OR IGNORE INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'metrics:view';
@@ -0,0 +1,6 @@
+-- The locale a user gets their emails in, such as 'en' or 'fr'. An empty locale means
+-- that it is picked from the Accept-Language header of the request behind each email.
+ALTER TABLE users ADD COLUMN locale text NOT NULL DEFAULT '';
+
+-- The locale an email is rendered in, chosen when it is queued.
+ALTER TABLE email_outbox ADD COLUMN locale text NOT NULL DEFAULT '';
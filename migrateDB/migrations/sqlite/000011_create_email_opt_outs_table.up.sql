@@ -0,0 +1,7 @@
+-- The categories of non-transactional email each user doesn't want to receive.
+CREATE TABLE IF NOT EXISTS email_opt_outs (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    category text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, category)
+);
@@ -0,0 +1,13 @@
+CREATE TABLE tokens_old (
+    hash BLOB PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expiry timestamp NOT NULL,
+    scope text NOT NULL
+);
+
+INSERT INTO tokens_old (hash, user_id, expiry, scope)
+SELECT hash, user_id, expiry, scope FROM tokens;
+
+DROP TABLE tokens;
+
+ALTER TABLE tokens_old RENAME TO tokens;
@@ -0,0 +1,28 @@
+-- Authentication tokens are the sessions of a user, which they can list and revoke
+-- one by one, so tokens get an id to refer to them by, and remember when they were
+-- created and last used, and the user agent and address they were used from. SQLite
+-- can't add a primary key to an existing table, so the table is rebuilt. The tokens
+-- issued before this migration count as created and last used when it ran.
+CREATE TABLE tokens_new (
+    id INTEGER PRIMARY KEY,
+    hash BLOB NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expiry timestamp NOT NULL,
+    scope text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    user_agent text NOT NULL DEFAULT '',
+    ip text NOT NULL DEFAULT ''
+);
+
+INSERT INTO tokens_new (hash, user_id, expiry, scope)
+SELECT hash, user_id, expiry, scope FROM tokens;
+
+DROP TABLE tokens;
+
+ALTER TABLE tokens_new RENAME TO tokens;
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_idx ON tokens (user_id);
+
+-- The token janitor deletes the expired tokens.
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
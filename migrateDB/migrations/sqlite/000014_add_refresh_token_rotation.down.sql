@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS tokens_family_idx;
+ALTER TABLE tokens DROP COLUMN rotated_at;
+ALTER TABLE tokens DROP COLUMN family;